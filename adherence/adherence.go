@@ -0,0 +1,297 @@
+package adherence
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/bp_readings"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/sites"
+)
+
+const (
+	defaultSilenceThresholdHours = 72
+
+	selectExpectations  = `SELECT data_type, expected_per_week FROM adherence_expectations WHERE study_id = $1 ORDER BY data_type`
+	selectSettings      = `SELECT silence_threshold_hours FROM adherence_settings WHERE study_id = $1`
+	selectStudyPatients = `SELECT participant_id, COALESCE(site_id, '') FROM participants p WHERE study_id = $1 AND capacity_id = 'patient' AND `
+	selectStudyVitals   = `SELECT b.participant_id, b.created_at FROM bp_readings b
+JOIN participants p ON p.participant_id = b.participant_id WHERE p.study_id = $1`
+	selectStudySymptoms = `SELECT s.participant_id, s.created_at FROM mme_symptoms s
+JOIN participants p ON p.participant_id = s.participant_id WHERE p.study_id = $1`
+	selectStudyFiles = `SELECT participant_id, extension, uploaded_at FROM files
+WHERE study_id = $1 AND uploaded_at BETWEEN $2 AND $3`
+)
+
+// Expectation number of uploads of a data type expected every week
+type Expectation struct {
+	DataType        string `json:"dataType"`
+	ExpectedPerWeek int    `json:"expectedPerWeek"`
+}
+
+// WeekAdherence expected versus received uploads of one data type in one week
+type WeekAdherence struct {
+	WeekStart string `json:"weekStart"`
+	DataType  string `json:"dataType"`
+	Expected  int    `json:"expected"`
+	Received  int    `json:"received"`
+}
+
+// ParticipantAdherence adherence of one participant over the report range
+type ParticipantAdherence struct {
+	ParticipantID     int64           `json:"participantID"`
+	Site              string          `json:"site"`
+	LastUpload        *time.Time      `json:"lastUpload"`
+	CurrentStreakDays int             `json:"currentStreakDays"`
+	LongestGapDays    int             `json:"longestGapDays"`
+	Silent            bool            `json:"silent"`
+	Weeks             []WeekAdherence `json:"weeks"`
+}
+
+// SiteAdherence adherence of the participants of one site, the weeks add up
+// the expected and received uploads of all of them. Site is empty for the
+// participants without a site.
+type SiteAdherence struct {
+	Site         string          `json:"site"`
+	Participants int             `json:"participants"`
+	Silent       int             `json:"silent"`
+	Weeks        []WeekAdherence `json:"weeks"`
+}
+
+// Report adherence of every participant of a study the coordinator sees
+type Report struct {
+	Study                 string                 `json:"study"`
+	From                  time.Time              `json:"from"`
+	To                    time.Time              `json:"to"`
+	SilenceThresholdHours int                    `json:"silenceThresholdHours"`
+	Expectations          []Expectation          `json:"expectations"`
+	Participants          []ParticipantAdherence `json:"participants"`
+	Sites                 []SiteAdherence        `json:"sites"`
+}
+
+// upload one received piece of data
+type upload struct {
+	dataType string
+	at       time.Time
+}
+
+// BuildReport computes the adherence report of the participants of a study at
+// the coordinator's sites between from and to. Only data types with an
+// expectation configured for the study are reported per week, but every upload
+// counts towards streaks, gaps and silence.
+func BuildReport(study string, coordinatorID int64, from time.Time, to time.Time, now time.Time) (Report, error) {
+	report := Report{Study: study, From: from, To: to, SilenceThresholdHours: defaultSilenceThresholdHours}
+
+	expectations, err := studyExpectations(study)
+	if err != nil {
+		return report, err
+	}
+	report.Expectations = expectations
+
+	err = database.ADB.Db.QueryRow(selectSettings, study).Scan(&report.SilenceThresholdHours)
+	if err != nil {
+		report.SilenceThresholdHours = defaultSilenceThresholdHours
+	}
+
+	participantSites, err := studyPatients(study, coordinatorID)
+	if err != nil {
+		return report, err
+	}
+	uploads, err := studyUploads(study, from, to)
+	if err != nil {
+		return report, err
+	}
+
+	threshold := time.Duration(report.SilenceThresholdHours) * time.Hour
+	for _, ps := range participantSites {
+		pa := participantAdherence(ps.id, uploads[ps.id], expectations, from, to, now, threshold)
+		pa.Site = ps.site
+		report.Participants = append(report.Participants, pa)
+	}
+	report.Sites = siteAdherence(report.Participants)
+	return report, nil
+}
+
+// siteAdherence sums the participants of each site in order of the site ids.
+// Every participant has the same weeks in the same order.
+func siteAdherence(participants []ParticipantAdherence) []SiteAdherence {
+	index := map[string]int{}
+	summaries := []SiteAdherence{}
+	for _, pa := range participants {
+		i, ok := index[pa.Site]
+		if !ok {
+			i = len(summaries)
+			index[pa.Site] = i
+			weeks := make([]WeekAdherence, len(pa.Weeks))
+			for w, week := range pa.Weeks {
+				weeks[w] = WeekAdherence{WeekStart: week.WeekStart, DataType: week.DataType}
+			}
+			summaries = append(summaries, SiteAdherence{Site: pa.Site, Weeks: weeks})
+		}
+		summaries[i].Participants++
+		if pa.Silent {
+			summaries[i].Silent++
+		}
+		for w, week := range pa.Weeks {
+			summaries[i].Weeks[w].Expected += week.Expected
+			summaries[i].Weeks[w].Received += week.Received
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Site < summaries[j].Site })
+	return summaries
+}
+
+func participantAdherence(ptid int64, uploads []upload, expectations []Expectation, from time.Time, to time.Time, now time.Time, threshold time.Duration) ParticipantAdherence {
+	pa := ParticipantAdherence{ParticipantID: ptid}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].at.Before(uploads[j].at) })
+
+	received := map[string]map[string]int{}
+	days := map[string]bool{}
+	for _, u := range uploads {
+		week := WeekStart(u.at).Format("2006-01-02")
+		if received[week] == nil {
+			received[week] = map[string]int{}
+		}
+		received[week][u.dataType]++
+		days[u.at.Format("2006-01-02")] = true
+	}
+
+	if len(uploads) > 0 {
+		last := uploads[len(uploads)-1].at
+		pa.LastUpload = &last
+		pa.Silent = now.Sub(last) > threshold
+	} else {
+		pa.Silent = true
+	}
+	pa.CurrentStreakDays, pa.LongestGapDays = streakAndGap(days, from, to)
+
+	for week := WeekStart(from); !week.After(to); week = week.AddDate(0, 0, 7) {
+		weekString := week.Format("2006-01-02")
+		for _, e := range expectations {
+			pa.Weeks = append(pa.Weeks, WeekAdherence{
+				WeekStart: weekString,
+				DataType:  e.DataType,
+				Expected:  e.ExpectedPerWeek,
+				Received:  received[weekString][e.DataType],
+			})
+		}
+	}
+	return pa
+}
+
+// streakAndGap walks the days of the range. The streak is the number of
+// consecutive days with an upload ending on the last day of the range, the gap
+// is the longest run of days without any upload.
+func streakAndGap(days map[string]bool, from time.Time, to time.Time) (int, int) {
+	var gap, longestGap, streak int
+	for day := from.Truncate(24 * time.Hour); !day.After(to); day = day.AddDate(0, 0, 1) {
+		if days[day.Format("2006-01-02")] {
+			streak++
+			gap = 0
+		} else {
+			streak = 0
+			gap++
+			if gap > longestGap {
+				longestGap = gap
+			}
+		}
+	}
+	return streak, longestGap
+}
+
+// WeekStart monday 00:00 UTC of the week containing t
+func WeekStart(t time.Time) time.Time {
+	t = t.UTC().Truncate(24 * time.Hour)
+	offset := (int(t.Weekday()) + 6) % 7
+	return t.AddDate(0, 0, -offset)
+}
+
+func studyExpectations(study string) ([]Expectation, error) {
+	rows, err := database.ADB.Db.Query(selectExpectations, study)
+	if err != nil {
+		log.Println("failed to query adherence expectations")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expectations []Expectation
+	for rows.Next() {
+		var e Expectation
+		if err := rows.Scan(&e.DataType, &e.ExpectedPerWeek); err != nil {
+			return nil, err
+		}
+		expectations = append(expectations, e)
+	}
+	return expectations, rows.Err()
+}
+
+// participantSite a participant of the report and its site
+type participantSite struct {
+	id   int64
+	site string
+}
+
+func studyPatients(study string, coordinatorID int64) ([]participantSite, error) {
+	query := selectStudyPatients + sites.Condition("p.site_id", 2) + ` ORDER BY participant_id`
+	rows, err := database.ADB.Db.Query(query, study, coordinatorID)
+	if err != nil {
+		log.Println("failed to query study participants")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participants []participantSite
+	for rows.Next() {
+		var ps participantSite
+		if err := rows.Scan(&ps.id, &ps.site); err != nil {
+			return nil, err
+		}
+		participants = append(participants, ps)
+	}
+	return participants, rows.Err()
+}
+
+// studyUploads every vital, symptom and file upload of the study in the range
+// grouped by participant
+func studyUploads(study string, from time.Time, to time.Time) (map[int64][]upload, error) {
+	uploads := map[int64][]upload{}
+
+	for dataType, query := range map[string]string{"vitals": selectStudyVitals, "symptoms": selectStudySymptoms} {
+		rows, err := database.ADB.Db.Query(query, study)
+		if err != nil {
+			log.Printf("failed to query %s for adherence\n", dataType)
+			return nil, err
+		}
+		for rows.Next() {
+			var ptid, createdAt int64
+			if err := rows.Scan(&ptid, &createdAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			at := bp_readings.CreatedAtTime(createdAt)
+			if at.Before(from) || at.After(to) {
+				continue
+			}
+			uploads[ptid] = append(uploads[ptid], upload{dataType: dataType, at: at})
+		}
+		rows.Close()
+	}
+
+	rows, err := database.ADB.Db.Query(selectStudyFiles, study, from, to)
+	if err != nil {
+		log.Println("failed to query files for adherence")
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ptid int64
+		var u upload
+		if err := rows.Scan(&ptid, &u.dataType, &u.at); err != nil {
+			return nil, err
+		}
+		u.at = u.at.UTC()
+		uploads[ptid] = append(uploads[ptid], u)
+	}
+	return uploads, rows.Err()
+}
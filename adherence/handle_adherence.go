@@ -0,0 +1,108 @@
+package adherence
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+)
+
+const dateLayout = "2006-01-02"
+
+// ReportHandler serves the adherence report of the coordinator's study and sites.
+// GET ?from=2006-01-02&to=2006-01-02[&format=csv], defaults to the last four weeks.
+type ReportHandler struct {
+	Name string
+}
+
+func (h ReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Building adherence report...")
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now().UTC()
+	from, to, ok := reportRange(r, now)
+	if !ok {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"from and to must be formatted as YYYY-MM-DD"}`))
+		return
+	}
+
+	report, err := BuildReport(claims.Study, claims.ID, from, to, now)
+	if err != nil {
+		log.Println("failed to build adherence report")
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"unable to build adherence report"}`))
+		return
+	}
+
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="adherence_`+from.Format(dateLayout)+`_`+to.Format(dateLayout)+`.csv"`)
+		writeCSV(w, report)
+		return
+	}
+	jsonObject, _ := json.Marshal(report)
+	w.Write(jsonObject)
+}
+
+func reportRange(r *http.Request, now time.Time) (time.Time, time.Time, bool) {
+	to := now
+	from := WeekStart(now).AddDate(0, 0, -21)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return from, to, false
+		}
+		from = t
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return from, to, false
+		}
+		// include the whole last day
+		to = t.Add(24*time.Hour - time.Millisecond)
+	}
+	return from, to, !to.Before(from)
+}
+
+// writeCSV one row per participant, week and data type. Participant level
+// columns are repeated on every row so the file can be filtered in a spreadsheet.
+// Site summaries are only in the json report.
+func writeCSV(w http.ResponseWriter, report Report) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"participant_id", "week_start", "data_type", "expected", "received",
+		"last_upload", "current_streak_days", "longest_gap_days", "silent", "site"})
+	for _, p := range report.Participants {
+		lastUpload := ""
+		if p.LastUpload != nil {
+			lastUpload = p.LastUpload.Format(time.RFC3339)
+		}
+		participantColumns := []string{lastUpload, strconv.Itoa(p.CurrentStreakDays),
+			strconv.Itoa(p.LongestGapDays), strconv.FormatBool(p.Silent), p.Site}
+		if len(p.Weeks) == 0 {
+			cw.Write(append([]string{strconv.FormatInt(p.ParticipantID, 10), "", "", "", ""}, participantColumns...))
+			continue
+		}
+		for _, week := range p.Weeks {
+			cw.Write(append([]string{strconv.FormatInt(p.ParticipantID, 10), week.WeekStart, week.DataType,
+				strconv.Itoa(week.Expected), strconv.Itoa(week.Received)}, participantColumns...))
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Write failed: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package alerts
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/messages"
+	"github.com/cliffordlab/amoss_services/support/moyo_mom_emory"
+)
+
+const (
+	defaultEscalateAfterMinutes = 30
+
+	selectAlertsToEscalate = `SELECT a.alert_id, a.study_id, a.site_id, a.message FROM alerts a
+LEFT JOIN alert_escalation_settings s ON s.study_id = a.study_id
+WHERE a.status = 'open' AND a.severity = 'severe' AND a.escalated_at IS NULL
+AND a.created_at < now() - make_interval(mins => COALESCE(s.escalate_after_minutes, $1))
+AND NOT EXISTS (SELECT 1 FROM participants p WHERE p.participant_id = a.participant_id
+AND p.lifecycle_state IN ('completed', 'withdrawn'))`
+	// the row lock keeps a second server from escalating the same alert, it
+	// skips alerts being escalated elsewhere
+	claimEscalation = `SELECT alert_id FROM alerts WHERE alert_id = $1 AND escalated_at IS NULL FOR UPDATE SKIP LOCKED`
+	// contacts of the alert's site and of the whole study that were not sent the alert yet
+	selectSecondaryContacts = `SELECT DISTINCT c.phone FROM alert_contacts c WHERE c.study_id = $1 AND c.level = 'secondary'
+AND (c.site_id IS NULL OR c.site_id = $2)
+AND NOT EXISTS (SELECT 1 FROM alert_escalation_deliveries d WHERE d.alert_id = $3 AND d.phone = c.phone)`
+	insertDelivery  = `INSERT INTO alert_escalation_deliveries (alert_id, phone) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	updateEscalated = `UPDATE alerts SET escalated_at = now() WHERE alert_id = $1 AND escalated_at IS NULL`
+)
+
+type escalation struct {
+	alertID int64
+	study   string
+	site    sql.NullString
+	message string
+}
+
+// StartEscalation checks every interval for severe alerts nobody acknowledged
+// in time and sends them to the secondary contacts of the study and the
+// alert's site
+func StartEscalation(interval time.Duration) {
+	log.Println("Starting alert escalation...")
+	go func() {
+		for {
+			escalate()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func escalate() {
+	rows, err := database.ADB.Db.Query(selectAlertsToEscalate, defaultEscalateAfterMinutes)
+	if err != nil {
+		log.Println("failed to query alerts to escalate")
+		log.Println(err)
+		return
+	}
+	var pending []escalation
+	for rows.Next() {
+		var e escalation
+		if err := rows.Scan(&e.alertID, &e.study, &e.site, &e.message); err != nil {
+			log.Println(err)
+			continue
+		}
+		pending = append(pending, e)
+	}
+	rows.Close()
+
+	for _, e := range pending {
+		if err := escalateAlert(e); err != nil {
+			// the transaction rolled back, nothing was queued and the next pass tries again
+			log.Printf("failed to escalate alert %d: %s\n", e.alertID, err.Error())
+		}
+	}
+}
+
+// escalateAlert queues the texts to every contact not reached yet, records
+// each delivery and marks the alert escalated in one transaction
+func escalateAlert(e escalation) error {
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var claimed int64
+	err = tx.QueryRow(claimEscalation, e.alertID).Scan(&claimed)
+	if err == sql.ErrNoRows {
+		// escalated meanwhile or being escalated by another server
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	contacts, err := secondaryContacts(tx, e)
+	if err != nil {
+		return err
+	}
+	note := "sent to secondary contacts"
+	if len(contacts) == 0 {
+		log.Printf("no secondary contacts for study %s, alert %d not sent\n", e.study, e.alertID)
+		note = "no secondary contacts configured"
+	}
+	message := "(ESCALATED) " + e.message
+	if rendered, err := messages.Render(e.study, "", messages.Escalation, map[string]interface{}{"Message": e.message}); err == nil {
+		message = rendered.Text
+	}
+	for _, phone := range contacts {
+		if err := moyo_mom_emory.SendEscalationSMS(tx, phone, &message); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(insertDelivery, e.alertID, phone); err != nil {
+			return err
+		}
+	}
+	err = updateWithEventTx(tx, updateEscalated, []interface{}{e.alertID}, e.alertID, "escalated", nil, note)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func secondaryContacts(tx *sql.Tx, e escalation) ([]string, error) {
+	rows, err := tx.Query(selectSecondaryContacts, e.study, e.site, e.alertID)
+	if err != nil {
+		log.Println("failed to query secondary contacts")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var phones []string
+	for rows.Next() {
+		var phone string
+		if err := rows.Scan(&phone); err != nil {
+			return nil, err
+		}
+		phones = append(phones, phone)
+	}
+	return phones, rows.Err()
+}
@@ -0,0 +1,298 @@
+package alerts
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/bp_readings"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/messages"
+)
+
+const (
+	// created_at is stored either as unix millis or with the leading "1"
+	// dropped, so a time bound is checked against both encodings
+	selectRecentVitals = `SELECT created_at, systolic_bp, diastolic_bp, pulse FROM bp_readings
+WHERE participant_id = $1 AND ((created_at < 1000000000000 AND created_at >= $2) OR created_at >= $3)`
+	selectRecentSymptoms = `SELECT created_at, blurried_vision, headache, difficulty_breathing, side_pain FROM mme_symptoms
+WHERE participant_id = $1 AND ((created_at < 1000000000000 AND created_at >= $2) OR created_at >= $3)`
+	// participants that completed or withdrew from the study are no longer monitored
+	selectMonitored = `SELECT lifecycle_state IN ('enrollment', 'active') FROM participants WHERE participant_id = $1`
+)
+
+// Reading one blood pressure reading
+type Reading struct {
+	CreatedAt time.Time
+	SBP       int
+	DBP       int
+	Pulse     int
+}
+
+// SymptomReport one symptoms questionnaire
+type SymptomReport struct {
+	CreatedAt           time.Time
+	BlurriedVision      bool
+	Headache            bool
+	DifficultyBreathing bool
+	SidePain            bool
+}
+
+// Count number of symptoms reported
+func (s SymptomReport) Count() int {
+	count := 0
+	for _, present := range []bool{s.BlurriedVision, s.Headache, s.DifficultyBreathing, s.SidePain} {
+		if present {
+			count++
+		}
+	}
+	return count
+}
+
+// Alert a rule that fired for a participant
+type Alert struct {
+	ParticipantID int64     `json:"participantID"`
+	Rule          string    `json:"rule"`
+	Severity      string    `json:"severity"`
+	Message       string    `json:"message"`
+	ReadingAt     time.Time `json:"readingAt"`
+}
+
+// EvaluateVitals checks a new reading against the participant's rules and
+// recent history. The reading may already be saved in bp_readings. Nothing
+// fires for participants that completed or withdrew from the study.
+func EvaluateVitals(study string, participantID int64, reading Reading) ([]Alert, error) {
+	if ok, err := monitored(participantID); !ok {
+		return nil, err
+	}
+	rules, err := RulesFor(study, participantID)
+	if err != nil {
+		return nil, err
+	}
+	since := reading.CreatedAt.Add(-maxWindow(rules))
+	vitals, err := recentVitals(participantID, since)
+	if err != nil {
+		return nil, err
+	}
+	symptoms, err := recentSymptoms(participantID, since)
+	if err != nil {
+		return nil, err
+	}
+	return vitalsAlerts(rules, study, participantID, reading, vitals, symptoms), nil
+}
+
+// EvaluateSymptoms checks a new symptoms report against the participant's
+// rules and recent readings
+func EvaluateSymptoms(study string, participantID int64, report SymptomReport) ([]Alert, error) {
+	if ok, err := monitored(participantID); !ok {
+		return nil, err
+	}
+	rules, err := RulesFor(study, participantID)
+	if err != nil {
+		return nil, err
+	}
+	vitals, err := recentVitals(participantID, report.CreatedAt.Add(-maxWindow(rules)))
+	if err != nil {
+		return nil, err
+	}
+	return symptomsAlerts(rules, study, participantID, report, vitals), nil
+}
+
+// monitored reports whether alerts fire for the participant
+func monitored(participantID int64) (bool, error) {
+	var ok bool
+	err := database.ADB.Db.QueryRow(selectMonitored, participantID).Scan(&ok)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return ok, err
+}
+
+func vitalsAlerts(rules []Rule, study string, participantID int64, reading Reading, vitals []Reading, symptoms []SymptomReport) []Alert {
+	var alerts []Alert
+	severe := false
+	for _, rule := range rules {
+		if !rule.Enabled || rule.Kind != KindSevereBP {
+			continue
+		}
+		if atOrAbove(reading, rule.Params) {
+			severe = true
+			alerts = append(alerts, newAlert(study, participantID, reading.CreatedAt, rule, messages.AlertSevereBP, map[string]interface{}{
+				"ParticipantID": participantID, "SBP": reading.SBP, "DBP": reading.DBP, "Pulse": reading.Pulse}))
+		}
+	}
+
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		p := rule.Params
+		switch rule.Kind {
+		case KindMildBPRepeat:
+			// a severe reading already alerted on its own
+			if severe || !atOrAbove(reading, p) {
+				continue
+			}
+			count := 1
+			for _, v := range withinWindow(vitals, reading.CreatedAt, p.WindowHours) {
+				if !v.CreatedAt.Equal(reading.CreatedAt) && atOrAbove(v, p) {
+					count++
+				}
+			}
+			if count >= p.Count {
+				alerts = append(alerts, newAlert(study, participantID, reading.CreatedAt, rule, messages.AlertMildBPRepeat, map[string]interface{}{
+					"ParticipantID": participantID, "Count": count, "WindowHours": p.WindowHours, "SBP": reading.SBP, "DBP": reading.DBP}))
+			}
+		case KindPulseRange:
+			if reading.Pulse > 0 && (reading.Pulse < p.PulseMin || reading.Pulse > p.PulseMax) {
+				alerts = append(alerts, newAlert(study, participantID, reading.CreatedAt, rule, messages.AlertPulseRange, map[string]interface{}{
+					"ParticipantID": participantID, "Pulse": reading.Pulse, "PulseMin": p.PulseMin, "PulseMax": p.PulseMax}))
+			}
+		case KindSymptomsWithBP:
+			if !atOrAbove(reading, p) {
+				continue
+			}
+			for _, s := range symptoms {
+				if s.Count() >= p.MinSymptoms && within(s.CreatedAt, reading.CreatedAt, p.WindowHours) {
+					alerts = append(alerts, newAlert(study, participantID, reading.CreatedAt, rule, messages.AlertSymptomsWithBP,
+						symptomsData(participantID, reading, s)))
+					break
+				}
+			}
+		}
+	}
+	return alerts
+}
+
+func symptomsAlerts(rules []Rule, study string, participantID int64, report SymptomReport, vitals []Reading) []Alert {
+	var alerts []Alert
+	for _, rule := range rules {
+		p := rule.Params
+		if !rule.Enabled || report.Count() < p.MinSymptoms {
+			continue
+		}
+		switch rule.Kind {
+		case KindSymptoms:
+			alerts = append(alerts, newAlert(study, participantID, report.CreatedAt, rule, messages.AlertSymptoms,
+				symptomsData(participantID, Reading{}, report)))
+		case KindSymptomsWithBP:
+			for _, v := range vitals {
+				if atOrAbove(v, p) && within(v.CreatedAt, report.CreatedAt, p.WindowHours) {
+					alerts = append(alerts, newAlert(study, participantID, report.CreatedAt, rule, messages.AlertSymptomsWithBP,
+						symptomsData(participantID, v, report)))
+					break
+				}
+			}
+		}
+	}
+	return alerts
+}
+
+// newAlert renders the message of the rule in the study's locale. A
+// template error must not drop the alert, so it falls back to a plain message.
+func newAlert(study string, participantID int64, readingAt time.Time, rule Rule, name string, data map[string]interface{}) Alert {
+	message := fmt.Sprintf("Alert %s for participant: %d", rule.Kind, participantID)
+	rendered, err := messages.Render(study, "", name, data)
+	if err != nil {
+		log.Printf("failed to render alert message %s: %s\n", name, err.Error())
+	} else {
+		message = rendered.Text
+	}
+	return Alert{ParticipantID: participantID, Rule: rule.Kind, Severity: rule.Severity, Message: message, ReadingAt: readingAt}
+}
+
+func symptomsData(participantID int64, reading Reading, s SymptomReport) map[string]interface{} {
+	return map[string]interface{}{
+		"ParticipantID":       participantID,
+		"SBP":                 reading.SBP,
+		"DBP":                 reading.DBP,
+		"BlurriedVision":      s.BlurriedVision,
+		"Headache":            s.Headache,
+		"DifficultyBreathing": s.DifficultyBreathing,
+		"SidePain":            s.SidePain,
+	}
+}
+
+// atOrAbove reports whether either pressure reaches the rule thresholds
+func atOrAbove(r Reading, p Params) bool {
+	return (p.SBP > 0 && r.SBP >= p.SBP) || (p.DBP > 0 && r.DBP >= p.DBP)
+}
+
+// within reports whether t is at most windowHours before or after ref
+func within(t time.Time, ref time.Time, windowHours int) bool {
+	d := ref.Sub(t)
+	if d < 0 {
+		d = -d
+	}
+	return d <= time.Duration(windowHours)*time.Hour
+}
+
+func withinWindow(vitals []Reading, ref time.Time, windowHours int) []Reading {
+	var result []Reading
+	for _, v := range vitals {
+		if !v.CreatedAt.After(ref) && within(v.CreatedAt, ref, windowHours) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func maxWindow(rules []Rule) time.Duration {
+	hours := 0
+	for _, rule := range rules {
+		if rule.Enabled && rule.Params.WindowHours > hours {
+			hours = rule.Params.WindowHours
+		}
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func createdAtBounds(since time.Time) (int64, int64) {
+	millis := since.UnixNano() / int64(time.Millisecond)
+	return millis - 1000000000000, millis
+}
+
+func recentVitals(participantID int64, since time.Time) ([]Reading, error) {
+	short, full := createdAtBounds(since)
+	rows, err := database.ADB.Db.Query(selectRecentVitals, participantID, short, full)
+	if err != nil {
+		log.Println("failed to query recent vitals")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var vitals []Reading
+	for rows.Next() {
+		var createdAt int64
+		var r Reading
+		if err := rows.Scan(&createdAt, &r.SBP, &r.DBP, &r.Pulse); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = bp_readings.CreatedAtTime(createdAt)
+		vitals = append(vitals, r)
+	}
+	return vitals, rows.Err()
+}
+
+func recentSymptoms(participantID int64, since time.Time) ([]SymptomReport, error) {
+	short, full := createdAtBounds(since)
+	rows, err := database.ADB.Db.Query(selectRecentSymptoms, participantID, short, full)
+	if err != nil {
+		log.Println("failed to query recent symptoms")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var symptoms []SymptomReport
+	for rows.Next() {
+		var createdAt int64
+		var s SymptomReport
+		if err := rows.Scan(&createdAt, &s.BlurriedVision, &s.Headache, &s.DifficultyBreathing, &s.SidePain); err != nil {
+			return nil, err
+		}
+		s.CreatedAt = bp_readings.CreatedAtTime(createdAt)
+		symptoms = append(symptoms, s)
+	}
+	return symptoms, rows.Err()
+}
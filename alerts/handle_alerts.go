@@ -0,0 +1,147 @@
+package alerts
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/gorilla/mux"
+)
+
+// ParticipantAlertsHandler full alert history of a participant of the coordinator's study and sites.
+// GET /participants/{participant_id}/alerts
+type ParticipantAlertsHandler struct {
+	Name string
+}
+
+// StudyAlertsHandler alerts of the coordinator's study and sites.
+// GET /alerts[?status=open|acknowledged|resolved]
+type StudyAlertsHandler struct {
+	Name string
+}
+
+// AlertActionHandler acknowledges or resolves an alert with an optional note.
+// POST /alerts/{alert_id}/acknowledge or /alerts/{alert_id}/resolve with {"note": "..."}
+type AlertActionHandler struct {
+	Name   string
+	Action string
+}
+
+// ActionRequest body of an acknowledge or resolve request
+type ActionRequest struct {
+	Note string `json:"note"`
+}
+
+func (h ParticipantAlertsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	participantID, err := strconv.ParseInt(mux.Vars(r)["participant_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid participant id", http.StatusBadRequest)
+		return
+	}
+	visible, err := sites.Visible(claims.Study, claims.ID, participantID)
+	if err != nil {
+		log.Println(err)
+	}
+	if !visible {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"no such participant"}`))
+		return
+	}
+
+	records, err := ParticipantHistory(claims.Study, participantID)
+	if err != nil {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"unable to query alerts"}`))
+		return
+	}
+	writeRecords(w, records)
+}
+
+func (h StudyAlertsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != StatusOpen && status != StatusAcknowledged && status != StatusResolved {
+		http.Error(w, "status must be open, acknowledged or resolved", http.StatusBadRequest)
+		return
+	}
+
+	records, err := StudyAlerts(claims.Study, claims.ID, status)
+	if err != nil {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"unable to query alerts"}`))
+		return
+	}
+	writeRecords(w, records)
+}
+
+func (h AlertActionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "HTTP Method needs to be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	alertID, err := strconv.ParseInt(mux.Vars(r)["alert_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid alert id", http.StatusBadRequest)
+		return
+	}
+	var ar ActionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&ar); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if h.Action == StatusResolved {
+		err = Resolve(alertID, claims.Study, claims.ID, ar.Note)
+	} else {
+		err = Acknowledge(alertID, claims.Study, claims.ID, ar.Note)
+	}
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	switch err {
+	case nil:
+		log.Printf("Alert %d %s by %d\n", alertID, h.Action, claims.ID)
+		w.Write([]byte(`{"success":"alert ` + h.Action + `"}`))
+	case ErrNoAlert:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"no such alert"}`))
+	case ErrInvalidTransition:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"alert cannot be ` + h.Action + ` from its current status"}`))
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"unable to update alert"}`))
+	}
+}
+
+func writeRecords(w http.ResponseWriter, records []Record) {
+	if records == nil {
+		records = []Record{}
+	}
+	jsonObject, _ := json.Marshal(records)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.Write(jsonObject)
+}
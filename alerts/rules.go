@@ -0,0 +1,128 @@
+package alerts
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	KindSevereBP       = "severe_bp"
+	KindMildBPRepeat   = "mild_bp_repeat"
+	KindPulseRange     = "pulse_range"
+	KindSymptoms       = "symptoms"
+	KindSymptomsWithBP = "symptoms_with_bp"
+
+	SeveritySevere  = "severe"
+	SeverityWarning = "warning"
+
+	selectAlertRules = `SELECT kind, enabled, severity, params, participant_id FROM alert_rules
+WHERE study_id = $1 AND (participant_id IS NULL OR participant_id = $2)
+ORDER BY participant_id NULLS FIRST`
+)
+
+// Params thresholds of a rule. Only the fields a rule kind uses are read.
+type Params struct {
+	SBP         int `json:"sbp,omitempty"`
+	DBP         int `json:"dbp,omitempty"`
+	PulseMin    int `json:"pulseMin,omitempty"`
+	PulseMax    int `json:"pulseMax,omitempty"`
+	Count       int `json:"count,omitempty"`
+	WindowHours int `json:"windowHours,omitempty"`
+	MinSymptoms int `json:"minSymptoms,omitempty"`
+}
+
+// Rule effective rule for one participant after study and participant overrides
+type Rule struct {
+	Kind     string `json:"kind"`
+	Enabled  bool   `json:"enabled"`
+	Severity string `json:"severity"`
+	Params   Params `json:"params"`
+}
+
+// DefaultRules rules used when a study configures nothing. Blood pressure
+// thresholds are inclusive: severe_bp fires at SBP >= 160 or DBP >= 110.
+func DefaultRules() []Rule {
+	return []Rule{
+		{Kind: KindSevereBP, Enabled: true, Severity: SeveritySevere, Params: Params{SBP: 160, DBP: 110}},
+		{Kind: KindMildBPRepeat, Enabled: true, Severity: SeverityWarning, Params: Params{SBP: 140, DBP: 90, Count: 2, WindowHours: 24}},
+		{Kind: KindPulseRange, Enabled: true, Severity: SeverityWarning, Params: Params{PulseMin: 50, PulseMax: 120}},
+		{Kind: KindSymptoms, Enabled: true, Severity: SeverityWarning, Params: Params{MinSymptoms: 1}},
+		{Kind: KindSymptomsWithBP, Enabled: true, Severity: SeveritySevere, Params: Params{SBP: 140, DBP: 90, MinSymptoms: 1, WindowHours: 24}},
+	}
+}
+
+// RulesFor loads the rules of a participant. Study rows override the
+// defaults and participant rows override the study, field by field.
+func RulesFor(study string, participantID int64) ([]Rule, error) {
+	rules := DefaultRules()
+	index := map[string]int{}
+	for i, rule := range rules {
+		index[rule.Kind] = i
+	}
+
+	rows, err := database.ADB.Db.Query(selectAlertRules, study, participantID)
+	if err != nil {
+		log.Println("failed to query alert rules")
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind string
+		var enabled bool
+		var severity sql.NullString
+		var params []byte
+		var ptid sql.NullInt64
+		if err := rows.Scan(&kind, &enabled, &severity, &params, &ptid); err != nil {
+			return nil, err
+		}
+		i, ok := index[kind]
+		if !ok {
+			log.Printf("ignoring alert rule of unknown kind %s for study %s\n", kind, study)
+			continue
+		}
+		rules[i].Enabled = enabled
+		if severity.Valid {
+			rules[i].Severity = severity.String
+		}
+		// unmarshal over the current params so missing fields keep the lower level value
+		if err := json.Unmarshal(params, &rules[i].Params); err != nil {
+			log.Printf("invalid params for alert rule %s of study %s: %s\n", kind, study, err.Error())
+			return nil, err
+		}
+	}
+	return rules, rows.Err()
+}
+
+const upsertStudyRule = `INSERT INTO alert_rules (study_id, kind, enabled, severity, params) VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+ON CONFLICT (study_id, kind) WHERE participant_id IS NULL
+DO UPDATE SET enabled = EXCLUDED.enabled, severity = EXCLUDED.severity, params = EXCLUDED.params`
+
+// SaveStudyRules replaces the study level rules of the given kinds in the
+// caller's transaction. Participant overrides are kept.
+func SaveStudyRules(tx *sql.Tx, study string, rules []Rule) error {
+	for _, rule := range rules {
+		known := false
+		for _, d := range DefaultRules() {
+			known = known || d.Kind == rule.Kind
+		}
+		if !known {
+			return fmt.Errorf("unknown alert rule kind %q", rule.Kind)
+		}
+		if rule.Severity != "" && rule.Severity != SeveritySevere && rule.Severity != SeverityWarning {
+			return fmt.Errorf("alert rule %s: severity must be severe or warning", rule.Kind)
+		}
+		params, err := json.Marshal(rule.Params)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(upsertStudyRule, study, rule.Kind, rule.Enabled, rule.Severity, params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package alerts
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/sites"
+)
+
+const (
+	StatusOpen         = "open"
+	StatusAcknowledged = "acknowledged"
+	StatusResolved     = "resolved"
+
+	insertAlert = `INSERT INTO alerts (participant_id, study_id, rule, severity, message, reading_at, site_id)
+VALUES ($1, $2, $3, $4, $5, $6, (SELECT site_id FROM participants WHERE participant_id = $1)) ON CONFLICT (participant_id, rule, reading_at) DO NOTHING RETURNING alert_id`
+	selectExistingAlert = `SELECT alert_id, notified_at IS NOT NULL FROM alerts
+WHERE participant_id = $1 AND rule = $2 AND reading_at = $3`
+	insertAlertEvent   = `INSERT INTO alert_events (alert_id, event, actor_id, note) VALUES ($1, $2, $3, $4)`
+	updateNotified     = `UPDATE alerts SET notified_at = now() WHERE alert_id = $1`
+	updateAcknowledged = `UPDATE alerts SET status = 'acknowledged', acknowledged_at = now(), acknowledged_by = $3
+WHERE alert_id = $1 AND study_id = $2 AND status = 'open'`
+	updateResolved = `UPDATE alerts SET status = 'resolved', resolved_at = now(), resolved_by = $3
+WHERE alert_id = $1 AND study_id = $2 AND status IN ('open', 'acknowledged')`
+	selectAlertStudy = `SELECT study_id FROM alerts WHERE alert_id = $1 AND `
+	selectAlerts     = `SELECT alert_id, participant_id, rule, severity, message, reading_at, status, created_at,
+notified_at, escalated_at, acknowledged_at, acknowledged_by, resolved_at, resolved_by FROM alerts `
+	selectAlertEvents = `SELECT e.alert_id, e.event, e.actor_id, e.note, e.created_at FROM alert_events e
+JOIN alerts a ON a.alert_id = e.alert_id WHERE a.study_id = $1 AND a.participant_id = $2 ORDER BY e.created_at`
+)
+
+var (
+	// ErrNoAlert returned when the alert does not exist in the coordinator's study and sites
+	ErrNoAlert = errors.New("no such alert")
+	// ErrInvalidTransition returned when the alert is not in a state allowing the change
+	ErrInvalidTransition = errors.New("alert cannot change to this status")
+)
+
+// Event one entry of the audit trail of an alert
+type Event struct {
+	Event     string    `json:"event"`
+	ActorID   *int64    `json:"actorID"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Record stored alert with its lifecycle and audit trail
+type Record struct {
+	AlertID        int64      `json:"alertID"`
+	ParticipantID  int64      `json:"participantID"`
+	Rule           string     `json:"rule"`
+	Severity       string     `json:"severity"`
+	Message        string     `json:"message"`
+	ReadingAt      time.Time  `json:"readingAt"`
+	Status         string     `json:"status"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	NotifiedAt     *time.Time `json:"notifiedAt"`
+	EscalatedAt    *time.Time `json:"escalatedAt"`
+	AcknowledgedAt *time.Time `json:"acknowledgedAt"`
+	AcknowledgedBy *int64     `json:"acknowledgedBy"`
+	ResolvedAt     *time.Time `json:"resolvedAt"`
+	ResolvedBy     *int64     `json:"resolvedBy"`
+	Events         []Event    `json:"events"`
+}
+
+// Open saves a fired alert. When the same rule already fired for the same
+// reading the existing alert is returned, notified tells whether the
+// clinicians were already told about it.
+func Open(study string, alert Alert) (int64, bool, error) {
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var alertID int64
+	err = tx.QueryRow(insertAlert, alert.ParticipantID, study, alert.Rule, alert.Severity, alert.Message, alert.ReadingAt).Scan(&alertID)
+	if err == sql.ErrNoRows {
+		var notified bool
+		err = tx.QueryRow(selectExistingAlert, alert.ParticipantID, alert.Rule, alert.ReadingAt).Scan(&alertID, &notified)
+		return alertID, notified, err
+	}
+	if err != nil {
+		log.Println("failed to insert alert")
+		return 0, false, err
+	}
+	if _, err := tx.Exec(insertAlertEvent, alertID, "opened", nil, ""); err != nil {
+		log.Println("failed to insert alert event")
+		return 0, false, err
+	}
+	return alertID, false, tx.Commit()
+}
+
+// MarkNotified records that the alert was sent to the clinicians
+func MarkNotified(alertID int64) error {
+	return updateWithEvent(updateNotified, []interface{}{alertID}, alertID, "notified", nil, "")
+}
+
+// Acknowledge moves an open alert of the study and the actor's sites to acknowledged
+func Acknowledge(alertID int64, study string, actorID int64, note string) error {
+	return transition(updateAcknowledged, alertID, study, actorID, StatusAcknowledged, note)
+}
+
+// Resolve moves an open or acknowledged alert of the study and the actor's sites to resolved
+func Resolve(alertID int64, study string, actorID int64, note string) error {
+	return transition(updateResolved, alertID, study, actorID, StatusResolved, note)
+}
+
+func transition(query string, alertID int64, study string, actorID int64, event string, note string) error {
+	// the actor is argument 3, coordinators only change alerts of their sites
+	query += " AND " + sites.Condition("site_id", 3)
+	err := updateWithEvent(query, []interface{}{alertID, study, actorID}, alertID, event, &actorID, note)
+	if err != ErrNoAlert {
+		return err
+	}
+	// tell a missing alert apart from one in the wrong state
+	var alertStudy string
+	err = database.ADB.Db.QueryRow(selectAlertStudy+sites.Condition("site_id", 2), alertID, actorID).Scan(&alertStudy)
+	if err != nil || alertStudy != study {
+		return ErrNoAlert
+	}
+	return ErrInvalidTransition
+}
+
+// updateWithEvent runs the update and appends the event in one transaction.
+// ErrNoAlert is returned when the update changed nothing.
+func updateWithEvent(query string, args []interface{}, alertID int64, event string, actorID *int64, note string) error {
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateWithEventTx(tx, query, args, alertID, event, actorID, note); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateWithEventTx updateWithEvent as part of the caller's transaction
+func updateWithEventTx(tx *sql.Tx, query string, args []interface{}, alertID int64, event string, actorID *int64, note string) error {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		log.Printf("failed to update alert %d\n", alertID)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNoAlert
+	}
+	if _, err := tx.Exec(insertAlertEvent, alertID, event, actorID, note); err != nil {
+		log.Println("failed to insert alert event")
+		return err
+	}
+	return nil
+}
+
+// ParticipantHistory every alert of a participant with its audit trail, newest first
+func ParticipantHistory(study string, participantID int64) ([]Record, error) {
+	records, err := queryRecords(selectAlerts+`WHERE study_id = $1 AND participant_id = $2 ORDER BY created_at DESC`, study, participantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.ADB.Db.Query(selectAlertEvents, study, participantID)
+	if err != nil {
+		log.Println("failed to query alert events")
+		return nil, err
+	}
+	defer rows.Close()
+
+	index := map[int64]int{}
+	for i, record := range records {
+		index[record.AlertID] = i
+	}
+	for rows.Next() {
+		var alertID int64
+		var e Event
+		var actorID sql.NullInt64
+		if err := rows.Scan(&alertID, &e.Event, &actorID, &e.Note, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if actorID.Valid {
+			e.ActorID = &actorID.Int64
+		}
+		if i, ok := index[alertID]; ok {
+			records[i].Events = append(records[i].Events, e)
+		}
+	}
+	return records, rows.Err()
+}
+
+// StudyAlerts alerts of a study at the coordinator's sites, optionally only
+// those with the given status
+func StudyAlerts(study string, coordinatorID int64, status string) ([]Record, error) {
+	if status == "" {
+		return queryRecords(selectAlerts+`WHERE study_id = $1 AND `+sites.Condition("site_id", 2)+
+			` ORDER BY created_at DESC LIMIT 500`, study, coordinatorID)
+	}
+	return queryRecords(selectAlerts+`WHERE study_id = $1 AND `+sites.Condition("site_id", 2)+
+		` AND status = $3 ORDER BY created_at DESC LIMIT 500`, study, coordinatorID, status)
+}
+
+func queryRecords(query string, args ...interface{}) ([]Record, error) {
+	rows, err := database.ADB.Db.Query(query, args...)
+	if err != nil {
+		log.Println("failed to query alerts")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var r Record
+		var notifiedAt, escalatedAt, acknowledgedAt, resolvedAt sql.NullTime
+		var acknowledgedBy, resolvedBy sql.NullInt64
+		err := rows.Scan(&r.AlertID, &r.ParticipantID, &r.Rule, &r.Severity, &r.Message, &r.ReadingAt, &r.Status, &r.CreatedAt,
+			&notifiedAt, &escalatedAt, &acknowledgedAt, &acknowledgedBy, &resolvedAt, &resolvedBy)
+		if err != nil {
+			return nil, err
+		}
+		r.NotifiedAt = nullTime(notifiedAt)
+		r.EscalatedAt = nullTime(escalatedAt)
+		r.AcknowledgedAt = nullTime(acknowledgedAt)
+		r.ResolvedAt = nullTime(resolvedAt)
+		if acknowledgedBy.Valid {
+			r.AcknowledgedBy = &acknowledgedBy.Int64
+		}
+		if resolvedBy.Valid {
+			r.ResolvedBy = &resolvedBy.Int64
+		}
+		r.Events = []Event{}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -17,18 +17,32 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cliffordlab/amoss_services/adherence"
+	"github.com/cliffordlab/amoss_services/alerts"
 	"github.com/cliffordlab/amoss_services/amoss_login"
 	"github.com/cliffordlab/amoss_services/amoss_streams"
 	"github.com/cliffordlab/amoss_services/amoss_streams/moyo_mom/emory"
 	"github.com/cliffordlab/amoss_services/bp_readings"
 	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/caseloads"
+	"github.com/cliffordlab/amoss_services/consent"
 	"github.com/cliffordlab/amoss_services/database"
 	"github.com/cliffordlab/amoss_services/download"
+	"github.com/cliffordlab/amoss_services/enrollment"
 	"github.com/cliffordlab/amoss_services/fhir"
+	"github.com/cliffordlab/amoss_services/file_catalog"
 	"github.com/cliffordlab/amoss_services/garminauth"
 	"github.com/cliffordlab/amoss_services/handlers"
 	"github.com/cliffordlab/amoss_services/health"
+	"github.com/cliffordlab/amoss_services/jobs"
+	"github.com/cliffordlab/amoss_services/lifecycle"
+	"github.com/cliffordlab/amoss_services/messages"
+	"github.com/cliffordlab/amoss_services/notify"
 	"github.com/cliffordlab/amoss_services/participant"
+	"github.com/cliffordlab/amoss_services/questionnaires"
+	"github.com/cliffordlab/amoss_services/reminders"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/cliffordlab/amoss_services/studies"
 	"github.com/cliffordlab/amoss_services/vault"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -38,11 +52,15 @@ var svc *s3.S3
 var gMux *mux.Router
 
 var (
-	devPnt        *bool
-	prodPnt       *bool
-	localPnt      *bool
-	falseEnvCount int
-	environment   string
+	devPnt         *bool
+	prodPnt        *bool
+	localPnt       *bool
+	workersPnt     *int
+	notifyDirPnt   *string
+	templatesPnt   *string
+	instrumentsPnt *string
+	falseEnvCount  int
+	environment    string
 )
 
 func init() {
@@ -50,6 +68,10 @@ func init() {
 	devPnt = flag.Bool("dev", false, "flag for development environment")
 	prodPnt = flag.Bool("prod", false, "flag for prod environment")
 	localPnt = flag.Bool("local", false, "flag for local environment")
+	workersPnt = flag.Int("workers", 4, "number of post-upload job workers")
+	notifyDirPnt = flag.String("notify-dir", "", "write notifications to this directory instead of sending them")
+	templatesPnt = flag.String("templates", "", "directory of the message templates, the templates built into the binary when empty")
+	instrumentsPnt = flag.String("instruments", "", "directory of the questionnaire definitions, the definitions built into the binary when empty")
 	flag.Parse()
 
 	envs := []bool{*devPnt, *prodPnt, *localPnt}
@@ -83,6 +105,14 @@ func init() {
 		svc = s3.New(session.New(&aws.Config{Region: aws.String("us-east-1")}))
 	}
 
+	// refuse to start with a template using variables outside its schema
+	if err := messages.Init(*templatesPnt); err != nil {
+		log.Fatalln(err)
+	}
+	if err := questionnaires.Init(*instrumentsPnt); err != nil {
+		log.Fatalln(err)
+	}
+
 	gMux = mux.NewRouter()
 
 	setHandlers(svc)
@@ -171,6 +201,13 @@ func main() {
 	}
 	capacity.AWSSESLambdaAPIKey = apiKey
 
+	log.Println("Getting notification settings...")
+	notificationConfig, err := vc.GetNotificationConfig(secretVaultEndpoint)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	setNotifiers(notificationConfig, apiKey)
+
 	// Get Database credential
 	log.Println("Getting DBCreds secrets...")
 	var secretDBVaultEndpoint = "secret/amossDB"
@@ -198,6 +235,16 @@ func main() {
 		database.InitDb("postgres", "password", "localhost", "amoss")
 	}
 
+	capacity.SetTokenPolicy(studies.TokenLifetime)
+
+	// post-upload processing runs in the background once the db is reachable
+	emory.RegisterJobs(svc)
+	jobs.StartWorkers(*workersPnt)
+	alerts.StartEscalation(time.Minute)
+	notify.StartRelay(10 * time.Second)
+	reminders.StartScheduler(15 * time.Minute)
+	amoss_streams.StartPendingUploadSweep(svc, time.Hour)
+
 	handler := cors.New(cors.Options{
 		AllowedOrigins:     []string{"*"},
 		AllowedMethods:     []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS"},
@@ -219,6 +266,38 @@ func main() {
 	log.Printf("Shutdown signal received, exiting...\n")
 }
 
+// setNotifiers picks the provider of every notification channel. Local runs
+// and -notify-dir write messages to files, SMTP replaces the email lambda
+// when it is configured.
+func setNotifiers(config vault.NotificationConfig, lambdaAPIKey string) {
+	notifyDir := *notifyDirPnt
+	if notifyDir == "" && environment == "local" {
+		notifyDir = "outbox"
+	}
+	if notifyDir != "" {
+		log.Println("Writing notifications to " + notifyDir)
+		fileNotifier := notify.FileNotifier{Dir: notifyDir}
+		notify.SetNotifier(notify.ChannelEmail, fileNotifier)
+		notify.SetNotifier(notify.ChannelSMS, fileNotifier)
+		notify.SetNotifier(notify.ChannelTopic, fileNotifier)
+		return
+	}
+
+	snsNotifier := notify.SNSNotifier{Region: "us-east-1", TopicArn: config.AlertTopicArn}
+	notify.SetNotifier(notify.ChannelSMS, snsNotifier)
+	notify.SetNotifier(notify.ChannelTopic, snsNotifier)
+	if config.SMTPAddr != "" {
+		notify.SetNotifier(notify.ChannelEmail, notify.SMTPNotifier{
+			Addr:     config.SMTPAddr,
+			User:     config.SMTPUser,
+			Password: config.SMTPPassword,
+			From:     config.SMTPFrom,
+		})
+	} else {
+		notify.SetNotifier(notify.ChannelEmail, notify.LambdaEmailNotifier{URL: config.EmailLambdaURL, APIKey: lambdaAPIKey})
+	}
+}
+
 func setHandlers(svc *s3.S3) {
 	log.Println("Setting Handlers..")
 	s := gMux.PathPrefix("/api/moyo/mom/emory").Subrouter()
@@ -226,22 +305,62 @@ func setHandlers(svc *s3.S3) {
 	s.Handle("/participants/{participant_id:[0-9]+}/charts", handlers.HandleReqWithBearerToken(participant.VitalChartHandler{Name: "query db to visualize vital chart"}))
 	s.Handle("/participants/{participant_id:[0-9]+}/vitals/unverified_uploads", handlers.HandleReqWithBearerToken(participant.ListUnverifiedFilesHandler{Name: "list unverified files handler"}))
 	s.Handle("/participants/{participant_id:[0-9]+}/vitals/unverified_uploads/{created_at:[0-9]+}", handlers.HandleReqWithBearerToken(participant.UnverifiedBPFileHandler{Name: "unverified bp file handler", Svc: svc}))
+	s.Handle("/participants/{participant_id:[0-9]+}/vitals/unverified_uploads/{created_at:[0-9]+}/verifications", handlers.HandleReqWithBearerToken(participant.VerificationHandler{Name: "bp verifications handler", Svc: svc}))
+	s.Handle("/participants/{participant_id:[0-9]+}/vitals/unverified_uploads/{created_at:[0-9]+}/adjudicate", handlers.HandleReqWithBearerToken(participant.VerificationHandler{Name: "bp adjudication handler", Svc: svc}))
+	s.Handle("/participants/{participant_id:[0-9]+}/vitals/{created_at:[0-9]+}/revisions", handlers.HandleReqWithBearerToken(participant.RevisionsHandler{Name: "bp reading revisions handler"}))
+	s.Handle("/participants/{participant_id:[0-9]+}/coordinator", handlers.HandleReqWithBearerToken(caseloads.AssignmentHandler{Name: "participant assignment handler"}))
+	s.Handle("/participants/{participant_id:[0-9]+}/state", handlers.HandleReqWithBearerToken(lifecycle.StateHandler{Name: "participant state handler"}))
+	s.Handle("/participants/{participant_id:[0-9]+}/consent", handlers.HandleReqWithBearerToken(consent.StatusHandler{Name: "participant consent handler"}))
+	s.Handle("/consent", handlers.HandleReqWithBearerToken(consent.StatusHandler{Name: "study consent status handler"}))
+	s.Handle("/caseload", handlers.HandleReqWithBearerToken(caseloads.CaseloadHandler{Name: "coordinator caseload handler"}))
+	s.Handle("/participants/{participant_id:[0-9]+}/alerts", handlers.HandleReqWithBearerToken(alerts.ParticipantAlertsHandler{Name: "participant alert history handler"}))
+	s.Handle("/participants/{participant_id:[0-9]+}/bp/summary", handlers.HandleReqWithBearerToken(bp_readings.SummaryHandler{Name: "participant bp summary handler"}))
+	s.Handle("/bp/summary", handlers.HandleReqWithBearerToken(bp_readings.SummaryHandler{Name: "study bp summary handler"}))
+	s.Handle("/participants/{participant_id:[0-9]+}/questionnaires", handlers.HandleReqWithBearerToken(questionnaires.ResponsesHandler{Name: "participant questionnaire responses handler"}))
+	s.Handle("/questionnaires", handlers.HandleReqWithBearerToken(questionnaires.ResponsesHandler{Name: "study questionnaire responses handler"}))
+	s.Handle("/alerts", handlers.HandleReqWithBearerToken(alerts.StudyAlertsHandler{Name: "study alerts handler"}))
+	s.Handle("/alerts/{alert_id:[0-9]+}/acknowledge", handlers.HandleReqWithBearerToken(alerts.AlertActionHandler{Name: "acknowledge alert handler", Action: alerts.StatusAcknowledged}))
+	s.Handle("/alerts/{alert_id:[0-9]+}/resolve", handlers.HandleReqWithBearerToken(alerts.AlertActionHandler{Name: "resolve alert handler", Action: alerts.StatusResolved}))
 	s.Handle("/vitals/upload", handlers.HandleReq(emory.UploadMMEVitalsHandler{Name: "moyo mom emory vitals upload handler", Svc: svc}))
 	s.Handle("/symptoms/upload", handlers.HandleReq(emory.UploadMMESymptomsHandler{Name: "moyo mom emory symptoms upload handler", Svc: svc}))
 
 	gMux.Handle("/api/createCoordinator", handlers.HandleReqWithBearerToken(amoss_login.RegistrationHandler{Name: "registration handler"}))
 	gMux.Handle("/api/createPatient", handlers.HandleReqWithBearerToken(amoss_login.RegistrationHandler{Name: "registration handler"}))
 	gMux.Handle("/api/passwordRevocery", handlers.HandleReqWithBearerToken(participant.PasswordRecoveryHandler{Name: "password recovery handler"}))
+	gMux.Handle("/api/participants/import", handlers.HandleReqWithAdminOrCoordinatorToken(enrollment.ImportHandler{Name: "participant import handler"}))
 	gMux.Handle("/api/getUniqueID", handlers.HandleReqWithBearerToken(participant.IDGenerationHandler{Name: "ID generation handler"}))
 	gMux.Handle("/loginParticipant", handlers.HandleReq(amoss_login.LoginHandler{Name: "login handler"}))
 	gMux.Handle("/api/addGarmin", handlers.HandleReqWithBearerToken(garminauth.GarminAccessTokenHandler{Name: "add garmin handler"}))
 	gMux.Handle("/api/garmin_uauth_token", handlers.HandleReqWithBearerToken(garminauth.GarminUnauthorizedRequestHandler{Name: "garmin request token handler"}))
 	gMux.Handle("/api/utsw/fhir/filter", handlers.HandleReq(fhir.FhirFilterHandler{Name: "upload utsw fhir handler", Svc: svc}))
 	gMux.Handle("/api/upload_s3", handlers.HandleReq(amoss_streams.UploadHandler{Name: "upload s3 handler", Svc: svc}))
+	gMux.Handle("/api/uploads/presign", handlers.HandleReq(amoss_streams.PresignUploadHandler{Name: "presign upload handler", Svc: svc}))
+	gMux.Handle("/api/uploads/complete", handlers.HandleReq(amoss_streams.CompleteUploadHandler{Name: "complete upload handler", Svc: svc}))
 	gMux.Handle("/api/moyo/upload_s3", handlers.HandleReq(amoss_streams.UploadMoyoHandler{Name: "upload moyo handler", Svc: svc}))
 	gMux.Handle("/api/moyo/register", handlers.HandleReq(amoss_login.MoyoRegistrationHandler{Name: "moyo registration handler"}))
 	gMux.Handle("/api/moyo/moyo-mom/bp/{participant_id:[0-9]+}", handlers.HandleReq(bp_readings.QueryHandler{Name: "query bp handler"}))
-	gMux.Handle("/api/moyo/download", handlers.HandleReq(download.APKDownloadHandler{Name: "Download MSM handler", Svc: svc}))
+	gMux.Handle("/api/adherence", handlers.HandleReqWithBearerToken(adherence.ReportHandler{Name: "adherence report handler"}))
+	gMux.Handle("/api/jobs/dead", handlers.HandleReqWithAdminToken(jobs.DeadJobsHandler{Name: "dead jobs handler"}))
+	gMux.Handle("/api/jobs/dead/{job_id:[0-9]+}", handlers.HandleReqWithAdminToken(jobs.DeadJobsHandler{Name: "dead jobs handler"}))
+	gMux.Handle("/api/studies", handlers.HandleReqWithAdminToken(studies.StudiesHandler{Name: "studies handler"}))
+	gMux.Handle("/api/studies/{study_id}", handlers.HandleReqWithAdminToken(studies.StudyHandler{Name: "study handler"}))
+	gMux.Handle("/api/studies/{study_id}/sites", handlers.HandleReqWithAdminToken(sites.SitesHandler{Name: "study sites handler"}))
+	gMux.Handle("/api/studies/{study_id}/sites/{site_id}", handlers.HandleReqWithAdminToken(sites.SiteHandler{Name: "study site handler"}))
+	gMux.Handle("/api/studies/{study_id}/coordinators/{participant_id:[0-9]+}/sites", handlers.HandleReqWithAdminToken(sites.CoordinatorSitesHandler{Name: "coordinator sites handler"}))
+	gMux.Handle("/api/studies/{study_id}/participants/{participant_id:[0-9]+}/site", handlers.HandleReqWithAdminToken(sites.ParticipantSiteHandler{Name: "participant site handler"}))
+	gMux.Handle("/api/studies/{study_id}/participants/{participant_id:[0-9]+}/coordinator", handlers.HandleReqWithAdminToken(caseloads.AssignmentHandler{Name: "participant assignment handler"}))
+	gMux.Handle("/api/studies/{study_id}/participants/{participant_id:[0-9]+}/state", handlers.HandleReqWithAdminToken(lifecycle.StateHandler{Name: "participant state handler"}))
+	gMux.Handle("/api/studies/{study_id}/consent", handlers.HandleReqWithAdminToken(consent.StatusHandler{Name: "study consent status handler"}))
+	gMux.Handle("/api/studies/{study_id}/consent/documents", handlers.HandleReqWithAdminToken(consent.DocumentsHandler{Name: "consent documents handler"}))
+	gMux.Handle("/api/studies/{study_id}/consent/documents/{version:[0-9]+}/publish", handlers.HandleReqWithAdminToken(consent.PublishHandler{Name: "publish consent document handler"}))
+	gMux.Handle("/api/studies/{study_id}/participants/{participant_id:[0-9]+}/consent", handlers.HandleReqWithAdminToken(consent.StatusHandler{Name: "participant consent handler"}))
+	gMux.Handle("/api/studies/{study_id}/caseloads", handlers.HandleReqWithAdminToken(caseloads.WorkloadsHandler{Name: "study workloads handler"}))
+	gMux.Handle("/api/consent", handlers.HandleReq(consent.ParticipantConsentHandler{Name: "participant consent handler"}))
+	gMux.Handle("/api/questionnaires", handlers.HandleReq(questionnaires.InstrumentsHandler{Name: "questionnaire instruments handler"}))
+	gMux.Handle("/api/questionnaires/responses", handlers.HandleReq(questionnaires.SubmitHandler{Name: "questionnaire submission handler"}))
+	gMux.Handle("/api/messages/{name}/preview", handlers.HandleReqWithBearerToken(messages.PreviewHandler{Name: "message preview handler"}))
+	gMux.Handle("/api/files/query", handlers.HandleReq(file_catalog.FileQueryHandler{Name: "file catalog query handler"}))
+	gMux.Handle("/api/moyo/download", handlers.HandleReq(download.APKDownloadHandler{Name: "Download MSM handler", Study: "moyo", Svc: svc}))
 	gMux.HandleFunc("/api/health", health.Handler)
 	// If unable to create new Garmin Health API consumer and secret for Dev environment, than:
 	// In dev environment this handler will never be called.
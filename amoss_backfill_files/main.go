@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/file_catalog"
+	"github.com/cliffordlab/amoss_services/studies"
+)
+
+// Backfills the files table from the objects already in the bucket.
+// Usage: amoss_backfill_files -dbuser postgres -dbpw password -dbaddr localhost -dbname amoss -prefix moyo/
+func main() {
+	bucket := flag.String("bucket", "awsS3Bucket", "bucket to list")
+	prefix := flag.String("prefix", "", "only backfill keys starting with this prefix")
+	dbUser := flag.String("dbuser", "postgres", "database user")
+	dbPW := flag.String("dbpw", "password", "database password")
+	dbAddr := flag.String("dbaddr", "localhost", "database address")
+	dbName := flag.String("dbname", "amoss", "database name")
+	dryRun := flag.Bool("dry-run", false, "list the rows that would be inserted without writing them")
+	flag.Parse()
+
+	log.Println("Started file catalog backfill")
+	database.InitDb(*dbUser, *dbPW, *dbAddr, *dbName)
+
+	// studies with their own s3 folder are recorded under their id
+	registry, err := studies.List()
+	if err != nil {
+		log.Fatalln("Failed to read the studies:", err)
+	}
+	prefixes := map[string]string{}
+	for _, s := range registry {
+		if s.S3Prefix != "" {
+			prefixes[s.S3Prefix] = s.ID
+		}
+	}
+
+	svc := s3.New(session.New(&aws.Config{Region: aws.String("us-east-1")}))
+	input := &s3.ListObjectsV2Input{
+		Bucket: bucket,
+		Prefix: prefix,
+	}
+
+	var recorded, skipped, failed int
+	err = svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			f, ok := file_catalog.ParseKey(key, prefixes)
+			if !ok {
+				log.Printf("Skipping key outside the participant layout: %s\n", key)
+				skipped++
+				continue
+			}
+			f.Size = aws.Int64Value(object.Size)
+			f.ETag = strings.Trim(aws.StringValue(object.ETag), `"`)
+			f.UploadedAt = aws.TimeValue(object.LastModified)
+			if *dryRun {
+				fmt.Printf("%d\t%s\t%s\t%d\t%s\n", f.ParticipantID, f.Study, f.WeekMillis, f.Size, f.Key)
+				recorded++
+				continue
+			}
+			if err := file_catalog.RecordFile(f); err != nil {
+				failed++
+				continue
+			}
+			recorded++
+		}
+		return true
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case s3.ErrCodeNoSuchBucket:
+				fmt.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
+			default:
+				fmt.Println(aerr.Error())
+			}
+		} else {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
+	log.Printf("Backfill complete {Recorded: %d, Skipped: %d, Failed: %d}\n", recorded, skipped, failed)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/enrollment"
+	"github.com/cliffordlab/amoss_services/messages"
+	"github.com/cliffordlab/amoss_services/vault"
+)
+
+// Enrolls the participants of a csv file with the columns
+// participant_id, study, site, email, phone, language.
+// Contact info is encrypted with the key in vault, VAULT_ADDR and
+// VAULT_TOKEN must be set unless it is a dry run. Credential emails are
+// queued in the notification outbox and sent by the server's relay.
+// Usage: amoss_enroll -dbuser postgres -dbpw password -dbaddr localhost -dbname amoss -file participants.csv -send-credentials
+func main() {
+	file := flag.String("file", "", "csv file of the participants")
+	dbUser := flag.String("dbuser", "postgres", "database user")
+	dbPW := flag.String("dbpw", "password", "database password")
+	dbAddr := flag.String("dbaddr", "localhost", "database address")
+	dbName := flag.String("dbname", "amoss", "database name")
+	templates := flag.String("templates", "messages/templates", "directory of the message templates")
+	sendCredentials := flag.Bool("send-credentials", false, "email every participant their login and password")
+	dryRun := flag.Bool("dry-run", false, "validate the file without enrolling anyone")
+	flag.Parse()
+
+	if *file == "" {
+		log.Fatalln("-file is required")
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	database.InitDb(*dbUser, *dbPW, *dbAddr, *dbName)
+	if *sendCredentials {
+		if err := messages.Init(*templates); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if !*dryRun {
+		vc, err := vault.NewVaultClient(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), http.DefaultClient)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if capacity.CryptoKey, err = vc.GetCryptoKey("secret/amoss"); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	enrolled, rowErrors, err := enrollment.Import(f, enrollment.Options{SendCredentials: *sendCredentials, DryRun: *dryRun})
+	if err == enrollment.ErrInvalidRows {
+		for _, e := range rowErrors {
+			fmt.Printf("row %d\t%s\t%s\n", e.Row, e.Column, e.Message)
+		}
+		log.Fatalf("%d problems found, nobody was enrolled\n", len(rowErrors))
+	}
+	if err != nil {
+		log.Fatalf("Enrollment failed, nobody was enrolled: %s\n", err.Error())
+	}
+
+	fmt.Println("row\tlogin\tparticipant_id\tstudy\tsite\tpassword")
+	for _, e := range enrolled {
+		fmt.Printf("%d\t%s\t%d\t%s\t%s\t%s\n", e.Row, e.Login, e.ParticipantID, e.Study, e.Site, e.Password)
+	}
+	if *dryRun {
+		log.Printf("Dry run, %d participants are valid\n", len(enrolled))
+		return
+	}
+	log.Printf("Enrolled %d participants\n", len(enrolled))
+}
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/cliffordlab/amoss_services/consent"
+	"github.com/cliffordlab/amoss_services/lifecycle"
 	"github.com/cliffordlab/amoss_services/mathb"
 	"github.com/cliffordlab/amoss_services/participant"
 	"golang.org/x/crypto/bcrypt"
@@ -15,6 +17,7 @@ import (
 
 const errorResJSON = `{"error":"json parsing error","error description":"key or value of json is formatted incorrectly"}`
 const errorInvalidIDOrPassword = `{"error":"invalid participant ID or password"}`
+const errorWithdrawn = `{"error":"participant has withdrawn from the study"}`
 
 //LoginHandler struct used to handle login requests
 type LoginHandler struct {
@@ -25,6 +28,8 @@ type AmossLoginRequest struct {
 	ParticipantID int64  `json:"participantID"`
 	Password      string `json:"password"`
 	Study         string `json:"study"`
+	// site of a new patient, defaults to the site of a coordinator with one site
+	Site string `json:"site"`
 }
 
 func (lh LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -68,6 +73,13 @@ func (lh LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(errorInvalidIDOrPassword))
 		return
 	}
+	if lifecycle.Withdrawn(currentParticipant.ID) {
+		log.Printf("Rejected login of withdrawn participant %d\n", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(errorWithdrawn))
+		return
+	}
 	// save new salt and password hash
 	var src = rand.NewSource(time.Now().UnixNano())
 	newSalt := mathb.RandString(58, src)
@@ -82,6 +94,10 @@ func (lh LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	currentParticipant.Salt = newSalt
 	currentParticipant.PasswordHash = string(newPasswordHash)
 
+	// the app asks for consent again when a new version was published, studies
+	// without a published document keep the app's own consent flow
+	currentParticipant.HasConsented = consent.Consented(currentParticipant.Study, currentParticipant.ID)
+
 	participant.AlterSaltAndPasswordHash(&currentParticipant)
 	participant.LoginParticipant(&currentParticipant, w)
 }
@@ -15,6 +15,8 @@ import (
 	"github.com/cliffordlab/amoss_services/capacity"
 	"github.com/cliffordlab/amoss_services/mathb"
 	"github.com/cliffordlab/amoss_services/participant"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/cliffordlab/amoss_services/studies"
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -25,10 +27,6 @@ const (
 	patient = "patient"
 )
 
-var (
-	studyNames = [20]string{"hf", "chf", "depression monitoring", "moyo", "test", "super", "pCRF", "sleepBank", "utsw", "sleep technology", "ptsd-vns", "ptsd_twin", "ptsd_grc", "otsuka", "Anytime Fitness Study", "PRO-C study", "vismet", "cfd-sleep-study-test", "cfd-sleep_study", "cfd-classroom-audio"}
-)
-
 //RegistrationHandler struct used to handle registration requests
 type RegistrationHandler struct {
 	Name string
@@ -167,13 +165,28 @@ func setupNewParticipant(cap string, marsToken string, w http.ResponseWriter, cp
 	log.Println(cp.Capacity)
 	log.Println(cp.ID)
 	log.Println(cp.Study)
+	study := amr.Study
 	if cp.Capacity == cap || cap == patient {
-		np.Study = cp.Study
-	} else {
-		for _, value := range studyNames {
-			if value == amr.Study {
-				np.Study = amr.Study
-			}
+		study = cp.Study
+	}
+	// only studies in the registry that are active take new users
+	enrolling, err := studies.Enrolling(study)
+	if err != nil {
+		log.Println("failed to look up study " + study)
+		log.Println(err)
+	}
+	if !enrolling {
+		return
+	}
+	if cap == patient {
+		site, ok := sites.EnrollmentSite(study, cp.ID, amr.Site)
+		if !ok {
+			log.Printf("site %q not available to coordinator %d\n", amr.Site, cp.ID)
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.Write([]byte(`{"error":"site invalid or not one of the coordinator's sites"}`))
+			return
 		}
+		np.Site = site
 	}
+	np.Study = study
 }
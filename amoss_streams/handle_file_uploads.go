@@ -13,8 +13,13 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/cliffordlab/amoss_services/capacity"
 	check "github.com/cliffordlab/amoss_services/checkHTTP"
+	"github.com/cliffordlab/amoss_services/consent"
 	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/file_catalog"
+	"github.com/cliffordlab/amoss_services/ingest"
+	"github.com/cliffordlab/amoss_services/lifecycle"
 	"github.com/cliffordlab/amoss_services/participant"
+	"github.com/cliffordlab/amoss_services/studies"
 	"github.com/dgrijalva/jwt-go"
 )
 
@@ -23,6 +28,8 @@ const (
 	partialSucess    = `{"partial success":"able to upload some data to awsS3Bucket files",
     "description":"all files were not able to be upload may be due to empty files"}`
 	invalidAccessToken = `{"logout user":"Invalid access token."}`
+	withdrawnErr       = `{"error":"participant has withdrawn from the study"}`
+	consentRequiredErr = `{"error":"the current consent document has not been signed"}`
 	insertVitalsData   = `INSERT INTO bp_readings 
 (created_at, participant_id, systolic_bp, diastolic_bp, pulse, jpg_s3_key, csv_s3_key) 
 VALUES($1, $2, $3, $4, $5, $6, $7)`
@@ -58,11 +65,11 @@ func setKey(currentParticipant participant.Participant, startOfWeekMillis string
 	var key string
 	switch database.ADB.Environment {
 	case "dev":
-		key = "dev/" + currentParticipant.Study + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis + "/" + filename
+		key = "dev/" + studies.KeyPrefix(currentParticipant.Study) + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis + "/" + filename
 	case "local":
-		key = "test/" + currentParticipant.Study + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis + "/" + filename
+		key = "test/" + studies.KeyPrefix(currentParticipant.Study) + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis + "/" + filename
 	default:
-		key = currentParticipant.Study + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis + "/" + filename
+		key = studies.KeyPrefix(currentParticipant.Study) + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis + "/" + filename
 	}
 	return key
 }
@@ -99,6 +106,20 @@ func (uh UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid token type", http.StatusUnauthorized)
 		return
 	}
+	if lifecycle.Withdrawn(currentParticipant.ID) {
+		log.Printf("Rejected upload for withdrawn participant %d\n", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(withdrawnErr))
+		return
+	}
+	if !consent.Current(currentParticipant.Study, currentParticipant.ID) {
+		log.Printf("Rejected upload of participant %d without a current consent\n", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(consentRequiredErr))
+		return
+	}
 
 	var bucket string
 	err = r.ParseMultipartForm(defaultMaxMemory)
@@ -126,17 +147,36 @@ func (uh UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//get a ref to the parsed multipart form
 	m := r.MultipartForm
 	path := r.Form.Get("path")
+	if path != "" {
+		// the folder may only point inside the participant's own namespace
+		namespace := strings.TrimSuffix(SetPartialKey(currentParticipant, ""), "/")
+		path, err = ingest.ResolvePath(path, namespace)
+		if err != nil {
+			log.Printf("Rejected path %q for participant %d\n", r.Form.Get("path"), currentParticipant.ID)
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(ingest.ErrorJSON(err)))
+			return
+		}
+	}
 	var key string
 
 	//get the *fileheaders
 	files := m.File["upload"]
+	checked, err := ingest.CheckFiles(currentParticipant.Study, files)
+	if err != nil {
+		log.Printf("Rejected upload for participant %d: %s\n", currentParticipant.ID, err.Error())
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(ingest.ErrorJSON(err)))
+		return
+	}
 	for i, f := range files {
 		//for each fileheader, get a handle to the actual file
-		filename := files[i].Filename
+		filename := checked[i].Filename
 		if path != "" {
 			key = path + "/" + filename
 		} else {
-
 			key = setKey(currentParticipant, startOfWeekMillis, filename)
 		}
 		file, err := f.Open()
@@ -146,11 +186,13 @@ func (uh UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		uploadResult, err := uh.Svc.PutObject(&s3.PutObjectInput{
-			Bucket: &bucket,
-			Key:    &key,
-			Body:   file,
-		})
+		uploadResult, err := file_catalog.Upload(uh.Svc, bucket, file_catalog.File{
+			ParticipantID: currentParticipant.ID,
+			Study:         currentParticipant.Study,
+			WeekMillis:    startOfWeekMillis,
+			Key:           key,
+			ContentType:   checked[i].ContentType,
+		}, file)
 		if err != nil {
 			fullUpload = false
 			log.Printf("Failed to upload data to %s/%s, %s\n", bucket, key, err.Error())
@@ -209,7 +251,7 @@ func (uh UploadMoyoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Println("Querying db for access token")
-	query := "SELECT access_token FROM participants WHERE participant_id = $1 AND access_token = $2"
+	query := "SELECT access_token FROM participants WHERE participant_id = $1 AND access_token = $2 AND lifecycle_state <> 'withdrawn'"
 	rows, err := database.ADB.Db.Query(query, currentParticipant.ID, bearerToken)
 	if err != nil {
 		log.Println("failed to execute get access_token query")
@@ -229,6 +271,14 @@ func (uh UploadMoyoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	rows.Close()
 
+	if accessTokenDB == bearerToken && !consent.Current(currentParticipant.Study, currentParticipant.ID) {
+		log.Printf("Rejected upload of participant %d without a current consent\n", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(consentRequiredErr))
+		return
+	}
+
 	if accessTokenDB == bearerToken {
 		bucket := "awsS3Bucket"
 		fullUpload := true
@@ -247,9 +297,17 @@ func (uh UploadMoyoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		//get the *fileheaders
 		files := m.File["upload"]
+		checked, err := ingest.CheckFiles(currentParticipant.Study, files)
+		if err != nil {
+			log.Printf("Rejected upload for participant %d: %s\n", currentParticipant.ID, err.Error())
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(ingest.ErrorJSON(err)))
+			return
+		}
 		for i, f := range files {
 			//for each fileheader, get a handle to the actual file
-			filename := files[i].Filename
+			filename := checked[i].Filename
 			key := setKey(currentParticipant, startOfWeekMillis, filename)
 
 			file, err := f.Open()
@@ -260,11 +318,13 @@ func (uh UploadMoyoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			uploadResult, err := uh.Svc.PutObject(&s3.PutObjectInput{
-				Bucket: &bucket,
-				Key:    &key,
-				Body:   file,
-			})
+			uploadResult, err := file_catalog.Upload(uh.Svc, bucket, file_catalog.File{
+				ParticipantID: currentParticipant.ID,
+				Study:         currentParticipant.Study,
+				WeekMillis:    startOfWeekMillis,
+				Key:           key,
+				ContentType:   checked[i].ContentType,
+			}, file)
 			if err != nil {
 				fullUpload = false
 				log.Printf("Failed to upload data to %s/%s, %s\n", bucket, key, err.Error())
@@ -318,9 +378,17 @@ func (uh UploadUTSWHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	//get the *fileheaders
 	files := m.File["upload"]
+	checked, err := ingest.CheckFiles(currentParticipant.Study, files)
+	if err != nil {
+		log.Printf("Rejected upload for participant %d: %s\n", currentParticipant.ID, err.Error())
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(ingest.ErrorJSON(err)))
+		return
+	}
 	for i, f := range files {
 		//for each fileheader, get a handle to the actual file
-		filename := files[i].Filename
+		filename := checked[i].Filename
 		key := setKey(currentParticipant, startOfWeekMillis, filename)
 		file, err := f.Open()
 		defer file.Close()
@@ -330,11 +398,13 @@ func (uh UploadUTSWHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		uploadResult, err := uh.Svc.PutObject(&s3.PutObjectInput{
-			Bucket: &bucket,
-			Key:    &key,
-			Body:   file,
-		})
+		uploadResult, err := file_catalog.Upload(uh.Svc, bucket, file_catalog.File{
+			ParticipantID: currentParticipant.ID,
+			Study:         currentParticipant.Study,
+			WeekMillis:    startOfWeekMillis,
+			Key:           key,
+			ContentType:   checked[i].ContentType,
+		}, file)
 		if err != nil {
 			fullUpload = false
 			log.Printf("Failed to upload data to %s/%s, %s\n", bucket, key, err.Error())
@@ -417,6 +487,20 @@ func (uh UploadHFHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid token type", http.StatusUnauthorized)
 		return
 	}
+	if lifecycle.Withdrawn(currentParticipant.ID) {
+		log.Printf("Rejected upload for withdrawn participant %d\n", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(withdrawnErr))
+		return
+	}
+	if !consent.Current(currentParticipant.Study, currentParticipant.ID) {
+		log.Printf("Rejected upload of participant %d without a current consent\n", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(consentRequiredErr))
+		return
+	}
 
 	bucket := "awsS3Bucket"
 	fullUpload := true
@@ -434,9 +518,17 @@ func (uh UploadHFHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	//get the *fileheaders
 	files := m.File["upload"]
+	checked, err := ingest.CheckFiles(currentParticipant.Study, files)
+	if err != nil {
+		log.Printf("Rejected upload for participant %d: %s\n", currentParticipant.ID, err.Error())
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(ingest.ErrorJSON(err)))
+		return
+	}
 	for i, f := range files {
 		//for each fileheader, get a handle to the actual file
-		filename := files[i].Filename
+		filename := checked[i].Filename
 		key := setKey(currentParticipant, startOfWeekMillis, filename)
 		file, err := f.Open()
 		defer file.Close()
@@ -446,11 +538,13 @@ func (uh UploadHFHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		uploadResult, err := uh.Svc.PutObject(&s3.PutObjectInput{
-			Bucket: &bucket,
-			Key:    &key,
-			Body:   file,
-		})
+		uploadResult, err := file_catalog.Upload(uh.Svc, bucket, file_catalog.File{
+			ParticipantID: currentParticipant.ID,
+			Study:         currentParticipant.Study,
+			WeekMillis:    startOfWeekMillis,
+			Key:           key,
+			ContentType:   checked[i].ContentType,
+		}, file)
 		if err != nil {
 			fullUpload = false
 			log.Printf("Failed to upload data to %s/%s, %s\n", bucket, key, err.Error())
@@ -482,7 +576,12 @@ func HandleDataTransferToS3Bucket(w http.ResponseWriter, req *http.Request, newP
 		bucket := "awsS3Bucket"
 		fullUpload := true
 		//for each fileheader, get a handle to the actual file
-		filename := info.Filename
+		checked, err := ingest.Check(newParticipant.Study, info.Filename, file)
+		if err != nil {
+			log.Printf("Rejected consent upload for participant %d: %s\n", newParticipant.ID, err.Error())
+			return "failed"
+		}
+		filename := checked.Filename
 
 		key := setKey(newParticipant, "Consent & Demographic Questionnaire", filename)
 		if err != nil {
@@ -492,11 +591,13 @@ func HandleDataTransferToS3Bucket(w http.ResponseWriter, req *http.Request, newP
 		}
 		svc := s3.New(session.New(&aws.Config{Region: aws.String("us-east-1")}))
 
-		uploadResult, err := svc.PutObject(&s3.PutObjectInput{
-			Bucket: &bucket,
-			Key:    &key,
-			Body:   file,
-		})
+		uploadResult, err := file_catalog.Upload(svc, bucket, file_catalog.File{
+			ParticipantID: newParticipant.ID,
+			Study:         newParticipant.Study,
+			WeekMillis:    "Consent & Demographic Questionnaire",
+			Key:           key,
+			ContentType:   checked.ContentType,
+		}, file)
 		if err != nil {
 			fullUpload = false
 			log.Printf("Failed to upload data to %s/%s, %s\n", bucket, key, err.Error())
@@ -522,11 +623,11 @@ func SetPartialKey(currentParticipant participant.Participant, startOfWeekMillis
 	var partialKey string
 	switch database.ADB.Environment {
 	case "dev":
-		partialKey = "dev/" + currentParticipant.Study + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis
+		partialKey = "dev/" + studies.KeyPrefix(currentParticipant.Study) + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis
 	case "local":
-		partialKey = "test/" + currentParticipant.Study + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis
+		partialKey = "test/" + studies.KeyPrefix(currentParticipant.Study) + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis
 	default:
-		partialKey = currentParticipant.Study + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis
+		partialKey = studies.KeyPrefix(currentParticipant.Study) + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis
 	}
 
 	return partialKey
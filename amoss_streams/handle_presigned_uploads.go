@@ -0,0 +1,346 @@
+package amoss_streams
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/consent"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/file_catalog"
+	"github.com/cliffordlab/amoss_services/ingest"
+	"github.com/cliffordlab/amoss_services/participant"
+)
+
+const (
+	presignExpiration = 15 * time.Minute
+	checksumMetaKey   = "Sha256"
+
+	selectAccessToken   = `SELECT access_token FROM participants WHERE participant_id = $1 AND access_token = $2 AND lifecycle_state <> 'withdrawn'`
+	insertPendingUpload = `INSERT INTO pending_uploads
+(s3_key, participant_id, study_id, week_millis, size_bytes, checksum, md5, content_type, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (s3_key) DO UPDATE SET size_bytes = EXCLUDED.size_bytes, checksum = EXCLUDED.checksum, md5 = EXCLUDED.md5,
+content_type = EXCLUDED.content_type, expires_at = EXCLUDED.expires_at`
+	// a PUT started before the url expired may finish and be completed later,
+	// completion is accepted until completeGrace after the expiry
+	completeGrace       = 24 * time.Hour
+	pendingColumns      = `s3_key, participant_id, study_id, week_millis, size_bytes, checksum, md5, content_type`
+	selectPendingUpload = `SELECT ` + pendingColumns + ` FROM pending_uploads
+WHERE s3_key = $1 AND participant_id = $2 AND expires_at > $3`
+	selectStaleUploads  = `SELECT ` + pendingColumns + ` FROM pending_uploads WHERE expires_at <= $1 LIMIT 500`
+	deletePendingUpload = `DELETE FROM pending_uploads WHERE s3_key = $1`
+)
+
+var (
+	errNotUploaded     = errors.New("object has not been uploaded")
+	errUploadMismatch  = errors.New("uploaded object does not match size or checksum")
+	errNoPendingUpload = errors.New("no pending upload for key")
+)
+
+// PresignUploadHandler issues presigned PUT urls so the apps can send files
+// straight to s3. Only metadata goes through the server.
+type PresignUploadHandler struct {
+	Name string
+	Svc  *s3.S3
+}
+
+// CompleteUploadHandler called by the apps once a presigned PUT finished.
+// Verifies the object and records it in the file catalog.
+type CompleteUploadHandler struct {
+	Name string
+	Svc  *s3.S3
+}
+
+// PresignFile file the app wants to upload. Checksum is the hex sha256 of the
+// content and MD5 its hex md5, which s3 checks on the PUT through Content-MD5.
+type PresignFile struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	MD5      string `json:"md5"`
+}
+
+// PresignRequest body of a presign request
+type PresignRequest struct {
+	Files []PresignFile `json:"files"`
+}
+
+// PresignedUpload url and headers the app must use for the PUT
+type PresignedUpload struct {
+	Filename  string            `json:"filename"`
+	Key       string            `json:"key"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// CompleteUploadRequest body of the completion callback
+type CompleteUploadRequest struct {
+	Key string `json:"key"`
+}
+
+// authorizeUpload validates the Mars token, that it is still the token
+// saved for the participant at login and that the participant signed the
+// current consent document
+func authorizeUpload(w http.ResponseWriter, r *http.Request) (participant.Participant, bool) {
+	var currentParticipant participant.Participant
+	claims, bearerToken, err := capacity.ClaimsFromHeader(r, "Mars")
+	if err != nil {
+		log.Println("token not valid")
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return currentParticipant, false
+	}
+	currentParticipant.Study = claims.Study
+	currentParticipant.ID = claims.ID
+
+	var accessTokenDB string
+	err = database.ADB.Db.QueryRow(selectAccessToken, currentParticipant.ID, bearerToken).Scan(&accessTokenDB)
+	if err != nil || accessTokenDB != bearerToken {
+		log.Println("Access token does not match that of the database")
+		log.Println("Participant_ID: ", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(invalidAccessToken))
+		return currentParticipant, false
+	}
+	if !consent.Current(currentParticipant.Study, currentParticipant.ID) {
+		log.Printf("Rejected upload of participant %d without a current consent\n", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(consentRequiredErr))
+		return currentParticipant, false
+	}
+	return currentParticipant, true
+}
+
+func (ph PresignUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	startOfWeekMillis := r.Header.Get("weekMillis")
+	if len(startOfWeekMillis) != 12 {
+		log.Println("token length is wrong")
+		w.Write([]byte("{\"error\": \"invalid header\"}"))
+		return
+	}
+	currentParticipant, ok := authorizeUpload(w, r)
+	if !ok {
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var pr PresignRequest
+	if err := dec.Decode(&pr); err != nil || len(pr.Files) == 0 {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.Write([]byte(errorResJSON))
+		return
+	}
+
+	bucket := "awsS3Bucket"
+	expiresAt := time.Now().UTC().Add(presignExpiration)
+	var uploads []PresignedUpload
+	for _, pf := range pr.Files {
+		md5Sum, md5Err := hex.DecodeString(pf.MD5)
+		if pf.Size <= 0 || len(pf.Checksum) != 64 || md5Err != nil || len(md5Sum) != 16 {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"filename, size, sha256 checksum and md5 are required for every file"}`))
+			return
+		}
+		// the content never reaches the server so only the extension can be checked
+		checked, err := ingest.CheckFilename(currentParticipant.Study, pf.Filename)
+		if err != nil {
+			log.Printf("Rejected presign for participant %d: %s\n", currentParticipant.ID, err.Error())
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(ingest.ErrorJSON(err)))
+			return
+		}
+		filename := checked.Filename
+		key := setKey(currentParticipant, startOfWeekMillis, filename)
+		checksum := strings.ToLower(pf.Checksum)
+
+		input := &s3.PutObjectInput{
+			Bucket:        &bucket,
+			Key:           &key,
+			ContentLength: aws.Int64(pf.Size),
+			ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(md5Sum)),
+			Metadata:      map[string]*string{checksumMetaKey: aws.String(checksum)},
+		}
+		input.ContentType = aws.String(checked.ContentType)
+		req, _ := ph.Svc.PutObjectRequest(input)
+		url, signedHeaders, err := req.PresignRequest(presignExpiration)
+		if err != nil {
+			log.Printf("Failed to presign %s/%s, %s\n", bucket, key, err.Error())
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"unable to presign upload"}`))
+			return
+		}
+
+		_, err = database.ADB.Db.Exec(insertPendingUpload, key, currentParticipant.ID, currentParticipant.Study,
+			startOfWeekMillis, pf.Size, checksum, hex.EncodeToString(md5Sum), checked.ContentType, expiresAt)
+		if err != nil {
+			log.Println("failed to save pending upload")
+			log.Println(err)
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"unable to presign upload"}`))
+			return
+		}
+
+		headers := map[string]string{}
+		for name := range signedHeaders {
+			if strings.ToLower(name) != "host" {
+				headers[name] = signedHeaders.Get(name)
+			}
+		}
+		uploads = append(uploads, PresignedUpload{Filename: filename, Key: key, URL: url, Headers: headers, ExpiresAt: expiresAt})
+	}
+
+	jsonObject, _ := json.Marshal(uploads)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.Write(jsonObject)
+}
+
+func (ch CompleteUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	currentParticipant, ok := authorizeUpload(w, r)
+	if !ok {
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var cr CompleteUploadRequest
+	if err := dec.Decode(&cr); err != nil || cr.Key == "" {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.Write([]byte(errorResJSON))
+		return
+	}
+
+	f, md5Hex, err := scanPendingUpload(database.ADB.Db.QueryRow(selectPendingUpload, cr.Key, currentParticipant.ID,
+		time.Now().UTC().Add(-completeGrace)))
+	if err == nil {
+		err = verifyUpload(ch.Svc, f, md5Hex)
+	}
+	switch err {
+	case nil:
+	case errNoPendingUpload:
+		log.Printf("no pending upload for %s\n", cr.Key)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"no pending upload for key"}`))
+		return
+	case errNotUploaded, errUploadMismatch:
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusConflict)
+		errorJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
+		w.Write(errorJSON)
+		return
+	default:
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"unable to record upload"}`))
+		return
+	}
+
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.Write([]byte("{\"success\": \"you have completed upload to awsS3Bucket\"}"))
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPendingUpload catalog entry and hex md5 of a pending upload
+func scanPendingUpload(row rowScanner) (file_catalog.File, string, error) {
+	var f file_catalog.File
+	var md5Hex string
+	err := row.Scan(&f.Key, &f.ParticipantID, &f.Study, &f.WeekMillis, &f.Size, &f.Checksum, &md5Hex, &f.ContentType)
+	if err == sql.ErrNoRows {
+		return f, "", errNoPendingUpload
+	}
+	return f, md5Hex, err
+}
+
+// verifyUpload checks the object in s3 against the pending upload and moves
+// it to the file catalog
+func verifyUpload(svc *s3.S3, f file_catalog.File, md5Hex string) error {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("awsS3Bucket"), Key: aws.String(f.Key)})
+	if err != nil {
+		log.Printf("object %s not found after presigned upload: %s\n", f.Key, err.Error())
+		return errNotUploaded
+	}
+	f.ETag = strings.Trim(aws.StringValue(head.ETag), `"`)
+	if aws.Int64Value(head.ContentLength) != f.Size || f.ETag != md5Hex ||
+		aws.StringValue(head.Metadata[checksumMetaKey]) != f.Checksum {
+		log.Printf("object %s does not match pending upload {Size: %d, Expected: %d}\n", f.Key, aws.Int64Value(head.ContentLength), f.Size)
+		return errUploadMismatch
+	}
+	if err := file_catalog.RecordFile(f); err != nil {
+		return err
+	}
+	if _, err := database.ADB.Db.Exec(deletePendingUpload, f.Key); err != nil {
+		log.Println("failed to delete pending upload")
+		log.Println(err)
+	}
+	return nil
+}
+
+// StartPendingUploadSweep every interval catalogs uploads whose completion
+// grace passed but whose object arrived, and drops the ones never uploaded
+func StartPendingUploadSweep(svc *s3.S3, interval time.Duration) {
+	log.Println("Starting pending upload sweep...")
+	go func() {
+		for {
+			sweepPendingUploads(svc)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func sweepPendingUploads(svc *s3.S3) {
+	rows, err := database.ADB.Db.Query(selectStaleUploads, time.Now().UTC().Add(-completeGrace))
+	if err != nil {
+		log.Println("failed to query stale pending uploads")
+		log.Println(err)
+		return
+	}
+	type stale struct {
+		f      file_catalog.File
+		md5Hex string
+	}
+	var batch []stale
+	for rows.Next() {
+		f, md5Hex, err := scanPendingUpload(rows)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		batch = append(batch, stale{f, md5Hex})
+	}
+	rows.Close()
+
+	for _, p := range batch {
+		err := verifyUpload(svc, p.f, p.md5Hex)
+		switch err {
+		case nil:
+			log.Printf("Cataloged upload that was never completed {Key: %s}\n", p.f.Key)
+		case errNotUploaded, errUploadMismatch:
+			if _, err := database.ADB.Db.Exec(deletePendingUpload, p.f.Key); err != nil {
+				log.Printf("failed to delete pending upload %s: %s\n", p.f.Key, err.Error())
+			}
+		default:
+			log.Printf("failed to catalog pending upload %s: %s\n", p.f.Key, err.Error())
+		}
+	}
+}
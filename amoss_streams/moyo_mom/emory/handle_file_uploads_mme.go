@@ -2,17 +2,27 @@ package emory
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cliffordlab/amoss_services/alerts"
+	"github.com/cliffordlab/amoss_services/bp_readings"
 	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/consent"
 	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/file_catalog"
+	"github.com/cliffordlab/amoss_services/ingest"
+	"github.com/cliffordlab/amoss_services/jobs"
 	"github.com/cliffordlab/amoss_services/participant"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/cliffordlab/amoss_services/studies"
 	"github.com/cliffordlab/amoss_services/support/moyo_mom_emory"
 	"github.com/dgrijalva/jwt-go"
 )
@@ -22,12 +32,17 @@ const (
 	partialSucess    = `{"partial success":"able to upload some data to awsS3Bucket files",
     "description":"all files were not able to be upload may be due to empty files"}`
 	invalidAccessToken = `{"logout user":"Invalid access token."}`
-	insertVitalsData   = `INSERT INTO bp_readings 
-(created_at, participant_id, systolic_bp, diastolic_bp, pulse, jpg_s3_key, csv_s3_key) 
-VALUES($1, $2, $3, $4, $5, $6, $7)`
+	enqueueFailed      = `{"error":"unable to process upload, please try again"}`
+	consentRequiredErr = `{"error":"the current consent document has not been signed"}`
+	// inserts are skipped when the reading already exists so a retried job does not duplicate it
+	insertVitalsData = `INSERT INTO bp_readings 
+(created_at, participant_id, systolic_bp, diastolic_bp, pulse, jpg_s3_key, csv_s3_key, plausibility_flags) 
+SELECT $1, $2, $3, $4, $5, $6, $7, $8
+WHERE NOT EXISTS (SELECT 1 FROM bp_readings WHERE participant_id = $2 AND created_at = $1)`
 	insertSymptomsData = `INSERT INTO mme_symptoms 
 (created_at, participant_id, blurried_vision, headache, difficulty_breathing, side_pain) 
-VALUES($1, $2, $3, $4, $5, $6)`
+SELECT $1, $2, $3, $4, $5, $6
+WHERE NOT EXISTS (SELECT 1 FROM mme_symptoms WHERE participant_id = $2 AND created_at = $1)`
 )
 
 type UploadMMEVitalsHandler struct {
@@ -114,14 +129,12 @@ func (u UploadMMESymptomsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "Invalid token type", http.StatusUnauthorized)
 		return
 	}
-	checkSymptomsThreshold(psr, currentParticipant)
-
 	//todo	query database to match header token with token in DB and continue
 	// else return you are already logged in and log them out return 400 unauthorized or forbidden?
 	// Bearer token or token?
 
 	log.Println("Querying db for access token")
-	query := "SELECT access_token FROM participants WHERE participant_id = $1 AND access_token = $2"
+	query := "SELECT access_token FROM participants WHERE participant_id = $1 AND access_token = $2 AND lifecycle_state <> 'withdrawn'"
 	rows, err := database.ADB.Db.Query(query, currentParticipant.ID, bearerToken)
 	if err != nil {
 		log.Println("failed to execute get access_token query")
@@ -145,6 +158,14 @@ func (u UploadMMESymptomsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 	log.Println("This is the access token: " + accessTokenDB)
 	log.Println("This is the bearer token: " + bearerToken)
 
+	if accessTokenDB == bearerToken && !consent.Current(currentParticipant.Study, currentParticipant.ID) {
+		log.Printf("Rejected upload of participant %d without a current consent\n", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(consentRequiredErr))
+		return
+	}
+
 	if accessTokenDB == bearerToken {
 		log.Println("Access token matches Database token...")
 		bucket := "awsS3Bucket"
@@ -161,9 +182,17 @@ func (u UploadMMESymptomsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 
 		//get the *fileheaders
 		files := m.File["upload"]
+		checked, err := ingest.CheckFiles(currentParticipant.Study, files)
+		if err != nil {
+			log.Printf("Rejected upload for participant %d: %s\n", currentParticipant.ID, err.Error())
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(ingest.ErrorJSON(err)))
+			return
+		}
 		for i, f := range files {
 			//for each fileheader, get a handle to the actual file
-			filename := files[i].Filename
+			filename := checked[i].Filename
 			key := setKey(currentParticipant, startOfWeekMillis, filename)
 			//file, err := files[i].Open()
 			file, err := f.Open()
@@ -174,11 +203,13 @@ func (u UploadMMESymptomsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 				return
 			}
 
-			uploadResult, err := u.Svc.PutObject(&s3.PutObjectInput{
-				Bucket: &bucket,
-				Key:    &key,
-				Body:   file,
-			})
+			uploadResult, err := file_catalog.Upload(u.Svc, bucket, file_catalog.File{
+				ParticipantID: currentParticipant.ID,
+				Study:         currentParticipant.Study,
+				WeekMillis:    startOfWeekMillis,
+				Key:           key,
+				ContentType:   checked[i].ContentType,
+			}, file)
 			if err != nil {
 				fullUpload = false
 				log.Printf("Failed to upload data to %s/%s, %s\n", bucket, key, err.Error())
@@ -186,15 +217,29 @@ func (u UploadMMESymptomsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 
 			if !fullUpload {
 				log.Printf("This is the result of the upload: %s\n{Key: %s, Success: partial}\n", uploadResult.GoString(), key)
-				w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
-				w.Write([]byte(partialSucess))
 			} else {
 				log.Printf("This is the result of the upload: %s\n{Key: %s, Success: full}\n", uploadResult.GoString(), key)
-				w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
-				w.Write([]byte("{\"success\": \"you have completed upload to awsS3Bucket\"}"))
 			}
 		}
-		insertSymptomsIntoDB(currentParticipant, psr)
+
+		_, err = jobs.Enqueue(symptomsJobKind, SymptomsJob{
+			ParticipantID: currentParticipant.ID,
+			Study:         currentParticipant.Study,
+			Symptoms:      psr,
+		})
+		if err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(enqueueFailed))
+			return
+		}
+		if !fullUpload {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.Write([]byte(partialSucess))
+		} else {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.Write([]byte("{\"success\": \"you have completed upload to awsS3Bucket\"}"))
+		}
 	} else {
 		log.Println("Access token does not match that of the database")
 		log.Println("Participant_ID: ", currentParticipant.ID)
@@ -205,40 +250,36 @@ func (u UploadMMESymptomsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-func insertSymptomsIntoDB(currentParticipant participant.Participant, psr ParticipantSymptomsRequest) {
+func insertSymptomsIntoDB(currentParticipant participant.Participant, psr ParticipantSymptomsRequest) error {
 	log.Println("Inserting symptoms into DB..")
 
-	stmt, err := database.ADB.Db.Prepare(insertSymptomsData)
+	_, err := database.ADB.Db.Exec(insertSymptomsData, psr.CreatedAt, currentParticipant.ID, psr.BV, psr.HA, psr.DB, psr.SP)
 	if err != nil {
-		log.Println("failed to prepare insert symptom statement")
-		log.Fatalln(err)
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query(psr.CreatedAt, currentParticipant.ID, psr.BV, psr.HA, psr.DB, psr.SP)
-	if err != nil {
-		log.Println("failed to execute query statement")
-		log.Fatalln(err)
+		log.Println("failed to insert symptoms")
+		return err
 	}
 	log.Println("Symptom data inserted successfully into db.")
-	rows.Close()
+	return nil
 }
 
-func checkSymptomsThreshold(psr ParticipantSymptomsRequest, currentParticipant participant.Participant) {
-	log.Println("Checking symptoms thresholds... ")
-	//systolic BP >160 mm Hg or diastolic BP>110 mm Hg
-	patientID := currentParticipant.ID
-	patientIDString := strconv.FormatInt(patientID, 10)
-
-	bvString := strconv.FormatBool(psr.BV)
-	haString := strconv.FormatBool(psr.HA)
-	dbString := strconv.FormatBool(psr.DB)
-	spString := strconv.FormatBool(psr.SP)
-
-	if psr.BV == true || psr.HA == true || psr.DB == true || psr.SP == true {
-		log.Println("Symptoms threshold reached. Attempting to send email...")
-		moyo_mom_emory.SendSymptomsEmail(aws.String("\n Symptom alert for participant: " + patientIDString + "\n Blurried vision: " + bvString + "\n Head ache: " + haString + "\n Difficulty Breathing: " + dbString + "\n Side Pain: " + spString))
+func checkSymptomsThreshold(psr ParticipantSymptomsRequest, currentParticipant participant.Participant) error {
+	log.Println("Checking symptoms alert rules... ")
+	triggered, err := alerts.EvaluateSymptoms(currentParticipant.Study, currentParticipant.ID, alerts.SymptomReport{
+		CreatedAt:           bp_readings.CreatedAtTime(psr.CreatedAt),
+		BlurriedVision:      psr.BV,
+		Headache:            psr.HA,
+		DifficultyBreathing: psr.DB,
+		SidePain:            psr.SP,
+	})
+	if err != nil {
+		return err
 	}
+	for _, alert := range triggered {
+		if err := notifyAlert(currentParticipant, alert, moyo_mom_emory.SendSymptomsEmail); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type ParticipantVitalsRequest struct {
@@ -246,6 +287,8 @@ type ParticipantVitalsRequest struct {
 	DBP       int
 	Pulse     int
 	CreatedAt int64
+	// plausibility flags of a reading that passed validation
+	Flags []string
 }
 
 func (uh UploadMMEVitalsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -264,15 +307,6 @@ func (uh UploadMMEVitalsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	}
 	m := r.Form
 
-	pvr.SBP, _ = strconv.Atoi(m.Get("sbp"))
-	pvr.DBP, _ = strconv.Atoi(m.Get("dbp"))
-	pvr.Pulse, _ = strconv.Atoi(m.Get("pulse"))
-	pvr.CreatedAt, _ = strconv.ParseInt(m.Get("created_at"), 10, 64)
-
-	log.Println("SBP: " + strconv.Itoa(pvr.SBP))
-	log.Println("DBP" + strconv.Itoa(pvr.DBP))
-	log.Println("Pulse" + strconv.Itoa(pvr.Pulse))
-
 	startOfWeekMillis := r.Header.Get("weekMillis")
 	if len(startOfWeekMillis) != 12 {
 		log.Println("token length is wrong")
@@ -313,14 +347,12 @@ func (uh UploadMMEVitalsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	checkThreshold(pvr, currentParticipant)
-
 	//todo	query database to match header token with token in DB and continue
 	// else return you are already logged in and log them out return 400 unauthorized or forbidden?
 	// Bearer token or token?
 
 	log.Println("Querying db for access token")
-	query := "SELECT access_token FROM participants WHERE participant_id = $1 AND access_token = $2"
+	query := "SELECT access_token FROM participants WHERE participant_id = $1 AND access_token = $2 AND lifecycle_state <> 'withdrawn'"
 	rows, err := database.ADB.Db.Query(query, currentParticipant.ID, bearerToken)
 	if err != nil {
 		log.Println("failed to execute get access_token query")
@@ -344,7 +376,43 @@ func (uh UploadMMEVitalsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	log.Println("This is the access token: " + accessTokenDB)
 	log.Println("This is the bearer token: " + bearerToken)
 
+	if accessTokenDB == bearerToken && !consent.Current(currentParticipant.Study, currentParticipant.ID) {
+		log.Printf("Rejected upload of participant %d without a current consent\n", currentParticipant.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(consentRequiredErr))
+		return
+	}
+
 	if accessTokenDB == bearerToken {
+		enrolledAt, err := bp_readings.EnrolledAt(currentParticipant.ID)
+		if err != nil {
+			log.Printf("failed to query enrollment of participant %d: %s\n", currentParticipant.ID, err.Error())
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(enqueueFailed))
+			return
+		}
+		// rejected before anything is stored, implausible values are kept but flagged
+		submitted, flags, fieldErrors := bp_readings.ValidateVitals(m, enrolledAt, time.Now())
+		if len(fieldErrors) > 0 {
+			log.Printf("Rejected vitals of participant %d: %+v\n", currentParticipant.ID, fieldErrors)
+			body, _ := json.Marshal(map[string]interface{}{"error": "invalid vitals", "fields": fieldErrors})
+			w.Header().Add("Content-Type", "application/json; charset=UTF-8")
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write(body)
+			return
+		}
+		pvr = ParticipantVitalsRequest{SBP: submitted.SBP, DBP: submitted.DBP, Pulse: submitted.Pulse,
+			CreatedAt: submitted.CreatedAt, Flags: flags}
+		log.Println("SBP: " + strconv.Itoa(pvr.SBP))
+		log.Println("DBP" + strconv.Itoa(pvr.DBP))
+		log.Println("Pulse" + strconv.Itoa(pvr.Pulse))
+		if len(flags) > 0 {
+			log.Printf("Vitals of participant %d flagged: %s\n", currentParticipant.ID, strings.Join(flags, ","))
+		}
+
 		bucket := "awsS3Bucket"
 		fullUpload := true
 		err = r.ParseMultipartForm(defaultMaxMemory)
@@ -354,14 +422,46 @@ func (uh UploadMMEVitalsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		csvFilename := strconv.FormatInt(currentParticipant.ID, 10) + "_" + strconv.FormatInt(pvr.CreatedAt, 10) + "_bp.csv"
-
-		csvS3Key := setKey(currentParticipant, startOfWeekMillis, csvFilename)
-		fullUpload = uh.uploadCSV(csvFilename, pvr, bucket, fullUpload, csvS3Key)
-		fullUpload, done := uh.uploadJPEG(w, r, currentParticipant, startOfWeekMillis, bucket, fullUpload)
+		checked, err := ingest.CheckFiles(currentParticipant.Study, r.MultipartForm.File["upload"])
+		if err != nil {
+			log.Printf("Rejected upload for participant %d: %s\n", currentParticipant.ID, err.Error())
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(ingest.ErrorJSON(err)))
+			return
+		}
+		// the photo only lives in this request so it is stored right away,
+		// the derived csv, db insert and alerting run in the job queue
+		jpgS3Key, fullUpload, done := uh.uploadJPEG(w, r, checked, currentParticipant, startOfWeekMillis, bucket, fullUpload)
 		if done {
 			return
 		}
+		_, err = jobs.Enqueue(vitalsJobKind, VitalsJob{
+			ParticipantID: currentParticipant.ID,
+			Study:         currentParticipant.Study,
+			WeekMillis:    startOfWeekMillis,
+			JPGKey:        jpgS3Key,
+			Vitals:        pvr,
+		})
+		if err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(enqueueFailed))
+			return
+		}
+		// the proposal is only a hint for reviewers, the upload succeeds without
+		// it. The job of a photo that never reached s3 fails until it is buried.
+		if jpgS3Key != "" {
+			_, err = jobs.Enqueue(bpImageJobKind, BPImageJob{
+				ParticipantID: currentParticipant.ID,
+				CreatedAt:     pvr.CreatedAt,
+				Bucket:        bucket,
+				JPGKey:        jpgS3Key,
+			})
+			if err != nil {
+				log.Printf("Failed to queue reading of %s: %s\n", jpgS3Key, err.Error())
+			}
+		}
 		if !fullUpload {
 			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
 			w.Write([]byte(partialSucess))
@@ -369,8 +469,6 @@ func (uh UploadMMEVitalsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
 			w.Write([]byte("{\"success\": \"you have completed upload to awsS3Bucket/moyo-mom-emory/\"}"))
 		}
-		insertVitalsToDB(currentParticipant, mMEJPEGS3Key, csvS3Key, pvr)
-
 	} else {
 		log.Println("Access token does not match that of the database")
 		log.Println("Participant_ID: ", currentParticipant.ID)
@@ -381,67 +479,87 @@ func (uh UploadMMEVitalsHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-var mMEJPEGS3Key string
-
-func checkThreshold(pvr ParticipantVitalsRequest, currentParticipant participant.Participant) {
-	log.Println("Checking vital thresholds... ")
-	//systolic BP >160 mm Hg or diastolic BP>110 mm Hg
-	patientID := currentParticipant.ID
-	patientIDString := strconv.FormatInt(patientID, 10)
-
-	sbpString := strconv.Itoa(pvr.SBP)
-	dbpString := strconv.Itoa(pvr.DBP)
-	pulseString := strconv.Itoa(pvr.Pulse)
-
-	if pvr.SBP > 160 || pvr.DBP > 110 {
-		log.Println("Vital threshold reached. Attempting to send email...")
-		moyo_mom_emory.SendVitalEmail(aws.String("Threshold reached for participant: " + patientIDString + " SDP: " + sbpString + " DBP: " + dbpString + " Pulse: " + pulseString))
+// notifyAlert saves the alert and sends it to the topic of the participant's
+// site unless a previous attempt of the same job already did
+func notifyAlert(currentParticipant participant.Participant, alert alerts.Alert, send func(topic string, msg *string) error) error {
+	alertID, notified, err := alerts.Open(currentParticipant.Study, alert)
+	if err != nil {
+		return err
 	}
+	if notified {
+		return nil
+	}
+	log.Printf("Alert rule %s reached. Attempting to send email...\n", alert.Rule)
+	if err := send(sites.AlertTopic(currentParticipant.ID), aws.String(alert.Message)); err != nil {
+		return err
+	}
+	return alerts.MarkNotified(alertID)
+}
 
+func checkThreshold(pvr ParticipantVitalsRequest, currentParticipant participant.Participant) error {
+	log.Println("Checking vital alert rules... ")
+	triggered, err := alerts.EvaluateVitals(currentParticipant.Study, currentParticipant.ID, alerts.Reading{
+		CreatedAt: bp_readings.CreatedAtTime(pvr.CreatedAt),
+		SBP:       pvr.SBP,
+		DBP:       pvr.DBP,
+		Pulse:     pvr.Pulse,
+	})
+	if err != nil {
+		return err
+	}
+	for _, alert := range triggered {
+		if err := notifyAlert(currentParticipant, alert, moyo_mom_emory.SendVitalEmail); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (uh UploadMMEVitalsHandler) uploadJPEG(w http.ResponseWriter, r *http.Request, currentParticipant participant.Participant, startOfWeekMillis string, bucket string, fullUpload bool) (bool, bool) {
+func (uh UploadMMEVitalsHandler) uploadJPEG(w http.ResponseWriter, r *http.Request, checked []ingest.Checked, currentParticipant participant.Participant, startOfWeekMillis string, bucket string, fullUpload bool) (string, bool, bool) {
 	log.Println("Uploading JPEG to S3...")
 	m := r.MultipartForm
 
 	//get the *fileheaders
 	files := m.File["upload"]
+	var jpgS3Key string
 	for i, f := range files {
 		//for each fileheader, get a handle to the actual file
-		filename := files[i].Filename
-		mMEJPEGS3Key = setKey(currentParticipant, startOfWeekMillis, filename)
+		filename := checked[i].Filename
+		jpgS3Key = setKey(currentParticipant, startOfWeekMillis, filename)
 		log.Println("this is the key: ")
-		log.Println(mMEJPEGS3Key)
+		log.Println(jpgS3Key)
 
 		//file, err := files[i].Open()
 		file, err := f.Open()
 		defer file.Close()
 		if err != nil {
-			log.Printf("{Error: %s, Key: %s}\n", err.Error(), mMEJPEGS3Key)
+			log.Printf("{Error: %s, Key: %s}\n", err.Error(), jpgS3Key)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return false, true
+			return jpgS3Key, false, true
 		}
 
-		uploadResult, err := uh.Svc.PutObject(&s3.PutObjectInput{
-			Bucket: &bucket,
-			Key:    &mMEJPEGS3Key,
-			Body:   file,
-		})
+		uploadResult, err := file_catalog.Upload(uh.Svc, bucket, file_catalog.File{
+			ParticipantID: currentParticipant.ID,
+			Study:         currentParticipant.Study,
+			WeekMillis:    startOfWeekMillis,
+			Key:           jpgS3Key,
+			ContentType:   checked[i].ContentType,
+		}, file)
 		if err != nil {
 			fullUpload = false
-			log.Printf("Failed to upload data to %s/%s, %s\n", bucket, mMEJPEGS3Key, err.Error())
+			log.Printf("Failed to upload data to %s/%s, %s\n", bucket, jpgS3Key, err.Error())
 		}
 
 		if !fullUpload {
-			log.Printf("This is the result of the upload: %s\n{Key: %s, Success: partial}\n", uploadResult.GoString(), mMEJPEGS3Key)
+			log.Printf("This is the result of the upload: %s\n{Key: %s, Success: partial}\n", uploadResult.GoString(), jpgS3Key)
 		} else {
-			log.Printf("This is the result of the upload: %s\n{Key: %s, Success: full}\n", uploadResult.GoString(), mMEJPEGS3Key)
+			log.Printf("This is the result of the upload: %s\n{Key: %s, Success: full}\n", uploadResult.GoString(), jpgS3Key)
 		}
 	}
-	return fullUpload, false
+	return jpgS3Key, fullUpload, false
 }
 
-func (uh UploadMMEVitalsHandler) uploadCSV(csvFilename string, pvr ParticipantVitalsRequest, bucket string, fullUpload bool, s3key string) bool {
+func uploadCSV(svc *s3.S3, currentParticipant participant.Participant, startOfWeekMillis string, pvr ParticipantVitalsRequest, bucket string, fullUpload bool, s3key string) bool {
 	log.Println("Writing new CSV file to upload to ...")
 	log.Println("SBP: " + strconv.Itoa(pvr.SBP))
 	log.Println("DBP" + strconv.Itoa(pvr.DBP))
@@ -453,11 +571,13 @@ func (uh UploadMMEVitalsHandler) uploadCSV(csvFilename string, pvr ParticipantVi
 	bb.Write([]byte("Pulse: " + strconv.Itoa(pvr.Pulse) + ", "))
 	reader := bytes.NewReader(bb.Bytes())
 	log.Println("Uploading new csv File... ")
-	uploadResult, err := uh.Svc.PutObject(&s3.PutObjectInput{
-		Body:   reader,
-		Bucket: &bucket,
-		Key:    &s3key,
-	})
+	uploadResult, err := file_catalog.Upload(svc, bucket, file_catalog.File{
+		ParticipantID: currentParticipant.ID,
+		Study:         currentParticipant.Study,
+		WeekMillis:    startOfWeekMillis,
+		Key:           s3key,
+		ContentType:   "text/csv",
+	}, reader)
 
 	//file, err := os.Create(csvFilename)
 	//if err != nil {
@@ -502,39 +622,49 @@ func (uh UploadMMEVitalsHandler) uploadCSV(csvFilename string, pvr ParticipantVi
 	return fullUpload
 }
 
-func insertVitalsToDB(currentParticipant participant.Participant, jpgS3Key string, csvS3Key string, pvr ParticipantVitalsRequest) {
+func insertVitalsToDB(currentParticipant participant.Participant, jpgS3Key string, csvS3Key string, pvr ParticipantVitalsRequest) error {
 	log.Println("Inserting s3Key into DB..")
 
 	log.Println("pvr.SBP: " + strconv.Itoa(pvr.SBP))
 	log.Println("pvr.DBP: " + strconv.Itoa(pvr.DBP))
 	log.Println("pvr.Pulse: " + strconv.Itoa(pvr.Pulse))
 
-	stmt, err := database.ADB.Db.Prepare(insertVitalsData)
+	tx, err := database.ADB.Db.Begin()
 	if err != nil {
-		log.Println("failed to prepare insert s3 key statement")
-		log.Fatalln(err)
+		return err
 	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query(pvr.CreatedAt, currentParticipant.ID, pvr.SBP, pvr.DBP, pvr.Pulse, jpgS3Key, csvS3Key)
+	defer tx.Rollback()
+	result, err := tx.Exec(insertVitalsData, pvr.CreatedAt, currentParticipant.ID, pvr.SBP, pvr.DBP, pvr.Pulse, jpgS3Key, csvS3Key,
+		strings.Join(pvr.Flags, ","))
 	if err != nil {
-		log.Println("failed to execute query statement")
-		log.Fatalln(err)
+		log.Println("failed to insert vitals")
+		return err
+	}
+	// a retried job finds the reading and its first revision already saved
+	if inserted, _ := result.RowsAffected(); inserted == 1 {
+		values := participant.Values{SBP: pvr.SBP, DBP: pvr.DBP, Pulse: pvr.Pulse}
+		if err := participant.RecordUpload(tx, currentParticipant.ID, pvr.CreatedAt, values, csvS3Key); err != nil {
+			log.Println("failed to record the first revision of the vitals")
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
 	log.Println("S3 Key inserted successfully into db.")
-	rows.Close()
+	return nil
 }
 
 func SetPartialKey(currentParticipant participant.Participant, startOfWeekMillis string) string {
 	var partialKey string
-	partialKey = "test/" + currentParticipant.Study + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis
+	partialKey = "test/" + studies.KeyPrefix(currentParticipant.Study) + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis
 
 	return partialKey
 }
 
 func setKey(currentParticipant participant.Participant, startOfWeekMillis string, filename string) string {
 	var key string
-	key = "test/" + currentParticipant.Study + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis + "/" + filename
+	key = "test/" + studies.KeyPrefix(currentParticipant.Study) + "/" + strconv.FormatInt(currentParticipant.ID, 10) + "/" + startOfWeekMillis + "/" + filename
 
 	return key
 }
@@ -0,0 +1,171 @@
+package emory
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cliffordlab/amoss_services/bpimage"
+	"github.com/cliffordlab/amoss_services/jobs"
+	"github.com/cliffordlab/amoss_services/participant"
+	"github.com/cliffordlab/amoss_services/questionnaires"
+)
+
+const (
+	vitalsJobKind   = "mme_vitals"
+	symptomsJobKind = "mme_symptoms"
+	bpImageJobKind  = "mme_bp_image"
+	// questionnaire answered with the symptoms upload of the app
+	symptomsInstrument = "moyo_symptoms"
+)
+
+// VitalsJob payload of the post-upload processing of a vitals reading
+type VitalsJob struct {
+	ParticipantID int64                    `json:"participantID"`
+	Study         string                   `json:"study"`
+	WeekMillis    string                   `json:"weekMillis"`
+	JPGKey        string                   `json:"jpgKey"`
+	Vitals        ParticipantVitalsRequest `json:"vitals"`
+}
+
+// SymptomsJob payload of the post-upload processing of a symptoms report
+type SymptomsJob struct {
+	ParticipantID int64                      `json:"participantID"`
+	Study         string                     `json:"study"`
+	Symptoms      ParticipantSymptomsRequest `json:"symptoms"`
+}
+
+// BPImageJob payload of reading the values off a stored blood pressure photo
+type BPImageJob struct {
+	ParticipantID int64  `json:"participantID"`
+	CreatedAt     int64  `json:"createdAt"`
+	Bucket        string `json:"bucket"`
+	JPGKey        string `json:"jpgKey"`
+}
+
+// RegisterJobs registers the vitals and symptoms processing with the job queue.
+// Every step is safe to repeat because a failed job is run again from the start.
+func RegisterJobs(svc *s3.S3) {
+	jobs.Register(vitalsJobKind, func(payload json.RawMessage) error {
+		var job VitalsJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return jobs.Permanent(err)
+		}
+		return processVitals(svc, job)
+	})
+	jobs.Register(symptomsJobKind, func(payload json.RawMessage) error {
+		var job SymptomsJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return jobs.Permanent(err)
+		}
+		return processSymptoms(job)
+	})
+	jobs.Register(bpImageJobKind, func(payload json.RawMessage) error {
+		var job BPImageJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return jobs.Permanent(err)
+		}
+		return processBPImage(svc, job)
+	})
+	// symptoms answered as a questionnaire go through the same processing
+	questionnaires.OnSubmit(symptomsInstrument, func(sub questionnaires.Submission) error {
+		answered := func(item string) bool {
+			v, _ := sub.Answers[item].(bool)
+			return v
+		}
+		_, err := jobs.Enqueue(symptomsJobKind, SymptomsJob{
+			ParticipantID: sub.ParticipantID,
+			Study:         sub.Study,
+			Symptoms: ParticipantSymptomsRequest{
+				BV:        answered("blurried_vision"),
+				HA:        answered("headache"),
+				DB:        answered("difficulty_breathing"),
+				SP:        answered("side_pain"),
+				CreatedAt: sub.CreatedAt,
+			},
+		})
+		return err
+	})
+}
+
+func processVitals(svc *s3.S3, job VitalsJob) error {
+	currentParticipant := participant.Participant{ID: job.ParticipantID, Study: job.Study}
+
+	csvFilename := strconv.FormatInt(job.ParticipantID, 10) + "_" + strconv.FormatInt(job.Vitals.CreatedAt, 10) + "_bp.csv"
+	csvS3Key := setKey(currentParticipant, job.WeekMillis, csvFilename)
+	if !uploadCSV(svc, currentParticipant, job.WeekMillis, job.Vitals, "awsS3Bucket", true, csvS3Key) {
+		return errors.New("failed to upload derived csv " + csvS3Key)
+	}
+	if err := insertVitalsToDB(currentParticipant, job.JPGKey, csvS3Key, job.Vitals); err != nil {
+		return err
+	}
+	if err := checkThreshold(job.Vitals, currentParticipant); err != nil {
+		log.Printf("failed to send vitals alert for participant %d\n", job.ParticipantID)
+		return err
+	}
+	return nil
+}
+
+func processSymptoms(job SymptomsJob) error {
+	currentParticipant := participant.Participant{ID: job.ParticipantID, Study: job.Study}
+
+	if err := insertSymptomsIntoDB(currentParticipant, job.Symptoms); err != nil {
+		return err
+	}
+	if err := saveSymptomsResponse(currentParticipant, job.Symptoms); err != nil {
+		return err
+	}
+	if err := checkSymptomsThreshold(job.Symptoms, currentParticipant); err != nil {
+		log.Printf("failed to send symptoms alert for participant %d\n", job.ParticipantID)
+		return err
+	}
+	return nil
+}
+
+// processBPImage proposes values for the photo of a reading. A photo the
+// reader finds nothing in is recorded, not retried.
+func processBPImage(svc *s3.S3, job BPImageJob) error {
+	object, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(job.Bucket),
+		Key:    aws.String(job.JPGKey),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	proposal, err := bpimage.Read(object.Body)
+	if err == bpimage.ErrUnreadable {
+		log.Printf("No blood pressure read from %s\n", job.JPGKey)
+		return bpimage.SaveUnreadable(job.ParticipantID, job.CreatedAt, proposal.Reader, err)
+	}
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	log.Printf("Read %d/%d pulse %d from %s with confidence %.2f\n", proposal.SBP, proposal.DBP, proposal.Pulse, job.JPGKey, proposal.Confidence)
+	return bpimage.SaveProposal(job.ParticipantID, job.CreatedAt, proposal)
+}
+
+// saveSymptomsResponse keeps the symptoms as a moyo_symptoms response too so
+// they can be read with the other questionnaires. Nothing is saved twice for
+// symptoms that were submitted as the questionnaire.
+func saveSymptomsResponse(currentParticipant participant.Participant, psr ParticipantSymptomsRequest) error {
+	inst, err := questionnaires.Get(symptomsInstrument, 0)
+	if err == questionnaires.ErrNoInstrument {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	answers := map[string]interface{}{
+		"blurried_vision":      psr.BV,
+		"headache":             psr.HA,
+		"difficulty_breathing": psr.DB,
+		"side_pain":            psr.SP,
+	}
+	_, err = questionnaires.Save(currentParticipant.ID, currentParticipant.Study, inst, psr.CreatedAt, answers)
+	return err
+}
@@ -0,0 +1,347 @@
+package bp_readings
+
+import (
+	"math"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/sites"
+)
+
+// blood pressure categories in pregnancy, from lowest to highest
+const (
+	CategoryNormal   = "normal"
+	CategoryElevated = "elevated"
+	CategoryMild     = "mild"
+	CategorySevere   = "severe"
+)
+
+const (
+	// participant 0 selects every participant of the study, followed by the
+	// site condition of the coordinator and studyReadingsRange
+	selectStudyReadings = `SELECT r.participant_id, r.timezone, r.ms, r.systolic_bp, r.diastolic_bp FROM
+(SELECT p.participant_id, COALESCE(p.timezone, s.timezone, '') AS timezone,
+CASE WHEN b.created_at < 1000000000000 THEN b.created_at + 1000000000000 ELSE b.created_at END AS ms,
+b.systolic_bp, b.diastolic_bp FROM bp_readings b
+JOIN participants p ON p.participant_id = b.participant_id
+LEFT JOIN reminder_settings s ON s.study_id = p.study_id
+WHERE p.study_id = $1 AND ($2::bigint = 0 OR p.participant_id = $2) AND `
+	studyReadingsRange = `) r
+WHERE r.ms >= $3 AND r.ms < $4 ORDER BY r.participant_id, r.ms`
+)
+
+var categoryRank = map[string]int{CategoryNormal: 0, CategoryElevated: 1, CategoryMild: 2, CategorySevere: 3}
+
+// Classify category of one reading. The higher of the systolic and diastolic
+// category wins: severe from 160/110, mild from 140/90, elevated from 120/80.
+func Classify(sbp int, dbp int) string {
+	switch {
+	case sbp >= 160 || dbp >= 110:
+		return CategorySevere
+	case sbp >= 140 || dbp >= 90:
+		return CategoryMild
+	case sbp >= 120 || dbp >= 80:
+		return CategoryElevated
+	}
+	return CategoryNormal
+}
+
+// CategoryCounts number of readings or participants in each category
+type CategoryCounts struct {
+	Normal   int `json:"normal"`
+	Elevated int `json:"elevated"`
+	Mild     int `json:"mild"`
+	Severe   int `json:"severe"`
+}
+
+func (c *CategoryCounts) add(category string, n int) {
+	switch category {
+	case CategoryNormal:
+		c.Normal += n
+	case CategoryElevated:
+		c.Elevated += n
+	case CategoryMild:
+		c.Mild += n
+	case CategorySevere:
+		c.Severe += n
+	}
+}
+
+// Average mean pressure over a period, nil values when it had no readings
+type Average struct {
+	Readings int      `json:"readings"`
+	SBP      *float64 `json:"sbp"`
+	DBP      *float64 `json:"dbp"`
+}
+
+// Variability standard deviation and average real variability (mean absolute
+// difference of successive readings), nil with fewer than two readings
+type Variability struct {
+	SBPSD  *float64 `json:"sbpSD"`
+	DBPSD  *float64 `json:"dbpSD"`
+	SBPARV *float64 `json:"sbpARV"`
+	DBPARV *float64 `json:"dbpARV"`
+}
+
+// WeekMean mean pressure of one week starting on Monday
+type WeekMean struct {
+	WeekStart string  `json:"weekStart"`
+	Readings  int     `json:"readings"`
+	SBP       float64 `json:"sbp"`
+	DBP       float64 `json:"dbp"`
+}
+
+// ParticipantSummary classification and trends of one participant. Slopes are
+// the least squares fit of the weekly means in mmHg per week, nil with fewer
+// than two weeks.
+type ParticipantSummary struct {
+	ParticipantID   int64          `json:"participantID"`
+	Timezone        string         `json:"timezone"`
+	Readings        int            `json:"readings"`
+	LastReading     *time.Time     `json:"lastReading"`
+	LatestCategory  string         `json:"latestCategory"`
+	HighestCategory string         `json:"highestCategory"`
+	Categories      CategoryCounts `json:"categories"`
+	Mean            Average        `json:"mean"`
+	Rolling7Day     Average        `json:"rolling7Day"`
+	Rolling28Day    Average        `json:"rolling28Day"`
+	Variability     Variability    `json:"variability"`
+	Weeks           []WeekMean     `json:"weeks"`
+	SBPSlope        *float64       `json:"sbpSlope"`
+	DBPSlope        *float64       `json:"dbpSlope"`
+}
+
+// CohortSummary the participant summaries of a study with the study totals.
+// ParticipantsByHighest counts participants by their highest category, the
+// mean slopes are over participants with a slope.
+type CohortSummary struct {
+	Study                 string               `json:"study"`
+	Participants          int                  `json:"participants"`
+	Readings              int                  `json:"readings"`
+	Categories            CategoryCounts       `json:"categories"`
+	ParticipantsByHighest CategoryCounts       `json:"participantsByHighest"`
+	Mean                  Average              `json:"mean"`
+	MeanSBPSlope          *float64             `json:"meanSBPSlope"`
+	MeanDBPSlope          *float64             `json:"meanDBPSlope"`
+	Summaries             []ParticipantSummary `json:"summaries"`
+}
+
+type reading struct {
+	at  time.Time
+	sbp int
+	dbp int
+}
+
+// Summarize summaries of the readings in the range for every participant of
+// the study at the coordinator's sites, or only participantID when it is not
+// 0. Rolling averages end at the end of the range, or now when it is open.
+func Summarize(study string, coordinatorID int64, participantID int64, q ChartQuery, now time.Time) (CohortSummary, error) {
+	cohort := CohortSummary{Study: study, Summaries: []ParticipantSummary{}}
+	from, to := q.bounds()
+	query := selectStudyReadings + sites.Condition("p.site_id", 5) + studyReadingsRange
+	rows, err := database.ADB.Db.Query(query, study, participantID, from, to, coordinatorID)
+	if err != nil {
+		return cohort, err
+	}
+	defer rows.Close()
+
+	end := now
+	if !q.To.IsZero() {
+		end = q.To
+	}
+	var currentID int64
+	var timezone string
+	var readings []reading
+	flush := func() {
+		if len(readings) > 0 {
+			cohort.Summaries = append(cohort.Summaries, summarize(currentID, timezone, readings, end))
+		}
+	}
+	for rows.Next() {
+		var id, ms int64
+		var tz string
+		var r reading
+		if err := rows.Scan(&id, &tz, &ms, &r.sbp, &r.dbp); err != nil {
+			return cohort, err
+		}
+		if id != currentID {
+			flush()
+			currentID, timezone, readings = id, tz, nil
+		}
+		r.at = CreatedAtTime(ms)
+		readings = append(readings, r)
+	}
+	if err := rows.Err(); err != nil {
+		return cohort, err
+	}
+	flush()
+
+	var sbpSum, dbpSum, sbpSlopes, dbpSlopes float64
+	var slopes int
+	for _, s := range cohort.Summaries {
+		cohort.Participants++
+		cohort.Readings += s.Readings
+		cohort.Categories.add(CategoryNormal, s.Categories.Normal)
+		cohort.Categories.add(CategoryElevated, s.Categories.Elevated)
+		cohort.Categories.add(CategoryMild, s.Categories.Mild)
+		cohort.Categories.add(CategorySevere, s.Categories.Severe)
+		cohort.ParticipantsByHighest.add(s.HighestCategory, 1)
+		sbpSum += *s.Mean.SBP * float64(s.Readings)
+		dbpSum += *s.Mean.DBP * float64(s.Readings)
+		if s.SBPSlope != nil {
+			slopes++
+			sbpSlopes += *s.SBPSlope
+			dbpSlopes += *s.DBPSlope
+		}
+	}
+	cohort.Mean.Readings = cohort.Readings
+	if cohort.Readings > 0 {
+		cohort.Mean.SBP = rounded(sbpSum / float64(cohort.Readings))
+		cohort.Mean.DBP = rounded(dbpSum / float64(cohort.Readings))
+	}
+	if slopes > 0 {
+		cohort.MeanSBPSlope = rounded(sbpSlopes / float64(slopes))
+		cohort.MeanDBPSlope = rounded(dbpSlopes / float64(slopes))
+	}
+	return cohort, nil
+}
+
+// summarize readings of one participant, ordered by time
+func summarize(participantID int64, timezone string, readings []reading, end time.Time) ParticipantSummary {
+	loc := time.UTC
+	if l, err := time.LoadLocation(timezone); err == nil && timezone != "" {
+		loc = l
+	}
+	s := ParticipantSummary{ParticipantID: participantID, Timezone: loc.String(), Readings: len(readings),
+		HighestCategory: CategoryNormal, Weeks: []WeekMean{}}
+
+	last := readings[len(readings)-1]
+	s.LastReading = &last.at
+	s.LatestCategory = Classify(last.sbp, last.dbp)
+	for _, r := range readings {
+		category := Classify(r.sbp, r.dbp)
+		s.Categories.add(category, 1)
+		if categoryRank[category] > categoryRank[s.HighestCategory] {
+			s.HighestCategory = category
+		}
+	}
+
+	s.Mean = average(readings, time.Time{}, time.Time{})
+	s.Rolling7Day = average(readings, end.AddDate(0, 0, -7), end)
+	s.Rolling28Day = average(readings, end.AddDate(0, 0, -28), end)
+
+	if len(readings) > 1 {
+		sbp := make([]float64, len(readings))
+		dbp := make([]float64, len(readings))
+		for i, r := range readings {
+			sbp[i], dbp[i] = float64(r.sbp), float64(r.dbp)
+		}
+		s.Variability = Variability{SBPSD: rounded(stdDev(sbp)), DBPSD: rounded(stdDev(dbp)),
+			SBPARV: rounded(arv(sbp)), DBPARV: rounded(arv(dbp))}
+	}
+
+	// readings are ordered so weeks come out ordered as well
+	var weekStarts []time.Time
+	var sbpSums, dbpSums []float64
+	for _, r := range readings {
+		week := weekStart(r.at.In(loc))
+		if len(weekStarts) == 0 || !weekStarts[len(weekStarts)-1].Equal(week) {
+			weekStarts = append(weekStarts, week)
+			s.Weeks = append(s.Weeks, WeekMean{WeekStart: week.Format(dateLayout)})
+			sbpSums = append(sbpSums, 0)
+			dbpSums = append(dbpSums, 0)
+		}
+		i := len(s.Weeks) - 1
+		s.Weeks[i].Readings++
+		sbpSums[i] += float64(r.sbp)
+		dbpSums[i] += float64(r.dbp)
+	}
+	weeks := make([]float64, len(s.Weeks))
+	sbpMeans := make([]float64, len(s.Weeks))
+	dbpMeans := make([]float64, len(s.Weeks))
+	for i := range s.Weeks {
+		n := float64(s.Weeks[i].Readings)
+		s.Weeks[i].SBP = *rounded(sbpSums[i] / n)
+		s.Weeks[i].DBP = *rounded(dbpSums[i] / n)
+		// weeks since the first one, days / 7 so daylight saving does not matter
+		weeks[i] = math.Round(weekStarts[i].Sub(weekStarts[0]).Hours()/24) / 7
+		sbpMeans[i], dbpMeans[i] = sbpSums[i]/n, dbpSums[i]/n
+	}
+	if len(s.Weeks) > 1 {
+		s.SBPSlope = rounded(slope(weeks, sbpMeans))
+		s.DBPSlope = rounded(slope(weeks, dbpMeans))
+	}
+	return s
+}
+
+// average of the readings after from up to end, zero times leave that side open
+func average(readings []reading, from time.Time, end time.Time) Average {
+	var a Average
+	var sbp, dbp float64
+	for _, r := range readings {
+		if (!from.IsZero() && !r.at.After(from)) || (!end.IsZero() && r.at.After(end)) {
+			continue
+		}
+		a.Readings++
+		sbp += float64(r.sbp)
+		dbp += float64(r.dbp)
+	}
+	if a.Readings > 0 {
+		a.SBP = rounded(sbp / float64(a.Readings))
+		a.DBP = rounded(dbp / float64(a.Readings))
+	}
+	return a
+}
+
+func weekStart(t time.Time) time.Time {
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location())
+}
+
+// stdDev sample standard deviation
+func stdDev(values []float64) float64 {
+	var mean float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	var sum float64
+	for _, v := range values {
+		sum += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
+
+func arv(values []float64) float64 {
+	var sum float64
+	for i := 1; i < len(values); i++ {
+		sum += math.Abs(values[i] - values[i-1])
+	}
+	return sum / float64(len(values)-1)
+}
+
+// slope least squares slope of y over x
+func slope(x []float64, y []float64) float64 {
+	var xMean, yMean float64
+	for i := range x {
+		xMean += x[i]
+		yMean += y[i]
+	}
+	xMean /= float64(len(x))
+	yMean /= float64(len(y))
+	var num, den float64
+	for i := range x {
+		num += (x[i] - xMean) * (y[i] - yMean)
+		den += (x[i] - xMean) * (x[i] - xMean)
+	}
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// rounded to one decimal
+func rounded(v float64) *float64 {
+	r := math.Round(v*10) / 10
+	return &r
+}
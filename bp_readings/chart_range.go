@@ -0,0 +1,286 @@
+package bp_readings
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	// resolutions of the vitals chart
+	ResolutionRaw    = "raw"
+	ResolutionHourly = "hourly"
+	ResolutionDaily  = "daily"
+
+	defaultPageSize = 500
+	maxPageSize     = 5000
+	dateLayout      = "2006-01-02"
+
+	// created_at is stored either as unix millis or with the leading "1"
+	// dropped, readings are compared and ordered as millis
+	readingsInRange = `(SELECT CASE WHEN created_at < 1000000000000 THEN created_at + 1000000000000 ELSE created_at END AS ms,
+systolic_bp, diastolic_bp, pulse FROM bp_readings WHERE participant_id = $1) r WHERE r.ms >= $2 AND r.ms < $3`
+	selectRawReadings = `SELECT r.ms, r.systolic_bp, r.diastolic_bp, r.pulse FROM ` + readingsInRange + `
+ORDER BY r.ms LIMIT $4 OFFSET $5`
+	countRawReadings       = `SELECT count(*) FROM ` + readingsInRange
+	selectVerifiedReadings = `SELECT r.ms, r.systolic_bp, r.diastolic_bp, r.pulse, r.is_verified FROM
+(SELECT CASE WHEN created_at < 1000000000000 THEN created_at + 1000000000000 ELSE created_at END AS ms,
+systolic_bp, diastolic_bp, pulse, is_verified FROM bp_readings WHERE participant_id = $1) r
+WHERE r.ms >= $2 AND r.ms < $3 ORDER BY r.ms LIMIT $4 OFFSET $5`
+	// buckets are truncated in the participant's time zone so a day is a local day
+	selectBucketedReadings = `SELECT date_trunc($6, to_timestamp(r.ms / 1000.0) AT TIME ZONE $7) AS bucket,
+avg(r.systolic_bp), min(r.systolic_bp), max(r.systolic_bp),
+avg(r.diastolic_bp), min(r.diastolic_bp), max(r.diastolic_bp),
+avg(r.pulse), min(r.pulse), max(r.pulse) FROM ` + readingsInRange + `
+GROUP BY bucket ORDER BY bucket LIMIT $4 OFFSET $5`
+	countBucketedReadings     = `SELECT count(DISTINCT date_trunc($4, to_timestamp(r.ms / 1000.0) AT TIME ZONE $5)) FROM ` + readingsInRange
+	selectParticipantTimezone = `SELECT COALESCE(p.timezone, s.timezone, '') FROM participants p
+LEFT JOIN reminder_settings s ON s.study_id = p.study_id WHERE p.participant_id = $1`
+)
+
+// ChartQuery time range, resolution and page of a chart request. A zero
+// From or To leaves that side of the range open.
+type ChartQuery struct {
+	From       time.Time
+	To         time.Time
+	Resolution string
+	Page       int
+	PageSize   int
+	Location   *time.Location
+}
+
+// Paging tells the dashboard which part of the range it received
+type Paging struct {
+	Resolution string `json:"resolution"`
+	Timezone   string `json:"timezone"`
+	Page       int    `json:"page"`
+	PageSize   int    `json:"pageSize"`
+	Total      int    `json:"total"`
+}
+
+// ParseChartQuery reads from, to, resolution, page and pageSize from the
+// query string. The dates of the request body are used when the query has
+// none. Dates without a time are days in the participant's time zone, to
+// includes the whole day.
+func ParseChartQuery(query url.Values, body Body, loc *time.Location) (ChartQuery, error) {
+	q := ChartQuery{Resolution: ResolutionRaw, Page: 1, PageSize: defaultPageSize, Location: loc}
+
+	from := query.Get("from")
+	if from == "" {
+		from = body.StartingDate
+	}
+	to := query.Get("to")
+	if to == "" {
+		to = body.EndingDate
+	}
+	var err error
+	if from != "" {
+		if q.From, _, err = parseChartTime(from, loc); err != nil {
+			return q, errors.New("from must be YYYY-MM-DD, RFC 3339 or unix millis")
+		}
+	}
+	if to != "" {
+		var dateOnly bool
+		if q.To, dateOnly, err = parseChartTime(to, loc); err != nil {
+			return q, errors.New("to must be YYYY-MM-DD, RFC 3339 or unix millis")
+		}
+		if dateOnly {
+			q.To = q.To.AddDate(0, 0, 1)
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return q, errors.New("from must be before to")
+	}
+
+	if v := query.Get("resolution"); v != "" {
+		if v != ResolutionRaw && v != ResolutionHourly && v != ResolutionDaily {
+			return q, errors.New("resolution must be raw, hourly or daily")
+		}
+		q.Resolution = v
+	}
+	if v := query.Get("page"); v != "" {
+		if q.Page, err = strconv.Atoi(v); err != nil || q.Page < 1 {
+			return q, errors.New("page must be a positive number")
+		}
+	}
+	if v := query.Get("pageSize"); v != "" {
+		if q.PageSize, err = strconv.Atoi(v); err != nil || q.PageSize < 1 || q.PageSize > maxPageSize {
+			return q, errors.New("pageSize must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+	}
+	return q, nil
+}
+
+func parseChartTime(v string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation(dateLayout, v, loc); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, false, nil
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return CreatedAtTime(ms), false, nil
+}
+
+// bounds range in millis, open sides become the smallest and largest value
+func (q ChartQuery) bounds() (int64, int64) {
+	from, to := int64(0), int64(math.MaxInt64)
+	if !q.From.IsZero() {
+		from = q.From.UnixNano() / int64(time.Millisecond)
+	}
+	if !q.To.IsZero() {
+		to = q.To.UnixNano() / int64(time.Millisecond)
+	}
+	return from, to
+}
+
+func (q ChartQuery) offset() int {
+	return (q.Page - 1) * q.PageSize
+}
+
+// ParticipantLocation time zone of the participant, else of the study, else UTC
+func ParticipantLocation(participantID int64) *time.Location {
+	var name string
+	if err := database.ADB.Db.QueryRow(selectParticipantTimezone, participantID).Scan(&name); err != nil || name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// VitalsChart SBP, DBP and pulse of a participant for the requested range.
+// Hourly and daily resolutions give the mean with min and max series.
+func VitalsChart(participantID int64, q ChartQuery) ([]SeriesChart, Paging, error) {
+	paging := Paging{Resolution: q.Resolution, Timezone: q.Location.String(), Page: q.Page, PageSize: q.PageSize}
+	if q.Resolution == ResolutionRaw {
+		charts, total, err := rawVitals(participantID, q)
+		paging.Total = total
+		return charts, paging, err
+	}
+	charts, total, err := bucketedVitals(participantID, q)
+	paging.Total = total
+	return charts, paging, err
+}
+
+func rawVitals(participantID int64, q ChartQuery) ([]SeriesChart, int, error) {
+	from, to := q.bounds()
+	var total int
+	if err := database.ADB.Db.QueryRow(countRawReadings, participantID, from, to).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.ADB.Db.Query(selectRawReadings, participantID, from, to, q.PageSize, q.offset())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	sbp := SeriesChart{Name: "SBP", Series: []Series{}}
+	dbp := SeriesChart{Name: "DBP", Series: []Series{}}
+	pulse := SeriesChart{Name: "Pulse", Series: []Series{}}
+	for rows.Next() {
+		var ms int64
+		var s, d, p int
+		if err := rows.Scan(&ms, &s, &d, &p); err != nil {
+			return nil, 0, err
+		}
+		name := CreatedAtTime(ms).In(q.Location).Format(time.RFC3339)
+		sbp.Series = append(sbp.Series, Series{Name: name, Value: s})
+		dbp.Series = append(dbp.Series, Series{Name: name, Value: d})
+		pulse.Series = append(pulse.Series, Series{Name: name, Value: p})
+	}
+	return []SeriesChart{sbp, dbp, pulse}, total, rows.Err()
+}
+
+func bucketedVitals(participantID int64, q ChartQuery) ([]SeriesChart, int, error) {
+	from, to := q.bounds()
+	unit := "hour"
+	if q.Resolution == ResolutionDaily {
+		unit = "day"
+	}
+	zone := q.Location.String()
+	var total int
+	if err := database.ADB.Db.QueryRow(countBucketedReadings, participantID, from, to, unit, zone).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.ADB.Db.Query(selectBucketedReadings, participantID, from, to, q.PageSize, q.offset(), unit, zone)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	names := []string{"SBP", "SBP Min", "SBP Max", "DBP", "DBP Min", "DBP Max", "Pulse", "Pulse Min", "Pulse Max"}
+	charts := make([]SeriesChart, len(names))
+	for i, name := range names {
+		charts[i] = SeriesChart{Name: name, Series: []Series{}}
+	}
+	for rows.Next() {
+		var bucket time.Time
+		var sbpMean, dbpMean, pulseMean float64
+		var sbpMin, sbpMax, dbpMin, dbpMax, pulseMin, pulseMax int
+		err := rows.Scan(&bucket, &sbpMean, &sbpMin, &sbpMax, &dbpMean, &dbpMin, &dbpMax, &pulseMean, &pulseMin, &pulseMax)
+		if err != nil {
+			return nil, 0, err
+		}
+		// the bucket holds the wall clock of the participant's time zone
+		local := time.Date(bucket.Year(), bucket.Month(), bucket.Day(), bucket.Hour(), 0, 0, 0, q.Location)
+		name := local.Format(time.RFC3339)
+		values := []int{round(sbpMean), sbpMin, sbpMax, round(dbpMean), dbpMin, dbpMax, round(pulseMean), pulseMin, pulseMax}
+		for i, value := range values {
+			charts[i].Series = append(charts[i].Series, Series{Name: name, Value: value})
+		}
+	}
+	return charts, total, rows.Err()
+}
+
+func round(v float64) int {
+	return int(math.Floor(v + 0.5))
+}
+
+// VerificationChart raw SBP and DBP of a participant split into verified and
+// unverified series, with the pulse of every reading. Resolution is ignored,
+// unverified readings are never averaged with verified ones.
+func VerificationChart(participantID int64, q ChartQuery) ([]SeriesChart, Paging, error) {
+	paging := Paging{Resolution: ResolutionRaw, Timezone: q.Location.String(), Page: q.Page, PageSize: q.PageSize}
+	from, to := q.bounds()
+	if err := database.ADB.Db.QueryRow(countRawReadings, participantID, from, to).Scan(&paging.Total); err != nil {
+		return nil, paging, err
+	}
+	rows, err := database.ADB.Db.Query(selectVerifiedReadings, participantID, from, to, q.PageSize, q.offset())
+	if err != nil {
+		return nil, paging, err
+	}
+	defer rows.Close()
+
+	names := []string{"SBP Verified", "DBP Verified", "SBP Unverified", "DBP Unverified", "Pulse"}
+	charts := make([]SeriesChart, len(names))
+	for i, name := range names {
+		charts[i] = SeriesChart{Name: name, Series: []Series{}}
+	}
+	for rows.Next() {
+		var ms int64
+		var s, d, p int
+		var verified bool
+		if err := rows.Scan(&ms, &s, &d, &p, &verified); err != nil {
+			return nil, paging, err
+		}
+		name := CreatedAtTime(ms).In(q.Location).Format(time.RFC3339)
+		sbp, dbp := 0, 1
+		if !verified {
+			sbp, dbp = 2, 3
+		}
+		charts[sbp].Series = append(charts[sbp].Series, Series{Name: name, Value: s})
+		charts[dbp].Series = append(charts[dbp].Series, Series{Name: name, Value: d})
+		charts[4].Series = append(charts[4].Series, Series{Name: name, Value: p})
+	}
+	return charts, paging, rows.Err()
+}
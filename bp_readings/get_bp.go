@@ -11,8 +11,6 @@ import (
 	"time"
 
 	"github.com/cliffordlab/amoss_services/capacity"
-	"github.com/cliffordlab/amoss_services/database"
-	"github.com/cliffordlab/amoss_services/participant"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 )
@@ -23,6 +21,8 @@ const (
 	errorResJSON             = `{"error":"json parsing error","error description":"key or value of json is formatted incorrectly"}`
 	errorInvalidIDOrPassword = `{"error":"invalid participant ID or password"}`
 	noSuchUserErr            = `{"error":"invalid participant id or password"}`
+	queryFailedErr           = `{"error":"unable to query readings"}`
+	noParticipantErr         = `{"error":"no such participant"}`
 )
 
 type QueryHandler struct {
@@ -48,6 +48,7 @@ type SeriesChart struct {
 
 type VitalsAndSymptomsSeries struct {
 	Series []SeriesChart `json:"data"`
+	Paging *Paging       `json:"paging,omitempty"`
 }
 
 func (QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -88,216 +89,67 @@ func (QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var currentParticipant participant.Participant
-	if claims, ok := token.Claims.(*capacity.NonAdminClaims); ok && token.Valid {
-		currentParticipant.Study = claims.Study
-		currentParticipant.ID = claims.ID
-	} else {
+	if _, ok := token.Claims.(*capacity.NonAdminClaims); !ok || !token.Valid {
 		log.Println("token not valid")
 		http.Error(w, "Invalid token type", http.StatusUnauthorized)
 		return
 	}
 
+	loc := ParticipantLocation(pidInt64)
+	var body Body
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(errorResJSON))
+			return
+		}
+	}
+	query, err := ParseChartQuery(r.URL.Query(), body, loc)
+	if err != nil {
+		errorJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(errorJSON)
+		return
+	}
+
 	log.Println("Querying database...")
 
-	vitalsData, done := getVitalsData(w, err, pidInt64)
-	if done {
+	vitalsData, paging, err := VitalsChart(pidInt64, query)
+	if err != nil {
+		log.Println("failed to retrieve blood pressure data")
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(queryFailedErr))
 		return
 	}
-	symptomsData, done := getSymptomsData(w, err, pidInt64)
-	if done {
+	symptomsData, err := SymptomsChart(pidInt64, query)
+	if err != nil {
+		log.Println("failed to retrieve symptoms data")
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(queryFailedErr))
 		return
 	}
 
 	var symptomsSeriesChart []VitalsAndSymptomsSeries
-	symptomsSeriesChart = append(symptomsSeriesChart, VitalsAndSymptomsSeries{vitalsData})
-	symptomsSeriesChart = append(symptomsSeriesChart, VitalsAndSymptomsSeries{symptomsData})
+	symptomsSeriesChart = append(symptomsSeriesChart, VitalsAndSymptomsSeries{Series: vitalsData, Paging: &paging})
+	symptomsSeriesChart = append(symptomsSeriesChart, VitalsAndSymptomsSeries{Series: symptomsData})
 
 	jsonObject, _ := json.MarshalIndent(symptomsSeriesChart, "", "    ")
-	log.Println(string(jsonObject))
 	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
 	w.Write(jsonObject)
 }
 
-func getSymptomsData(w http.ResponseWriter, err error, pidInt64 int64) ([]SeriesChart, bool) {
-	querySymptoms := "SELECT created_at, blurried_vision, headache, difficulty_breathing, side_pain FROM mme_symptoms WHERE participant_id = $1"
-	rows, err := database.ADB.Db.Query(querySymptoms, pidInt64)
-	if err != nil {
-		log.Println("failed to retrieve blood pressure data")
-		log.Fatalln(err)
-		return nil, false
-	}
-
-	// Vital Data
-	var id []byte
-	var bv []byte
-	var ha []byte
-	var db []byte
-	var sp []byte
-	var createdAt []byte
-	var seriesArray []Series
-	var symptomsSeriesChart []SeriesChart
-	bvTotalTrue := 0
-	bvTotalFalse := 0
-	hATotalTrue := 0
-	hATotalFalse := 0
-	dBTotalTrue := 0
-	dBTotalFalse := 0
-	sPTotalTrue := 0
-	sPTotalFalse := 0
-
-	for rows.Next() {
-		err = rows.Scan(&id, &bv, &ha, &db, &sp)
-		createdAtInt, _ := strconv.ParseInt("1"+string(createdAt), 10, 64)
-		log.Println("this is the createdAt: " + string(createdAt))
-		log.Println("this is the createdAtInt: " + strconv.FormatInt(createdAtInt, 10))
-		tm := time.Unix(0, createdAtInt*int64(time.Millisecond))
-		log.Println("this is the tm: " + tm.String())
-		dateTimeFormatted := tm.Format("01/02/2006 3:04 PM")
-		log.Println("this is the dateTimeFormatted: " + dateTimeFormatted)
-
-		if err != nil {
-			log.Println("failed to scan row for bp data")
-			log.Println(err)
-			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
-			w.Write([]byte(noSuchUserErr))
-			return nil, true
-		}
-
-		bvBool := string(bv)
-		haBool := string(ha)
-		dbBool := string(db)
-		spBool := string(sp)
-
-		switch bvBool {
-		case "true":
-			bvTotalTrue++
-		case "false":
-			bvTotalFalse++
-		default:
-		}
-
-		switch haBool {
-		case "true":
-			hATotalTrue++
-		case "false":
-			hATotalFalse++
-		default:
-		}
-
-		switch dbBool {
-		case "true":
-			dBTotalTrue++
-		case "false":
-			dBTotalFalse++
-		default:
-		}
-
-		switch spBool {
-		case "true":
-			sPTotalTrue++
-		case "false":
-			sPTotalFalse++
-		default:
-		}
-	}
-
-	seriesArray = append(seriesArray, Series{
-		Name: "Blurried Vision", Value: bvTotalTrue,
-	})
-	seriesArray = append(seriesArray, Series{
-		Name: "Blurried Vision False", Value: bvTotalFalse,
-	})
-	seriesArray = append(seriesArray, Series{
-		Name: "Headache", Value: hATotalTrue,
-	})
-	seriesArray = append(seriesArray, Series{
-		Name: "Headache False", Value: hATotalFalse,
-	})
-	seriesArray = append(seriesArray, Series{
-		Name: "Difficulty Breathing", Value: dBTotalTrue,
-	})
-	seriesArray = append(seriesArray, Series{
-		Name: "Difficulty Breathing False", Value: dBTotalFalse,
-	})
-	seriesArray = append(seriesArray, Series{
-		Name: "Side Pain", Value: sPTotalTrue,
-	})
-	seriesArray = append(seriesArray, Series{
-		Name: "Side Pain False", Value: sPTotalFalse,
-	})
-	symptomsSeriesChart = append(symptomsSeriesChart, SeriesChart{
-		Name:   "Symptoms",
-		Series: seriesArray,
-	})
-	return symptomsSeriesChart, false
-}
-
-func getVitalsData(w http.ResponseWriter, err error, pidInt64 int64) ([]SeriesChart, bool) {
-	queryVitals := "SELECT created_at, participant_id, systolic_bp, diastolic_bp, pulse, is_verified FROM bp_readings WHERE participant_id = $1 ORDER BY created_at ASC "
-
-	rows, err := database.ADB.Db.Query(queryVitals, pidInt64)
-	if err != nil {
-		log.Println("failed to retrieve blood pressure data")
-		log.Fatalln(err)
-		return nil, true
+// CreatedAtTime converts a created_at value from bp_readings or mme_symptoms
+// to a time. The apps send unix millis with the leading "1" dropped (12 digits),
+// so values below 1e12 get it added back.
+func CreatedAtTime(createdAt int64) time.Time {
+	if createdAt < 1000000000000 {
+		createdAt += 1000000000000
 	}
-
-	// Vital Data
-	var id []byte
-	var sbp []byte
-	var dbp []byte
-	var pulse []byte
-	var createdAt []byte
-	var sbpArray []Series
-	var dbpArray []Series
-	var pulseArray []Series
-	var isVerified bool
-	var bpData []SeriesChart
-
-	for rows.Next() {
-		err = rows.Scan(&createdAt, &id, &sbp, &dbp, &pulse, &isVerified)
-		createdAtInt, _ := strconv.ParseInt("1"+string(createdAt), 10, 64)
-		log.Println("this is the createdAt: " + string(createdAt))
-		log.Println("this is the createdAtInt: " + strconv.FormatInt(createdAtInt, 10))
-		tm := time.Unix(0, createdAtInt*int64(time.Millisecond))
-		log.Println("this is the tm: " + tm.String())
-		dateTimeFormatted := tm.Format("01/02/2006 3:04 PM")
-		log.Println("this is the dateTimeFormatted: " + dateTimeFormatted)
-
-		dbpInt, _ := strconv.Atoi(string(dbp))
-		sbpInt, _ := strconv.Atoi(string(sbp))
-		pulseInt, _ := strconv.Atoi(string(pulse))
-
-		sbpArray = append(sbpArray, Series{
-			Name: dateTimeFormatted, Value: sbpInt,
-		})
-		dbpArray = append(dbpArray, Series{
-			Name: dateTimeFormatted, Value: dbpInt,
-		})
-		pulseArray = append(pulseArray, Series{
-			Name: dateTimeFormatted, Value: pulseInt,
-		})
-
-		if err != nil {
-			log.Println("failed to scan row for bp data")
-			log.Println(err)
-			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
-			w.Write([]byte(noSuchUserErr))
-			return nil, true
-		}
-	}
-	bpData = append(bpData, SeriesChart{
-		Name:   "SBP",
-		Series: sbpArray,
-	})
-	bpData = append(bpData, SeriesChart{
-		Name:   "DBP",
-		Series: dbpArray,
-	})
-	bpData = append(bpData, SeriesChart{
-		Name:   "Pulse",
-		Series: pulseArray,
-	})
-	return bpData, false
+	return time.Unix(0, createdAt*int64(time.Millisecond)).UTC()
 }
@@ -0,0 +1,79 @@
+package bp_readings
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/gorilla/mux"
+)
+
+// SummaryHandler blood pressure categories and trends of the patients at the
+// coordinator's sites.
+// GET /bp/summary for the cohort or /participants/{participant_id}/bp/summary,
+// both with optional from and to.
+type SummaryHandler struct {
+	Name string
+}
+
+func (h SummaryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	var participantID int64
+	loc := time.UTC
+	if v, ok := mux.Vars(r)["participant_id"]; ok {
+		if participantID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid participant id", http.StatusBadRequest)
+			return
+		}
+		visible, err := sites.Visible(claims.Study, claims.ID, participantID)
+		if err != nil {
+			log.Println(err)
+		}
+		if !visible {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(noParticipantErr))
+			return
+		}
+		loc = ParticipantLocation(participantID)
+	}
+	query, err := ParseChartQuery(r.URL.Query(), Body{}, loc)
+	if err != nil {
+		errorJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(errorJSON)
+		return
+	}
+
+	cohort, err := Summarize(claims.Study, claims.ID, participantID, query, time.Now().UTC())
+	if err != nil {
+		log.Println("failed to summarize blood pressure readings")
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(queryFailedErr))
+		return
+	}
+
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.Header().Add("Content-Type", "application/json; charset=UTF-8")
+	var jsonObject []byte
+	if participantID == 0 {
+		jsonObject, _ = json.Marshal(cohort)
+	} else if len(cohort.Summaries) == 1 {
+		jsonObject, _ = json.Marshal(cohort.Summaries[0])
+	} else {
+		// no readings in the range
+		jsonObject, _ = json.Marshal(ParticipantSummary{ParticipantID: participantID, Timezone: loc.String(), Weeks: []WeekMean{}})
+	}
+	w.Write(jsonObject)
+}
@@ -0,0 +1,138 @@
+package bp_readings
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	// elevated blood pressure as in the default mild_bp_repeat alert rule
+	elevatedSBP = 140
+	elevatedDBP = 90
+
+	selectSymptomsInRange = `SELECT r.ms, r.blurried_vision, r.headache, r.difficulty_breathing, r.side_pain FROM
+(SELECT CASE WHEN created_at < 1000000000000 THEN created_at + 1000000000000 ELSE created_at END AS ms,
+blurried_vision, headache, difficulty_breathing, side_pain FROM mme_symptoms WHERE participant_id = $1) r
+WHERE r.ms >= $2 AND r.ms < $3 ORDER BY r.ms`
+	selectElevatedInRange = `SELECT r.ms FROM ` + readingsInRange + ` AND (r.systolic_bp >= $4 OR r.diastolic_bp >= $5) ORDER BY r.ms`
+)
+
+// names of the symptoms chart series
+const (
+	SeriesBlurriedVision      = "Blurried Vision"
+	SeriesHeadache            = "Headache"
+	SeriesDifficultyBreathing = "Difficulty Breathing"
+	SeriesSidePain            = "Side Pain"
+	SeriesSymptomReports      = "Symptom Reports"
+	SeriesElevatedBP          = "Elevated BP"
+	SeriesSymptomsWithBP      = "Symptoms With Elevated BP"
+)
+
+// symptomDay counts of one day in the participant's time zone
+type symptomDay struct {
+	blurriedVision      int
+	headache            int
+	difficultyBreathing int
+	sidePain            int
+	reports             int
+	elevated            int
+	withSymptoms        int
+}
+
+// SymptomsChart per day series of a participant's symptoms for the requested
+// range. Every series has a point for each day with a symptoms report or an
+// elevated reading, so they line up with each other and the BP chart.
+// Symptoms With Elevated BP counts the reports with at least one symptom on
+// days that also had an elevated reading.
+func SymptomsChart(participantID int64, q ChartQuery) ([]SeriesChart, error) {
+	from, to := q.bounds()
+	days := map[time.Time]*symptomDay{}
+	day := func(ms int64) *symptomDay {
+		t := CreatedAtTime(ms).In(q.Location)
+		key := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, q.Location)
+		if days[key] == nil {
+			days[key] = &symptomDay{}
+		}
+		return days[key]
+	}
+
+	rows, err := database.ADB.Db.Query(selectElevatedInRange, participantID, from, to, elevatedSBP, elevatedDBP)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ms int64
+		if err := rows.Scan(&ms); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		day(ms).elevated++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = database.ADB.Db.Query(selectSymptomsInRange, participantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var withSymptoms []int64
+	for rows.Next() {
+		var ms int64
+		var bv, ha, db, sp bool
+		if err := rows.Scan(&ms, &bv, &ha, &db, &sp); err != nil {
+			return nil, err
+		}
+		d := day(ms)
+		d.reports++
+		d.blurriedVision += count(bv)
+		d.headache += count(ha)
+		d.difficultyBreathing += count(db)
+		d.sidePain += count(sp)
+		if bv || ha || db || sp {
+			withSymptoms = append(withSymptoms, ms)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// elevated readings are all counted before reports are matched against them
+	for _, ms := range withSymptoms {
+		if d := day(ms); d.elevated > 0 {
+			d.withSymptoms++
+		}
+	}
+
+	var keys []time.Time
+	for key := range days {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Before(keys[j]) })
+
+	names := []string{SeriesBlurriedVision, SeriesHeadache, SeriesDifficultyBreathing, SeriesSidePain,
+		SeriesSymptomReports, SeriesElevatedBP, SeriesSymptomsWithBP}
+	charts := make([]SeriesChart, len(names))
+	for i, name := range names {
+		charts[i] = SeriesChart{Name: name, Series: []Series{}}
+	}
+	for _, key := range keys {
+		d := days[key]
+		name := key.Format(time.RFC3339)
+		values := []int{d.blurriedVision, d.headache, d.difficultyBreathing, d.sidePain, d.reports, d.elevated, d.withSymptoms}
+		for i, value := range values {
+			charts[i].Series = append(charts[i].Series, Series{Name: name, Value: value})
+		}
+	}
+	return charts, nil
+}
+
+func count(present bool) int {
+	if present {
+		return 1
+	}
+	return 0
+}
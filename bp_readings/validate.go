@@ -0,0 +1,141 @@
+package bp_readings
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+// reasons a reading is stored flagged
+const (
+	FlagLowSBP              = "low_sbp"
+	FlagHighSBP             = "high_sbp"
+	FlagLowDBP              = "low_dbp"
+	FlagHighDBP             = "high_dbp"
+	FlagLowPulse            = "low_pulse"
+	FlagHighPulse           = "high_pulse"
+	FlagNarrowPulsePressure = "narrow_pulse_pressure"
+)
+
+const (
+	// clocks of the phones run a little ahead of the server
+	maxClockSkew = 5 * time.Minute
+
+	selectEnrolledAt = `SELECT enrolled_at FROM participants WHERE participant_id = $1`
+)
+
+// physiologic limits, values outside are rejected
+var (
+	sbpLimits   = limits{min: 50, max: 300}
+	dbpLimits   = limits{min: 20, max: 200}
+	pulseLimits = limits{min: 20, max: 250}
+)
+
+// plausible ranges, values outside are possible but stored flagged
+var (
+	sbpPlausible   = limits{min: 70, max: 220}
+	dbpPlausible   = limits{min: 40, max: 140}
+	pulsePlausible = limits{min: 40, max: 180}
+)
+
+const minPulsePressure = 15
+
+type limits struct {
+	min, max int
+}
+
+// FieldError why one field of submitted vitals was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// SubmittedVitals a reading as the app submitted it
+type SubmittedVitals struct {
+	SBP       int
+	DBP       int
+	Pulse     int
+	CreatedAt int64
+}
+
+// ValidateVitals parses and checks the sbp, dbp, pulse and created_at fields
+// of an upload. Any field error rejects the reading. Flags are the reasons an
+// accepted reading is implausible. enrolledAt is nil when unknown.
+func ValidateVitals(form url.Values, enrolledAt *time.Time, now time.Time) (SubmittedVitals, []string, []FieldError) {
+	var v SubmittedVitals
+	var errs []FieldError
+	var flags []string
+
+	parseInt := func(field string) (int64, bool) {
+		raw := strings.TrimSpace(form.Get(field))
+		if raw == "" {
+			errs = append(errs, FieldError{Field: field, Message: "is required"})
+			return 0, false
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			errs = append(errs, FieldError{Field: field, Message: "must be a whole number"})
+			return 0, false
+		}
+		return n, true
+	}
+	checkRange := func(field string, value int64, hard limits, plausible limits, low string, high string) bool {
+		if value < int64(hard.min) || value > int64(hard.max) {
+			errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("must be between %d and %d", hard.min, hard.max)})
+			return false
+		}
+		if value < int64(plausible.min) {
+			flags = append(flags, low)
+		}
+		if value > int64(plausible.max) {
+			flags = append(flags, high)
+		}
+		return true
+	}
+
+	sbp, sbpOK := parseInt("sbp")
+	if sbpOK {
+		sbpOK = checkRange("sbp", sbp, sbpLimits, sbpPlausible, FlagLowSBP, FlagHighSBP)
+	}
+	dbp, dbpOK := parseInt("dbp")
+	if dbpOK {
+		dbpOK = checkRange("dbp", dbp, dbpLimits, dbpPlausible, FlagLowDBP, FlagHighDBP)
+	}
+	if pulse, ok := parseInt("pulse"); ok && checkRange("pulse", pulse, pulseLimits, pulsePlausible, FlagLowPulse, FlagHighPulse) {
+		v.Pulse = int(pulse)
+	}
+	if sbpOK && dbpOK {
+		if sbp <= dbp {
+			errs = append(errs, FieldError{Field: "sbp", Message: "must be higher than dbp"})
+		} else if sbp-dbp < minPulsePressure {
+			flags = append(flags, FlagNarrowPulsePressure)
+		}
+		v.SBP, v.DBP = int(sbp), int(dbp)
+	}
+
+	if createdAt, ok := parseInt("created_at"); ok {
+		taken := CreatedAtTime(createdAt)
+		switch {
+		case createdAt <= 0:
+			errs = append(errs, FieldError{Field: "created_at", Message: "must be unix milliseconds"})
+		case taken.After(now.Add(maxClockSkew)):
+			errs = append(errs, FieldError{Field: "created_at", Message: "is in the future"})
+		case enrolledAt != nil && taken.Before(*enrolledAt):
+			errs = append(errs, FieldError{Field: "created_at", Message: "is before the participant was enrolled"})
+		default:
+			v.CreatedAt = createdAt
+		}
+	}
+	return v, flags, errs
+}
+
+// EnrolledAt when the participant was enrolled, nil when not recorded
+func EnrolledAt(participantID int64) (*time.Time, error) {
+	var enrolledAt *time.Time
+	err := database.ADB.Db.QueryRow(selectEnrolledAt, participantID).Scan(&enrolledAt)
+	return enrolledAt, err
+}
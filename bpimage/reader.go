@@ -0,0 +1,58 @@
+package bpimage
+
+import (
+	"errors"
+	"image"
+	"io"
+	"sync"
+
+	// decoders for the photos the apps upload
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// ErrUnreadable returned when no blood pressure could be read from the photo
+var ErrUnreadable = errors.New("no blood pressure found in the photo")
+
+// Proposal values read from a blood pressure monitor photo. Pulse is 0 when
+// the monitor shows none. Confidence is between 0 and 1.
+type Proposal struct {
+	Reader     string  `json:"reader"`
+	SBP        int     `json:"sbp"`
+	DBP        int     `json:"dbp"`
+	Pulse      int     `json:"pulse"`
+	Confidence float64 `json:"confidence"`
+}
+
+// BPImageReader proposes the values shown on a blood pressure monitor photo
+type BPImageReader interface {
+	Name() string
+	Read(img image.Image) (Proposal, error)
+}
+
+var (
+	readerMutex sync.RWMutex
+	reader      BPImageReader = SevenSegmentReader{}
+)
+
+// SetReader replaces the reader used for uploaded photos
+func SetReader(r BPImageReader) {
+	readerMutex.Lock()
+	defer readerMutex.Unlock()
+	reader = r
+}
+
+// Read decodes a photo and reads it with the current reader
+func Read(photo io.Reader) (Proposal, error) {
+	img, _, err := image.Decode(photo)
+	if err != nil {
+		return Proposal{}, err
+	}
+	readerMutex.RLock()
+	r := reader
+	readerMutex.RUnlock()
+
+	p, err := r.Read(img)
+	p.Reader = r.Name()
+	return p, err
+}
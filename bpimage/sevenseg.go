@@ -0,0 +1,389 @@
+package bpimage
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+const (
+	// photos are scaled down to this width before reading
+	workWidth = 480
+	// fill ratio above which a segment counts as lit
+	segmentOn = 0.3
+)
+
+// segments a to g as bits, clockwise from the top with g in the middle
+const (
+	segA = 1 << iota
+	segB
+	segC
+	segD
+	segE
+	segF
+	segG
+)
+
+// digitPatterns lit segments of each digit, with the variants monitors use
+// for 6, 7 and 9
+var digitPatterns = map[int]int{
+	segA | segB | segC | segD | segE | segF:        0,
+	segB | segC:                                    1,
+	segA | segB | segD | segE | segG:               2,
+	segA | segB | segC | segD | segG:               3,
+	segB | segC | segF | segG:                      4,
+	segA | segC | segD | segF | segG:               5,
+	segA | segC | segD | segE | segF | segG:        6,
+	segC | segD | segE | segF | segG:               6,
+	segA | segB | segC:                             7,
+	segA | segB | segC | segF:                      7,
+	segA | segB | segC | segD | segE | segF | segG: 8,
+	segA | segB | segC | segD | segF | segG:        9,
+	segA | segB | segC | segF | segG:               9,
+}
+
+// segmentRegions where each segment is sampled, as fractions of the digit box
+var segmentRegions = [7][4]float64{
+	{0.25, 0.00, 0.75, 0.15}, // a
+	{0.70, 0.15, 1.00, 0.45}, // b
+	{0.70, 0.55, 1.00, 0.85}, // c
+	{0.25, 0.85, 0.75, 1.00}, // d
+	{0.00, 0.55, 0.30, 0.85}, // e
+	{0.00, 0.15, 0.30, 0.45}, // f
+	{0.25, 0.42, 0.75, 0.58}, // g
+}
+
+// SevenSegmentReader reads the LCD digits of a blood pressure monitor on the
+// CPU. The photo is binarized, lit segments are merged into digit boxes,
+// each box is classified by sampling its seven segments and the rows of
+// digits are read top to bottom as systolic, diastolic and pulse.
+type SevenSegmentReader struct{}
+
+func (SevenSegmentReader) Name() string {
+	return "seven_segment"
+}
+
+type box struct {
+	x0, y0, x1, y1 int
+}
+
+func (b box) width() int  { return b.x1 - b.x0 + 1 }
+func (b box) height() int { return b.y1 - b.y0 + 1 }
+
+// binary image, true for foreground
+type binary struct {
+	w, h int
+	px   []bool
+}
+
+func (b binary) at(x int, y int) bool {
+	return b.px[y*b.w+x]
+}
+
+func (s SevenSegmentReader) Read(img image.Image) (Proposal, error) {
+	gray, w, h := grayscale(img, workWidth)
+	if w < 16 || h < 16 {
+		return Proposal{}, ErrUnreadable
+	}
+	fg := threshold(gray, w, h)
+	boxes := digitBoxes(fg)
+	rows := digitRows(boxes)
+
+	var numbers []int
+	var confidences []float64
+	for _, row := range rows {
+		if len(row) < 2 || len(row) > 3 {
+			continue
+		}
+		value, confidence, ok := readRow(fg, row)
+		if !ok {
+			continue
+		}
+		numbers = append(numbers, value)
+		confidences = append(confidences, confidence)
+		if len(numbers) == 3 {
+			break
+		}
+	}
+	if len(numbers) < 2 {
+		return Proposal{}, ErrUnreadable
+	}
+
+	p := Proposal{SBP: numbers[0], DBP: numbers[1]}
+	confidence := math.Min(confidences[0], confidences[1])
+	if len(numbers) == 3 {
+		p.Pulse = numbers[2]
+		confidence = math.Min(confidence, confidences[2])
+	}
+	// implausible readings are more likely misread than real
+	if p.SBP < 60 || p.SBP > 260 || p.DBP < 30 || p.DBP > 160 || p.SBP <= p.DBP {
+		confidence *= 0.5
+	}
+	if p.Pulse != 0 && (p.Pulse < 30 || p.Pulse > 220) {
+		confidence *= 0.5
+	}
+	p.Confidence = math.Round(confidence*100) / 100
+	return p, nil
+}
+
+// grayscale averages the photo down to at most maxWidth pixels wide
+func grayscale(img image.Image, maxWidth int) ([]float64, int, int) {
+	bounds := img.Bounds()
+	scale := int(math.Ceil(float64(bounds.Dx()) / float64(maxWidth)))
+	if scale < 1 {
+		scale = 1
+	}
+	w, h := bounds.Dx()/scale, bounds.Dy()/scale
+	gray := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum float64
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					c := color.GrayModel.Convert(img.At(bounds.Min.X+x*scale+dx, bounds.Min.Y+y*scale+dy)).(color.Gray)
+					sum += float64(c.Y)
+				}
+			}
+			gray[y*w+x] = sum / float64(scale*scale)
+		}
+	}
+	return gray, w, h
+}
+
+// threshold binarizes with Otsu's method. Digits are the minority class, so
+// light digits on a dark backlight work as well as dark digits on grey.
+func threshold(gray []float64, w int, h int) binary {
+	var histogram [256]int
+	for _, v := range gray {
+		histogram[int(v)]++
+	}
+	total := float64(len(gray))
+	var sum float64
+	for i, n := range histogram {
+		sum += float64(i * n)
+	}
+	var sumBelow, weightBelow, best float64
+	cut := 0
+	for i, n := range histogram {
+		weightBelow += float64(n)
+		if weightBelow == 0 || weightBelow == total {
+			continue
+		}
+		sumBelow += float64(i * n)
+		meanBelow := sumBelow / weightBelow
+		meanAbove := (sum - sumBelow) / (total - weightBelow)
+		between := weightBelow * (total - weightBelow) * (meanBelow - meanAbove) * (meanBelow - meanAbove)
+		if between > best {
+			best, cut = between, i
+		}
+	}
+
+	fg := binary{w: w, h: h, px: make([]bool, w*h)}
+	dark := 0
+	for i, v := range gray {
+		if int(v) <= cut {
+			fg.px[i] = true
+			dark++
+		}
+	}
+	if float64(dark) > total/2 {
+		for i := range fg.px {
+			fg.px[i] = !fg.px[i]
+		}
+	}
+	return fg
+}
+
+// digitBoxes dilates the segments so the segments of one digit touch, then
+// keeps the connected components shaped like a digit
+func digitBoxes(fg binary) []box {
+	rx, ry := fg.w/240+1, fg.w/120+1
+	dilated := binary{w: fg.w, h: fg.h, px: make([]bool, len(fg.px))}
+	for y := 0; y < fg.h; y++ {
+		for x := 0; x < fg.w; x++ {
+			if !fg.at(x, y) {
+				continue
+			}
+			for yy := max(0, y-ry); yy <= min(fg.h-1, y+ry); yy++ {
+				for xx := max(0, x-rx); xx <= min(fg.w-1, x+rx); xx++ {
+					dilated.px[yy*fg.w+xx] = true
+				}
+			}
+		}
+	}
+
+	var boxes []box
+	seen := make([]bool, len(dilated.px))
+	var stack []int
+	for start := range dilated.px {
+		if !dilated.px[start] || seen[start] {
+			continue
+		}
+		b := box{x0: fg.w, y0: fg.h, x1: -1, y1: -1}
+		seen[start] = true
+		stack = append(stack[:0], start)
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := i%fg.w, i/fg.w
+			b.x0, b.y0, b.x1, b.y1 = min(b.x0, x), min(b.y0, y), max(b.x1, x), max(b.y1, y)
+			for _, n := range [4]int{i - 1, i + 1, i - fg.w, i + fg.w} {
+				if n < 0 || n >= len(dilated.px) || seen[n] || !dilated.px[n] {
+					continue
+				}
+				// no wrapping around the left and right edges
+				if (n == i-1 && x == 0) || (n == i+1 && x == fg.w-1) {
+					continue
+				}
+				seen[n] = true
+				stack = append(stack, n)
+			}
+		}
+		// undo the dilation
+		b = box{x0: min(b.x0+rx, b.x1), y0: min(b.y0+ry, b.y1), x1: max(b.x1-rx, b.x0), y1: max(b.y1-ry, b.y0)}
+		if isDigitShaped(fg, b) {
+			boxes = append(boxes, b)
+		}
+	}
+	return boxes
+}
+
+func isDigitShaped(fg binary, b box) bool {
+	w, h := float64(b.width()), float64(b.height())
+	if h < float64(fg.h)/20 || h > float64(fg.h)*0.7 {
+		return false
+	}
+	aspect := w / h
+	if aspect < 0.08 || aspect > 1.0 {
+		return false
+	}
+	fill := fillRatio(fg, b.x0, b.y0, b.x1, b.y1)
+	// a 1 is just two segments stacked, its box is all segment
+	if aspect < 0.3 {
+		return fill > 0.5
+	}
+	return fill > 0.08 && fill < 0.85
+}
+
+func fillRatio(fg binary, x0 int, y0 int, x1 int, y1 int) float64 {
+	lit, total := 0, 0
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			total++
+			if fg.at(x, y) {
+				lit++
+			}
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(lit) / float64(total)
+}
+
+// digitRows groups boxes of similar height on the same line, top row first,
+// and splits a line where the gap is wider than a digit
+func digitRows(boxes []box) [][]box {
+	sort.Slice(boxes, func(i, j int) bool { return boxes[i].y0+boxes[i].y1 < boxes[j].y0+boxes[j].y1 })
+	var lines [][]box
+	for _, b := range boxes {
+		placed := false
+		for i, line := range lines {
+			ref := line[0]
+			overlap := min(b.y1, ref.y1) - max(b.y0, ref.y0)
+			ratio := float64(b.height()) / float64(ref.height())
+			if float64(overlap) >= 0.5*float64(min(b.height(), ref.height())) && ratio > 0.7 && ratio < 1.4 {
+				lines[i] = append(line, b)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			lines = append(lines, []box{b})
+		}
+	}
+
+	var rows [][]box
+	for _, line := range lines {
+		sort.Slice(line, func(i, j int) bool { return line[i].x0 < line[j].x0 })
+		row := []box{line[0]}
+		for _, b := range line[1:] {
+			last := row[len(row)-1]
+			if b.x0-last.x1 > last.height() {
+				rows = append(rows, row)
+				row = nil
+			}
+			row = append(row, b)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// readRow reads the number of a row of digit boxes
+func readRow(fg binary, row []box) (int, float64, bool) {
+	height := 0
+	for _, b := range row {
+		height = max(height, b.height())
+	}
+	value := 0
+	confidence := 1.0
+	for _, b := range row {
+		digit, c, ok := readDigit(fg, b, height)
+		if !ok {
+			return 0, 0, false
+		}
+		value = value*10 + digit
+		confidence = math.Min(confidence, c)
+	}
+	return value, confidence, true
+}
+
+// readDigit classifies one digit box. A 1 only lights the right segments so
+// its box is narrow, any other digit is matched on its lit segments.
+func readDigit(fg binary, b box, rowHeight int) (int, float64, bool) {
+	if float64(b.width())/float64(rowHeight) < 0.3 {
+		return 1, 0.9, true
+	}
+	pattern := 0
+	certainty := 1.0
+	for i, r := range segmentRegions {
+		x0 := b.x0 + int(r[0]*float64(b.width()-1))
+		y0 := b.y0 + int(r[1]*float64(b.height()-1))
+		x1 := b.x0 + int(r[2]*float64(b.width()-1))
+		y1 := b.y0 + int(r[3]*float64(b.height()-1))
+		fill := fillRatio(fg, x0, y0, x1, y1)
+		if fill > segmentOn {
+			pattern |= 1 << uint(i)
+		}
+		certainty = math.Min(certainty, math.Min(1, math.Abs(fill-segmentOn)/segmentOn))
+	}
+	if digit, ok := digitPatterns[pattern]; ok {
+		return digit, 0.5 + certainty/2, true
+	}
+	// one segment misread still identifies the digit, with less confidence,
+	// unless the pattern is one segment off from several digits
+	match := -1
+	for known, digit := range digitPatterns {
+		if bitCount(known^pattern) != 1 {
+			continue
+		}
+		if match >= 0 && match != digit {
+			return 0, 0, false
+		}
+		match = digit
+	}
+	if match < 0 {
+		return 0, 0, false
+	}
+	return match, (0.5 + certainty/2) / 2, true
+}
+
+func bitCount(v int) int {
+	n := 0
+	for ; v != 0; v &= v - 1 {
+		n++
+	}
+	return n
+}
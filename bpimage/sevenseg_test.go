@@ -0,0 +1,169 @@
+package bpimage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+// segment patterns of the digits as the monitors draw them
+var testDigits = [10]int{
+	segA | segB | segC | segD | segE | segF,
+	segB | segC,
+	segA | segB | segD | segE | segG,
+	segA | segB | segC | segD | segG,
+	segB | segC | segF | segG,
+	segA | segC | segD | segF | segG,
+	segA | segC | segD | segE | segF | segG,
+	segA | segB | segC,
+	segA | segB | segC | segD | segE | segF | segG,
+	segA | segB | segC | segD | segF | segG,
+}
+
+// drawSegments paints the lit segments of pattern black in a w by h digit
+// with its top left corner at x, y
+func drawSegments(img draw.Image, x int, y int, w int, h int, pattern int) {
+	t := w / 5
+	rects := [7]image.Rectangle{
+		image.Rect(x+t/2, y, x+w-t/2, y+t),               // a
+		image.Rect(x+w-t, y+t/2, x+w, y+h/2),             // b
+		image.Rect(x+w-t, y+h/2, x+w, y+h-t/2),           // c
+		image.Rect(x+t/2, y+h-t, x+w-t/2, y+h),           // d
+		image.Rect(x, y+h/2, x+t, y+h-t/2),               // e
+		image.Rect(x, y+t/2, x+t, y+h/2),                 // f
+		image.Rect(x+t/2, y+h/2-t/2, x+w-t/2, y+h/2+t/2), // g
+	}
+	for i, r := range rects {
+		if pattern&(1<<uint(i)) != 0 {
+			draw.Draw(img, r, image.NewUniform(color.Black), image.Point{}, draw.Src)
+		}
+	}
+}
+
+// digitImage binary image of one digit filling the whole image
+func digitImage(w int, h int, pattern int) binary {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	drawSegments(img, 0, 0, w, h, pattern)
+	fg := binary{w: w, h: h, px: make([]bool, w*h)}
+	for i, v := range img.Pix {
+		fg.px[i] = v < 128
+	}
+	return fg
+}
+
+func TestReadDigit(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern int
+		want    int
+		ok      bool
+		misread bool
+	}{
+		{name: "0", pattern: testDigits[0], want: 0, ok: true},
+		{name: "2", pattern: testDigits[2], want: 2, ok: true},
+		{name: "3", pattern: testDigits[3], want: 3, ok: true},
+		{name: "4", pattern: testDigits[4], want: 4, ok: true},
+		{name: "5", pattern: testDigits[5], want: 5, ok: true},
+		{name: "6", pattern: testDigits[6], want: 6, ok: true},
+		{name: "6 without top", pattern: segC | segD | segE | segF | segG, want: 6, ok: true},
+		{name: "7", pattern: testDigits[7], want: 7, ok: true},
+		{name: "7 with left top", pattern: segA | segB | segC | segF, want: 7, ok: true},
+		{name: "8", pattern: testDigits[8], want: 8, ok: true},
+		{name: "9", pattern: testDigits[9], want: 9, ok: true},
+		{name: "9 without bottom", pattern: segA | segB | segC | segF | segG, want: 9, ok: true},
+		{name: "2 missing middle is only near 2", pattern: segA | segB | segD | segE, want: 2, ok: true, misread: true},
+		{name: "9 missing middle is near 0 and 9", pattern: segA | segB | segC | segD | segF, ok: false},
+		{name: "4 missing middle is near 1, 4 and 7", pattern: segB | segC | segF, ok: false},
+		{name: "top and bottom only", pattern: segA | segD, ok: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fg := digitImage(40, 70, tc.pattern)
+			// the same misread has to give the same answer every time
+			for i := 0; i < 20; i++ {
+				digit, confidence, ok := readDigit(fg, box{0, 0, 39, 69}, 70)
+				if ok != tc.ok {
+					t.Fatalf("ok = %v, want %v", ok, tc.ok)
+				}
+				if !ok {
+					continue
+				}
+				if digit != tc.want {
+					t.Fatalf("digit = %d, want %d", digit, tc.want)
+				}
+				if tc.misread && confidence > 0.5 {
+					t.Fatalf("confidence = %.2f, want at most 0.5 for a misread segment", confidence)
+				}
+				if !tc.misread && confidence < 0.5 {
+					t.Fatalf("confidence = %.2f, want at least 0.5", confidence)
+				}
+			}
+		})
+	}
+}
+
+func TestReadDigitNarrowBoxIsOne(t *testing.T) {
+	fg := digitImage(40, 70, testDigits[1])
+	digit, _, ok := readDigit(fg, box{32, 4, 39, 65}, 70)
+	if !ok || digit != 1 {
+		t.Fatalf("readDigit = %d, %v, want 1, true", digit, ok)
+	}
+}
+
+// monitorPhoto png of a monitor showing one number per row
+func monitorPhoto(t *testing.T, rows ...string) []byte {
+	const w, h, gap, top = 40, 70, 14, 30
+	img := image.NewGray(image.Rect(0, 0, 320, top+len(rows)*(h+top)))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	for r, number := range rows {
+		x := 40
+		for _, c := range number {
+			drawSegments(img, x, top+r*(h+top), w, h, testDigits[c-'0'])
+			x += w + gap
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name string
+		rows []string
+		want Proposal
+	}{
+		{name: "with pulse", rows: []string{"120", "80", "72"}, want: Proposal{SBP: 120, DBP: 80, Pulse: 72}},
+		{name: "without pulse", rows: []string{"145", "95"}, want: Proposal{SBP: 145, DBP: 95}},
+		{name: "severe", rows: []string{"168", "113", "90"}, want: Proposal{SBP: 168, DBP: 113, Pulse: 90}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := Read(bytes.NewReader(monitorPhoto(t, tc.rows...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.SBP != tc.want.SBP || p.DBP != tc.want.DBP || p.Pulse != tc.want.Pulse {
+				t.Fatalf("read %d/%d pulse %d, want %d/%d pulse %d", p.SBP, p.DBP, p.Pulse, tc.want.SBP, tc.want.DBP, tc.want.Pulse)
+			}
+			if p.Reader != "seven_segment" {
+				t.Fatalf("reader = %q", p.Reader)
+			}
+			if p.Confidence < 0.5 || p.Confidence > 1 {
+				t.Fatalf("confidence = %.2f, want between 0.5 and 1", p.Confidence)
+			}
+		})
+	}
+}
+
+func TestReadBlankPhoto(t *testing.T) {
+	if _, err := Read(bytes.NewReader(monitorPhoto(t))); err != ErrUnreadable {
+		t.Fatalf("err = %v, want ErrUnreadable", err)
+	}
+}
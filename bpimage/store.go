@@ -0,0 +1,27 @@
+package bpimage
+
+import (
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	upsertProposal = `INSERT INTO bp_image_readings (participant_id, created_at, reader, systolic_bp, diastolic_bp, pulse, confidence, error)
+VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), $7, '')
+ON CONFLICT (participant_id, created_at) DO UPDATE SET reader = EXCLUDED.reader, systolic_bp = EXCLUDED.systolic_bp,
+diastolic_bp = EXCLUDED.diastolic_bp, pulse = EXCLUDED.pulse, confidence = EXCLUDED.confidence, error = '', read_at = now()`
+	upsertUnreadable = `INSERT INTO bp_image_readings (participant_id, created_at, reader, error) VALUES ($1, $2, $3, $4)
+ON CONFLICT (participant_id, created_at) DO UPDATE SET reader = EXCLUDED.reader, systolic_bp = NULL, diastolic_bp = NULL,
+pulse = NULL, confidence = 0, error = EXCLUDED.error, read_at = now()`
+)
+
+// SaveProposal stores what was read from the photo of a reading
+func SaveProposal(participantID int64, createdAt int64, p Proposal) error {
+	_, err := database.ADB.Db.Exec(upsertProposal, participantID, createdAt, p.Reader, p.SBP, p.DBP, p.Pulse, p.Confidence)
+	return err
+}
+
+// SaveUnreadable records that the reader found nothing in the photo of a reading
+func SaveUnreadable(participantID int64, createdAt int64, reader string, readErr error) error {
+	_, err := database.ADB.Db.Exec(upsertUnreadable, participantID, createdAt, reader, readErr.Error())
+	return err
+}
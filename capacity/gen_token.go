@@ -2,6 +2,7 @@ package capacity
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -29,21 +30,38 @@ type NonAdminClaims struct {
 	jwt.StandardClaims
 }
 
+const defaultTokenLifetime = time.Hour * 24 * 365
+
+var (
+	tokenPolicyMutex sync.RWMutex
+	tokenPolicy      func(study string) time.Duration
+)
+
+//SetTokenPolicy sets how long the tokens of each study are valid, set by main
+//from the study registry. Without a policy tokens are valid for a year.
+func SetTokenPolicy(policy func(study string) time.Duration) {
+	tokenPolicyMutex.Lock()
+	defer tokenPolicyMutex.Unlock()
+	tokenPolicy = policy
+}
+
+func tokenLifetime(study string) time.Duration {
+	tokenPolicyMutex.RLock()
+	policy := tokenPolicy
+	tokenPolicyMutex.RUnlock()
+	if policy == nil || study == "" {
+		return defaultTokenLifetime
+	}
+	return policy(study)
+}
+
 //CreateAccessToken for participants
 func CreateAccessToken(capacity string, study string, ptID int64) string {
 	//get signing key and expiration for token to apply to claims of jwt token
 	signingKey := []byte(JwtSecret)
-	var expireToken int64
-	// Some studies need a longer expiration date. Default is 1 year.
-	if study == "cfd-sleep-study-test" || study == "cfd-classroom-audio" || study == "cfd-sleep-study" {
-		// Valid token 3 years
-		fmt.Println("Token valid: 3 years")
-		expireToken = time.Now().Add(time.Hour * 24 * 365 * 3).Unix()
-	} else {
-		// Default valid token is 1 year
-		fmt.Println("Token valid: 1 year")
-		expireToken = time.Now().Add(time.Hour * 24 * 365).Unix()
-	}
+	expiration := tokenLifetime(study)
+	fmt.Printf("Token valid: %s\n", expiration)
+	expireToken := time.Now().Add(expiration).Unix()
 
 	fmt.Printf("creating access token with %s capacity\n", capacity)
 
@@ -0,0 +1,39 @@
+package capacity
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// ErrInvalidToken returned when the authorization header cannot be trusted
+var ErrInvalidToken = errors.New("invalid token type")
+
+// ClaimsFromHeader validates the Authorization header of the request against
+// the expected token type ("Mars" for the mobile apps, "Bearer" for the portal)
+// and returns the non admin claims of the token
+func ClaimsFromHeader(r *http.Request, tokenType string) (*NonAdminClaims, string, error) {
+	splitHeaderValue := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(splitHeaderValue) != 2 || splitHeaderValue[0] != tokenType {
+		return nil, "", ErrInvalidToken
+	}
+	tokenString := splitHeaderValue[1]
+	token, err := jwt.ParseWithClaims(tokenString, &NonAdminClaims{}, func(token *jwt.Token) (interface{}, error) {
+		// Make sure token's signature wasn't changed
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected siging method")
+		}
+		return []byte(JwtSecret), nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	claims, ok := token.Claims.(*NonAdminClaims)
+	if !ok || !token.Valid {
+		return nil, "", ErrInvalidToken
+	}
+	return claims, tokenString, nil
+}
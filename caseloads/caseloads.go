@@ -0,0 +1,329 @@
+package caseloads
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/adherence"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/sites"
+)
+
+const (
+	selectCapacity   = `SELECT capacity_id FROM participants WHERE participant_id = $1 AND study_id = $2`
+	selectCurrent    = `SELECT coordinator_id FROM caseload_assignments WHERE participant_id = $1 FOR UPDATE`
+	upsertAssignment = `INSERT INTO caseload_assignments (participant_id, study_id, coordinator_id, assigned_by)
+VALUES ($1, $2, $3, $4) ON CONFLICT (participant_id) DO UPDATE
+SET study_id = EXCLUDED.study_id, coordinator_id = EXCLUDED.coordinator_id, assigned_by = EXCLUDED.assigned_by, assigned_at = now()`
+	deleteAssignment = `DELETE FROM caseload_assignments WHERE participant_id = $1`
+	insertEvent      = `INSERT INTO caseload_events (participant_id, study_id, coordinator_id, previous_coordinator_id, actor_id)
+VALUES ($1, $2, $3, $4, $5)`
+	selectAssignment = `SELECT coordinator_id, assigned_by, assigned_at FROM caseload_assignments WHERE participant_id = $1 AND study_id = $2`
+	selectEvents     = `SELECT coordinator_id, previous_coordinator_id, actor_id, created_at FROM caseload_events
+WHERE participant_id = $1 AND study_id = $2 ORDER BY created_at`
+
+	// outstanding work per participant
+	withTasks = `WITH unverified AS (SELECT participant_id, count(*) AS n FROM bp_readings WHERE is_verified = FALSE GROUP BY participant_id),
+open_alerts AS (SELECT participant_id, count(*) AS n FROM alerts WHERE status = 'open' GROUP BY participant_id)
+`
+	selectCaseload = withTasks + `SELECT a.participant_id, COALESCE(p.site_id, ''), a.assigned_at, COALESCE(u.n, 0), COALESCE(o.n, 0)
+FROM caseload_assignments a JOIN participants p ON p.participant_id = a.participant_id
+LEFT JOIN unverified u ON u.participant_id = a.participant_id
+LEFT JOIN open_alerts o ON o.participant_id = a.participant_id
+WHERE a.study_id = $1 AND a.coordinator_id = $2 ORDER BY a.participant_id`
+	selectWorkloads = withTasks + `SELECT c.participant_id, count(a.participant_id), COALESCE(sum(u.n), 0), COALESCE(sum(o.n), 0)
+FROM participants c LEFT JOIN (caseload_assignments a JOIN participants p ON p.participant_id = a.participant_id
+AND p.lifecycle_state IN ('enrollment', 'active')) ON a.coordinator_id = c.participant_id AND a.study_id = c.study_id
+LEFT JOIN unverified u ON u.participant_id = a.participant_id
+LEFT JOIN open_alerts o ON o.participant_id = a.participant_id
+WHERE c.study_id = $1 AND c.capacity_id = 'coordinator' GROUP BY c.participant_id ORDER BY c.participant_id`
+	selectUnassigned = `SELECT p.participant_id FROM participants p
+LEFT JOIN caseload_assignments a ON a.participant_id = p.participant_id
+WHERE p.study_id = $1 AND p.capacity_id = 'patient' AND p.lifecycle_state IN ('enrollment', 'active')
+AND a.participant_id IS NULL ORDER BY p.participant_id`
+)
+
+var (
+	// ErrNoParticipant returned for a participant that is not a patient of the study
+	ErrNoParticipant = errors.New("no such participant")
+	// ErrNoCoordinator returned for a coordinator that is not a coordinator of the study
+	ErrNoCoordinator = errors.New("no such coordinator")
+	// ErrOutOfScope returned when the coordinator is scoped to sites the participant is not at
+	ErrOutOfScope = errors.New("participant is not at the coordinator's sites")
+)
+
+// Event one assignment change of a participant
+type Event struct {
+	CoordinatorID         *int64    `json:"coordinatorID"`
+	PreviousCoordinatorID *int64    `json:"previousCoordinatorID"`
+	ActorID               int64     `json:"actorID"`
+	CreatedAt             time.Time `json:"createdAt"`
+}
+
+// Assignment current coordinator of a participant with the history of its
+// assignments. CoordinatorID is nil for unassigned participants.
+type Assignment struct {
+	ParticipantID int64      `json:"participantID"`
+	CoordinatorID *int64     `json:"coordinatorID"`
+	AssignedBy    *int64     `json:"assignedBy"`
+	AssignedAt    *time.Time `json:"assignedAt"`
+	Events        []Event    `json:"events"`
+}
+
+// Missing data type a participant is behind on this week. Expected is the
+// part of the weekly expectation due by now.
+type Missing struct {
+	DataType string `json:"dataType"`
+	Expected int    `json:"expected"`
+	Received int    `json:"received"`
+}
+
+// Entry one participant of a caseload with its outstanding tasks
+type Entry struct {
+	ParticipantID     int64      `json:"participantID"`
+	Site              string     `json:"site"`
+	AssignedAt        time.Time  `json:"assignedAt"`
+	UnverifiedUploads int        `json:"unverifiedUploads"`
+	OpenAlerts        int        `json:"openAlerts"`
+	LastUpload        *time.Time `json:"lastUpload"`
+	Silent            bool       `json:"silent"`
+	MissingData       []Missing  `json:"missingData"`
+}
+
+// Workload caseload size and outstanding tasks of one coordinator
+type Workload struct {
+	CoordinatorID     int64    `json:"coordinatorID"`
+	Sites             []string `json:"sites"`
+	Participants      int      `json:"participants"`
+	UnverifiedUploads int      `json:"unverifiedUploads"`
+	OpenAlerts        int      `json:"openAlerts"`
+}
+
+// Workloads caseloads of every coordinator of a study and the participants
+// nobody is assigned to
+type Workloads struct {
+	Study        string     `json:"study"`
+	Coordinators []Workload `json:"coordinators"`
+	Unassigned   []int64    `json:"unassigned"`
+}
+
+// Assign assigns the participant to the coordinator, replacing the previous
+// coordinator. The coordinator has to see the participant's site.
+func Assign(study string, participantID int64, coordinatorID int64, actorID int64) error {
+	if err := checkCapacity(study, participantID, "patient", ErrNoParticipant); err != nil {
+		return err
+	}
+	if err := checkCapacity(study, coordinatorID, "coordinator", ErrNoCoordinator); err != nil {
+		return err
+	}
+	visible, err := sites.Visible(study, coordinatorID, participantID)
+	if err != nil {
+		return err
+	}
+	if !visible {
+		return ErrOutOfScope
+	}
+	return change(study, participantID, &coordinatorID, actorID)
+}
+
+// Unassign removes the participant from its coordinator's caseload
+func Unassign(study string, participantID int64, actorID int64) error {
+	if err := checkCapacity(study, participantID, "patient", ErrNoParticipant); err != nil {
+		return err
+	}
+	return change(study, participantID, nil, actorID)
+}
+
+func checkCapacity(study string, participantID int64, want string, notFound error) error {
+	var capacity string
+	err := database.ADB.Db.QueryRow(selectCapacity, participantID, study).Scan(&capacity)
+	if err == sql.ErrNoRows || (err == nil && capacity != want) {
+		return notFound
+	}
+	return err
+}
+
+// change sets the coordinator of the participant, nil unassigns it, and
+// records the event when the coordinator changed
+func change(study string, participantID int64, coordinatorID *int64, actorID int64) error {
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous *int64
+	err = tx.QueryRow(selectCurrent, participantID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if previous == nil && coordinatorID == nil {
+		return nil
+	}
+	if previous != nil && coordinatorID != nil && *previous == *coordinatorID {
+		return nil
+	}
+
+	if coordinatorID == nil {
+		_, err = tx.Exec(deleteAssignment, participantID)
+	} else {
+		_, err = tx.Exec(upsertAssignment, participantID, study, *coordinatorID, actorID)
+	}
+	if err != nil {
+		log.Printf("failed to assign participant %d\n", participantID)
+		return err
+	}
+	if _, err := tx.Exec(insertEvent, participantID, study, coordinatorID, previous, actorID); err != nil {
+		log.Println("failed to insert caseload event")
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get current assignment of a participant of the study and its history
+func Get(study string, participantID int64) (Assignment, error) {
+	a := Assignment{ParticipantID: participantID, Events: []Event{}}
+	if err := checkCapacity(study, participantID, "patient", ErrNoParticipant); err != nil {
+		return a, err
+	}
+	var coordinatorID, assignedBy int64
+	var assignedAt time.Time
+	err := database.ADB.Db.QueryRow(selectAssignment, participantID, study).Scan(&coordinatorID, &assignedBy, &assignedAt)
+	if err == nil {
+		a.CoordinatorID, a.AssignedBy, a.AssignedAt = &coordinatorID, &assignedBy, &assignedAt
+	} else if err != sql.ErrNoRows {
+		return a, err
+	}
+
+	rows, err := database.ADB.Db.Query(selectEvents, participantID, study)
+	if err != nil {
+		log.Println("failed to query caseload events")
+		return a, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.CoordinatorID, &e.PreviousCoordinatorID, &e.ActorID, &e.CreatedAt); err != nil {
+			return a, err
+		}
+		a.Events = append(a.Events, e)
+	}
+	return a, rows.Err()
+}
+
+// Caseload participants assigned to the coordinator with their outstanding
+// tasks, participants with the most open alerts and unverified uploads first
+func Caseload(study string, coordinatorID int64, now time.Time) ([]Entry, error) {
+	rows, err := database.ADB.Db.Query(selectCaseload, study, coordinatorID)
+	if err != nil {
+		log.Println("failed to query caseload")
+		return nil, err
+	}
+	entries := []Entry{}
+	for rows.Next() {
+		e := Entry{MissingData: []Missing{}}
+		if err := rows.Scan(&e.ParticipantID, &e.Site, &e.AssignedAt, &e.UnverifiedUploads, &e.OpenAlerts); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return entries, nil
+	}
+
+	// last week is included so silence does not restart every monday
+	thisWeek := adherence.WeekStart(now)
+	report, err := adherence.BuildReport(study, coordinatorID, thisWeek.AddDate(0, 0, -7), now, now)
+	if err != nil {
+		return nil, err
+	}
+	byParticipant := map[int64]adherence.ParticipantAdherence{}
+	for _, pa := range report.Participants {
+		byParticipant[pa.ParticipantID] = pa
+	}
+	elapsed := now.Sub(thisWeek).Hours() / (7 * 24)
+	for i := range entries {
+		pa, ok := byParticipant[entries[i].ParticipantID]
+		if !ok {
+			continue
+		}
+		entries[i].LastUpload = pa.LastUpload
+		entries[i].Silent = pa.Silent
+		entries[i].MissingData = missingThisWeek(pa.Weeks, thisWeek.Format("2006-01-02"), elapsed)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].OpenAlerts != entries[j].OpenAlerts {
+			return entries[i].OpenAlerts > entries[j].OpenAlerts
+		}
+		return entries[i].UnverifiedUploads > entries[j].UnverifiedUploads
+	})
+	return entries, nil
+}
+
+// missingThisWeek data types of the current week with fewer uploads than
+// the share of the weekly expectation due after the elapsed part of the week
+func missingThisWeek(weeks []adherence.WeekAdherence, weekStart string, elapsed float64) []Missing {
+	missing := []Missing{}
+	for _, w := range weeks {
+		if w.WeekStart != weekStart {
+			continue
+		}
+		due := int(float64(w.Expected) * elapsed)
+		if w.Received < due {
+			missing = append(missing, Missing{DataType: w.DataType, Expected: due, Received: w.Received})
+		}
+	}
+	return missing
+}
+
+// StudyWorkloads caseload sizes and outstanding tasks of every coordinator of
+// the study, counting participants in enrollment or active only
+func StudyWorkloads(study string) (Workloads, error) {
+	workloads := Workloads{Study: study, Coordinators: []Workload{}, Unassigned: []int64{}}
+	rows, err := database.ADB.Db.Query(selectWorkloads, study)
+	if err != nil {
+		log.Println("failed to query workloads")
+		return workloads, err
+	}
+	for rows.Next() {
+		var w Workload
+		if err := rows.Scan(&w.CoordinatorID, &w.Participants, &w.UnverifiedUploads, &w.OpenAlerts); err != nil {
+			rows.Close()
+			return workloads, err
+		}
+		workloads.Coordinators = append(workloads.Coordinators, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return workloads, err
+	}
+	for i := range workloads.Coordinators {
+		if workloads.Coordinators[i].Sites, err = sites.CoordinatorSites(study, workloads.Coordinators[i].CoordinatorID); err != nil {
+			return workloads, err
+		}
+	}
+
+	rows, err = database.ADB.Db.Query(selectUnassigned, study)
+	if err != nil {
+		log.Println("failed to query unassigned participants")
+		return workloads, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return workloads, err
+		}
+		workloads.Unassigned = append(workloads.Unassigned, id)
+	}
+	return workloads, rows.Err()
+}
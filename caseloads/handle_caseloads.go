@@ -0,0 +1,180 @@
+package caseloads
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/gorilla/mux"
+)
+
+const (
+	adminOnlyErr     = `{"error":"only admins can view workloads"}`
+	invalidBodyErr   = `{"error":"invalid request body"}`
+	noParticipantErr = `{"error":"no such participant"}`
+	noCoordinatorErr = `{"error":"no such coordinator in the study"}`
+	outOfScopeErr    = `{"error":"participant is not at the coordinator's sites"}`
+	caseloadErr      = `{"error":"unable to query caseload"}`
+	assignFailedErr  = `{"error":"unable to update assignment"}`
+)
+
+// CaseloadHandler participants assigned to the coordinator with their
+// outstanding tasks.
+// GET /caseload
+type CaseloadHandler struct {
+	Name string
+}
+
+// AssignmentHandler coordinator a participant is assigned to. Admins use the
+// study in the path, coordinators their own study and only for participants
+// at their sites. A PUT without coordinatorID assigns the participant to the
+// coordinator sending it.
+// GET, PUT, DELETE /participants/{participant_id}/coordinator with {"coordinatorID": 1234567890}
+// GET, PUT, DELETE /api/studies/{study_id}/participants/{participant_id}/coordinator
+type AssignmentHandler struct {
+	Name string
+}
+
+// WorkloadsHandler caseloads of every coordinator of a study, admin only.
+// GET /api/studies/{study_id}/caseloads
+type WorkloadsHandler struct {
+	Name string
+}
+
+// AssignmentRequest body of an assignment
+type AssignmentRequest struct {
+	CoordinatorID int64 `json:"coordinatorID"`
+}
+
+func (h CaseloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	entries, err := Caseload(claims.Study, claims.ID, time.Now().UTC())
+	if err != nil {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(caseloadErr))
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (h AssignmentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	params := mux.Vars(r)
+	participantID, err := strconv.ParseInt(params["participant_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid participant id", http.StatusBadRequest)
+		return
+	}
+
+	study := claims.Study
+	if claims.Capacity == "admin" {
+		study = params["study_id"]
+	} else {
+		visible, err := sites.Visible(study, claims.ID, participantID)
+		if err != nil {
+			log.Println(err)
+		}
+		if !visible {
+			writeError(w, ErrNoParticipant)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var ar AssignmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&ar); err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(invalidBodyErr))
+			return
+		}
+		if ar.CoordinatorID == 0 {
+			ar.CoordinatorID = claims.ID
+		}
+		if err := Assign(study, participantID, ar.CoordinatorID, claims.ID); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Assigned participant %d to coordinator %d\n", participantID, ar.CoordinatorID)
+	case "DELETE":
+		if err := Unassign(study, participantID, claims.ID); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Unassigned participant %d\n", participantID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a, err := Get(study, participantID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (h WorkloadsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	if claims.Capacity != "admin" {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(adminOnlyErr))
+		return
+	}
+	workloads, err := StudyWorkloads(mux.Vars(r)["study_id"])
+	if err != nil {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(caseloadErr))
+		return
+	}
+	writeJSON(w, http.StatusOK, workloads)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	switch err {
+	case ErrNoParticipant:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(noParticipantErr))
+	case ErrNoCoordinator:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(noCoordinatorErr))
+	case ErrOutOfScope:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(outOfScopeErr))
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(assignFailedErr))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	resultsJSON, _ := json.Marshal(v)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(status)
+	w.Write(resultsJSON)
+}
@@ -0,0 +1,314 @@
+package consent
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/cliffordlab/amoss_services/studies"
+)
+
+const (
+	documentColumns = `study_id, version, title, body, document_hash, created_by, created_at, published_at`
+	selectDocuments = `SELECT ` + documentColumns + ` FROM consent_documents WHERE study_id = $1 ORDER BY version`
+	selectDocument  = `SELECT ` + documentColumns + ` FROM consent_documents WHERE study_id = $1 AND version = $2`
+	selectPublished = `SELECT ` + documentColumns + ` FROM consent_documents
+WHERE study_id = $1 AND published_at IS NOT NULL ORDER BY version DESC LIMIT 1`
+	insertDocument = `INSERT INTO consent_documents (study_id, version, title, body, document_hash, created_by)
+SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5 FROM consent_documents WHERE study_id = $1
+RETURNING ` + documentColumns
+	// a version older than the published one would never become current
+	publishDocument = `UPDATE consent_documents SET published_at = now()
+WHERE study_id = $1 AND version = $2 AND published_at IS NULL
+AND version > (SELECT COALESCE(MAX(version), 0) FROM consent_documents WHERE study_id = $1 AND published_at IS NOT NULL)`
+	resetConsented  = `UPDATE participants SET is_consented = FALSE WHERE study_id = $1 AND capacity_id = 'patient'`
+	insertSignature = `INSERT INTO consent_signatures (participant_id, study_id, version, typed_name, ip_address, document_hash)
+VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (participant_id, study_id, version) DO NOTHING`
+	setConsented     = `UPDATE participants SET is_consented = TRUE WHERE participant_id = $1 AND study_id = $2`
+	signatureColumns = `participant_id, version, typed_name, ip_address, document_hash, signed_at`
+	selectSignature  = `SELECT ` + signatureColumns + ` FROM consent_signatures
+WHERE participant_id = $1 AND study_id = $2 AND version = $3`
+	selectSignatures = `SELECT ` + signatureColumns + ` FROM consent_signatures
+WHERE participant_id = $1 AND study_id = $2 ORDER BY version`
+	// studies without a published document do not ask for consent
+	selectCurrent = `SELECT NOT EXISTS (SELECT 1 FROM consent_documents WHERE study_id = $2 AND published_at IS NOT NULL)
+OR EXISTS (SELECT 1 FROM consent_signatures s WHERE s.participant_id = $1 AND s.study_id = $2
+AND s.version = (SELECT MAX(version) FROM consent_documents WHERE study_id = $2 AND published_at IS NOT NULL))`
+	// without a published document the flag set by the app's consent flow is reported
+	selectConsented = `SELECT CASE WHEN EXISTS (SELECT 1 FROM consent_documents WHERE study_id = $2 AND published_at IS NOT NULL)
+THEN EXISTS (SELECT 1 FROM consent_signatures s WHERE s.participant_id = $1 AND s.study_id = $2
+AND s.version = (SELECT MAX(version) FROM consent_documents WHERE study_id = $2 AND published_at IS NOT NULL))
+ELSE COALESCE((SELECT is_consented FROM participants WHERE participant_id = $1), FALSE) END`
+	selectStudyStatus = `SELECT p.participant_id, COALESCE(p.site_id, ''), p.lifecycle_state, s.version, s.signed_at
+FROM participants p LEFT JOIN LATERAL (SELECT version, signed_at FROM consent_signatures
+WHERE participant_id = p.participant_id AND study_id = p.study_id ORDER BY version DESC LIMIT 1) s ON TRUE
+WHERE p.study_id = $1 AND p.capacity_id = 'patient' AND `
+)
+
+var (
+	// ErrNoDocument returned for a version that does not exist or a study without a published document
+	ErrNoDocument = errors.New("no such consent document")
+	// ErrNotPublishable returned when publishing a published version or one older than the published version
+	ErrNotPublishable = errors.New("consent document cannot be published")
+	// ErrNotCurrent returned when signing a version that is not the current one
+	ErrNotCurrent = errors.New("consent document is not the current version")
+	// ErrHashMismatch returned when the hash the participant signed is missing or not the hash of the document
+	ErrHashMismatch = errors.New("document hash does not match")
+	// ErrNoName returned for a signature without a typed name
+	ErrNoName = errors.New("a typed name is required")
+	// ErrEmptyDocument returned for a document without a title or body
+	ErrEmptyDocument = errors.New("a title and body are required")
+)
+
+// Document one version of a study's consent document. PublishedAt is nil
+// for drafts.
+type Document struct {
+	Study       string     `json:"study"`
+	Version     int        `json:"version"`
+	Title       string     `json:"title"`
+	Body        string     `json:"body"`
+	Hash        string     `json:"documentHash"`
+	CreatedBy   int64      `json:"createdBy"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	PublishedAt *time.Time `json:"publishedAt"`
+}
+
+// Signature a participant's signature on one version
+type Signature struct {
+	ParticipantID int64     `json:"participantID"`
+	Version       int       `json:"version"`
+	TypedName     string    `json:"typedName"`
+	IPAddress     string    `json:"ipAddress"`
+	DocumentHash  string    `json:"documentHash"`
+	SignedAt      time.Time `json:"signedAt"`
+}
+
+// Status consent of one participant. CurrentVersion is 0 when the study has
+// no published document, SignedVersion is the latest version signed.
+type Status struct {
+	ParticipantID  int64      `json:"participantID"`
+	Site           string     `json:"site"`
+	State          string     `json:"state"`
+	CurrentVersion int        `json:"currentVersion"`
+	SignedVersion  *int       `json:"signedVersion"`
+	SignedAt       *time.Time `json:"signedAt"`
+	Current        bool       `json:"current"`
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDocument(row scanner) (Document, error) {
+	var d Document
+	var published sql.NullTime
+	err := row.Scan(&d.Study, &d.Version, &d.Title, &d.Body, &d.Hash, &d.CreatedBy, &d.CreatedAt, &published)
+	if err == sql.ErrNoRows {
+		return d, ErrNoDocument
+	}
+	if published.Valid {
+		d.PublishedAt = &published.Time
+	}
+	return d, err
+}
+
+func scanSignature(row scanner) (Signature, error) {
+	var s Signature
+	err := row.Scan(&s.ParticipantID, &s.Version, &s.TypedName, &s.IPAddress, &s.DocumentHash, &s.SignedAt)
+	return s, err
+}
+
+// Hash sha256 of a document body as hex, what participants sign
+func Hash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// Documents every version of a study's consent document
+func Documents(study string) ([]Document, error) {
+	rows, err := database.ADB.Db.Query(selectDocuments, study)
+	if err != nil {
+		log.Println("failed to query consent documents")
+		return nil, err
+	}
+	defer rows.Close()
+
+	documents := []Document{}
+	for rows.Next() {
+		d, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, d)
+	}
+	return documents, rows.Err()
+}
+
+// Create saves a draft with the next version of the study's document
+func Create(study string, title string, body string, actorID int64) (Document, error) {
+	if strings.TrimSpace(title) == "" || strings.TrimSpace(body) == "" {
+		return Document{}, ErrEmptyDocument
+	}
+	if _, err := studies.Get(study); err != nil {
+		return Document{}, err
+	}
+	return scanDocument(database.ADB.Db.QueryRow(insertDocument, study, title, body, Hash(body), actorID))
+}
+
+// Publish makes a draft the current version. Every participant of the study
+// has to sign it again.
+func Publish(study string, version int) (Document, error) {
+	if _, err := scanDocument(database.ADB.Db.QueryRow(selectDocument, study, version)); err != nil {
+		return Document{}, err
+	}
+
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return Document{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(publishDocument, study, version)
+	if err != nil {
+		return Document{}, err
+	}
+	if published, _ := result.RowsAffected(); published == 0 {
+		return Document{}, ErrNotPublishable
+	}
+	if _, err := tx.Exec(resetConsented, study); err != nil {
+		log.Println("failed to reset consented participants")
+		return Document{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Document{}, err
+	}
+	return scanDocument(database.ADB.Db.QueryRow(selectDocument, study, version))
+}
+
+// CurrentDocument latest published version of the study's document
+func CurrentDocument(study string) (Document, error) {
+	return scanDocument(database.ADB.Db.QueryRow(selectPublished, study))
+}
+
+// Sign records the participant's signature on the current version. The hash
+// of the text the participant was shown is required and has to match the
+// document. Signing a version twice returns the first signature.
+func Sign(study string, participantID int64, version int, typedName string, documentHash string, ip string) (Signature, error) {
+	typedName = strings.TrimSpace(typedName)
+	if typedName == "" {
+		return Signature{}, ErrNoName
+	}
+	d, err := CurrentDocument(study)
+	if err != nil {
+		return Signature{}, err
+	}
+	if d.Version != version {
+		return Signature{}, ErrNotCurrent
+	}
+	if documentHash == "" || !strings.EqualFold(documentHash, d.Hash) {
+		return Signature{}, ErrHashMismatch
+	}
+
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return Signature{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(insertSignature, participantID, study, version, typedName, ip, d.Hash); err != nil {
+		log.Println("failed to insert consent signature")
+		return Signature{}, err
+	}
+	if _, err := tx.Exec(setConsented, participantID, study); err != nil {
+		return Signature{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Signature{}, err
+	}
+	return scanSignature(database.ADB.Db.QueryRow(selectSignature, participantID, study, version))
+}
+
+// Signatures every version the participant signed
+func Signatures(study string, participantID int64) ([]Signature, error) {
+	rows, err := database.ADB.Db.Query(selectSignatures, participantID, study)
+	if err != nil {
+		log.Println("failed to query consent signatures")
+		return nil, err
+	}
+	defer rows.Close()
+
+	signatures := []Signature{}
+	for rows.Next() {
+		s, err := scanSignature(rows)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, s)
+	}
+	return signatures, rows.Err()
+}
+
+// Current reports whether the participant signed the current version of its
+// study's document. A failing query is logged and treated as not signed.
+func Current(study string, participantID int64) bool {
+	var current bool
+	err := database.ADB.Db.QueryRow(selectCurrent, participantID, study).Scan(&current)
+	if err != nil {
+		log.Printf("failed to read consent of participant %d: %s\n", participantID, err.Error())
+	}
+	return current
+}
+
+// Consented what the app is told at login: whether the participant signed
+// the current version, or the stored is_consented of studies without a
+// published document. A failing query is logged and treated as not consented.
+func Consented(study string, participantID int64) bool {
+	var consented bool
+	err := database.ADB.Db.QueryRow(selectConsented, participantID, study).Scan(&consented)
+	if err != nil {
+		log.Printf("failed to read consent of participant %d: %s\n", participantID, err.Error())
+	}
+	return consented
+}
+
+// StudyStatus consent of the patients at the coordinator's sites
+func StudyStatus(study string, coordinatorID int64) ([]Status, error) {
+	var currentVersion int
+	d, err := CurrentDocument(study)
+	if err == nil {
+		currentVersion = d.Version
+	} else if err != ErrNoDocument {
+		return nil, err
+	}
+
+	rows, err := database.ADB.Db.Query(selectStudyStatus+sites.Condition("p.site_id", 2)+` ORDER BY p.participant_id`, study, coordinatorID)
+	if err != nil {
+		log.Println("failed to query consent status")
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []Status{}
+	for rows.Next() {
+		s := Status{CurrentVersion: currentVersion}
+		var signedVersion sql.NullInt64
+		var signedAt sql.NullTime
+		if err := rows.Scan(&s.ParticipantID, &s.Site, &s.State, &signedVersion, &signedAt); err != nil {
+			return nil, err
+		}
+		if signedVersion.Valid {
+			v := int(signedVersion.Int64)
+			s.SignedVersion = &v
+			s.SignedAt = &signedAt.Time
+		}
+		s.Current = currentVersion == 0 || (s.SignedVersion != nil && *s.SignedVersion == currentVersion)
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
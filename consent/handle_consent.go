@@ -0,0 +1,318 @@
+package consent
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/cliffordlab/amoss_services/studies"
+	"github.com/gorilla/mux"
+)
+
+const (
+	selectAccessToken  = `SELECT access_token FROM participants WHERE participant_id = $1 AND access_token = $2 AND lifecycle_state <> 'withdrawn'`
+	invalidAccessToken = `{"logout user":"Invalid access token."}`
+	invalidBodyErr     = `{"error":"invalid request body"}`
+	noStudyErr         = `{"error":"no such study"}`
+	noDocumentErr      = `{"error":"no such consent document"}`
+	noParticipantErr   = `{"error":"no such participant"}`
+	emptyDocumentErr   = `{"error":"a title and body are required"}`
+	notPublishableErr  = `{"error":"document is already published or older than the published version"}`
+	notCurrentErr      = `{"error":"a newer version of the consent document was published"}`
+	hashMismatchErr    = `{"error":"document hash is missing or does not match the current version"}`
+	noNameErr          = `{"error":"a typed name is required"}`
+	consentFailedErr   = `{"error":"unable to update consent"}`
+	queryFailedErr     = `{"error":"unable to query consent"}`
+)
+
+// DocumentsHandler lists and drafts versions of a study's consent document,
+// admin only.
+// GET, POST /api/studies/{study_id}/consent/documents with {"title": "", "body": ""}
+type DocumentsHandler struct {
+	Name string
+}
+
+// PublishHandler makes a draft the current version, participants have to
+// sign it again. Admin only.
+// POST /api/studies/{study_id}/consent/documents/{version}/publish
+type PublishHandler struct {
+	Name string
+}
+
+// ParticipantConsentHandler current document of the participant's study
+// and the participant's signature on it.
+// GET, POST /api/consent with {"version": 2, "typedName": "", "documentHash": ""}
+type ParticipantConsentHandler struct {
+	Name string
+}
+
+// StatusHandler consent of the patients at the coordinator's sites, or the
+// signatures of one participant. Admins use the study in the path.
+// GET /consent, GET /participants/{participant_id}/consent
+// GET /api/studies/{study_id}/consent, GET /api/studies/{study_id}/participants/{participant_id}/consent
+type StatusHandler struct {
+	Name string
+}
+
+// DocumentRequest body of a new version
+type DocumentRequest struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// SignRequest body of a signature. DocumentHash is the hash of the document
+// the participant was shown and is required.
+type SignRequest struct {
+	Version      int    `json:"version"`
+	TypedName    string `json:"typedName"`
+	DocumentHash string `json:"documentHash"`
+}
+
+// ParticipantConsent document a participant has to sign and whether it did
+type ParticipantConsent struct {
+	Document  *Document  `json:"document"`
+	Signed    bool       `json:"signed"`
+	Signature *Signature `json:"signature"`
+}
+
+// ParticipantSignatures signatures of one participant
+type ParticipantSignatures struct {
+	ParticipantID  int64       `json:"participantID"`
+	CurrentVersion int         `json:"currentVersion"`
+	Current        bool        `json:"current"`
+	Signatures     []Signature `json:"signatures"`
+}
+
+func (h DocumentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	study := mux.Vars(r)["study_id"]
+	switch r.Method {
+	case "GET":
+		documents, err := Documents(study)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, documents)
+	case "POST":
+		var dr DocumentRequest
+		if err := json.NewDecoder(r.Body).Decode(&dr); err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(invalidBodyErr))
+			return
+		}
+		d, err := Create(study, dr.Title, dr.Body, claims.ID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Drafted consent document %s v%d\n", study, d.Version)
+		writeJSON(w, http.StatusCreated, d)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h PublishHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "HTTP Method needs to be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	params := mux.Vars(r)
+	version, err := strconv.Atoi(params["version"])
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	d, err := Publish(params["study_id"], version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Published consent document %s v%d\n", d.Study, d.Version)
+	writeJSON(w, http.StatusOK, d)
+}
+
+func (h ParticipantConsentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, bearerToken, err := capacity.ClaimsFromHeader(r, "Mars")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	var accessTokenDB string
+	err = database.ADB.Db.QueryRow(selectAccessToken, claims.ID, bearerToken).Scan(&accessTokenDB)
+	if err != nil || accessTokenDB != bearerToken {
+		log.Println("Access token does not match that of the database")
+		log.Println("Participant_ID: ", claims.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(invalidAccessToken))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var sr SignRequest
+		if err := json.NewDecoder(r.Body).Decode(&sr); err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(invalidBodyErr))
+			return
+		}
+		if _, err := Sign(claims.Study, claims.ID, sr.Version, sr.TypedName, sr.DocumentHash, clientIP(r)); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Participant %d signed consent %s v%d\n", claims.ID, claims.Study, sr.Version)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var pc ParticipantConsent
+	d, err := CurrentDocument(claims.Study)
+	if err == ErrNoDocument {
+		pc.Signed = true
+		writeJSON(w, http.StatusOK, pc)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	pc.Document = &d
+	signatures, err := Signatures(claims.Study, claims.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for i := range signatures {
+		if signatures[i].Version == d.Version {
+			pc.Signed = true
+			pc.Signature = &signatures[i]
+		}
+	}
+	writeJSON(w, http.StatusOK, pc)
+}
+
+func (h StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	params := mux.Vars(r)
+	study := claims.Study
+	if claims.Capacity == "admin" {
+		study = params["study_id"]
+	}
+
+	id, ok := params["participant_id"]
+	if !ok {
+		statuses, err := StudyStatus(study, claims.ID)
+		if err != nil {
+			log.Println(err)
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(queryFailedErr))
+			return
+		}
+		writeJSON(w, http.StatusOK, statuses)
+		return
+	}
+
+	participantID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid participant id", http.StatusBadRequest)
+		return
+	}
+	visible, err := sites.Visible(study, claims.ID, participantID)
+	if err != nil {
+		log.Println(err)
+	}
+	if !visible {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(noParticipantErr))
+		return
+	}
+	ps := ParticipantSignatures{ParticipantID: participantID, Current: Current(study, participantID)}
+	if d, err := CurrentDocument(study); err == nil {
+		ps.CurrentVersion = d.Version
+	} else if err != ErrNoDocument {
+		writeError(w, err)
+		return
+	}
+	if ps.Signatures, err = Signatures(study, participantID); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ps)
+}
+
+// clientIP address the request came from. Behind the load balancer it is the
+// last address of X-Forwarded-For, the one the load balancer appended, the
+// addresses before it are sent by the client.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+		if last := strings.TrimSpace(addresses[len(addresses)-1]); last != "" {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	switch err {
+	case studies.ErrNoStudy:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(noStudyErr))
+	case ErrNoDocument:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(noDocumentErr))
+	case ErrEmptyDocument:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(emptyDocumentErr))
+	case ErrNoName:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(noNameErr))
+	case ErrNotPublishable:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(notPublishableErr))
+	case ErrNotCurrent:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(notCurrentErr))
+	case ErrHashMismatch:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(hashMismatchErr))
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(consentFailedErr))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	resultsJSON, _ := json.Marshal(v)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(status)
+	w.Write(resultsJSON)
+}
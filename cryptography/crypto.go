@@ -4,10 +4,13 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"io"
 	"log"
+	"strings"
 )
 
 func Encrypt(key, text []byte, iv []byte) ([]byte, error) {
@@ -44,3 +47,10 @@ func Decrypt(key, text []byte, iv []byte) ([]byte, error) {
 	}
 	return data, nil
 }
+
+// HashEmail hex sha256 of the trimmed lower case email, saved as email_hash
+// to find participants by email without decrypting every address
+func HashEmail(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
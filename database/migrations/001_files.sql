@@ -0,0 +1,18 @@
+-- File catalog: one row for every object uploaded to the awsS3Bucket bucket.
+-- Replaces the DynamoDB Participant_Files table.
+CREATE TABLE IF NOT EXISTS files (
+    file_id        BIGSERIAL PRIMARY KEY,
+    participant_id BIGINT      NOT NULL,
+    study_id       TEXT        NOT NULL,
+    week_millis    TEXT        NOT NULL DEFAULT '',
+    s3_key         TEXT        NOT NULL UNIQUE,
+    extension      TEXT        NOT NULL DEFAULT '',
+    size_bytes     BIGINT      NOT NULL DEFAULT 0,
+    checksum       TEXT        NOT NULL DEFAULT '',
+    etag           TEXT        NOT NULL DEFAULT '',
+    content_type   TEXT        NOT NULL DEFAULT '',
+    uploaded_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS files_participant_uploaded_idx ON files (participant_id, uploaded_at);
+CREATE INDEX IF NOT EXISTS files_study_uploaded_idx ON files (study_id, uploaded_at);
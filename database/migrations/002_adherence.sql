@@ -0,0 +1,15 @@
+-- Adherence expectations: how many uploads of each data type a study expects
+-- per participant per week. data_type is "vitals" (bp_readings), "symptoms"
+-- (mme_symptoms) or a file extension from the files table (e.g. "wav").
+CREATE TABLE IF NOT EXISTS adherence_expectations (
+    study_id          TEXT    NOT NULL,
+    data_type         TEXT    NOT NULL,
+    expected_per_week INTEGER NOT NULL,
+    PRIMARY KEY (study_id, data_type)
+);
+
+-- Participants with no upload for longer than silence_threshold_hours are flagged.
+CREATE TABLE IF NOT EXISTS adherence_settings (
+    study_id                TEXT PRIMARY KEY,
+    silence_threshold_hours INTEGER NOT NULL DEFAULT 72
+);
@@ -0,0 +1,14 @@
+-- Uploads issued a presigned URL that have not been confirmed yet. A row is
+-- moved to files once the completion callback verified the object in s3.
+CREATE TABLE IF NOT EXISTS pending_uploads (
+    s3_key         TEXT        PRIMARY KEY,
+    participant_id BIGINT      NOT NULL,
+    study_id       TEXT        NOT NULL,
+    week_millis    TEXT        NOT NULL,
+    size_bytes     BIGINT      NOT NULL,
+    checksum       TEXT        NOT NULL,
+    md5            TEXT        NOT NULL,
+    content_type   TEXT        NOT NULL DEFAULT '',
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at     TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,7 @@
+-- File types a study accepts on upload. Studies without rows accept every
+-- type the server can recognise (jpeg, csv, wav, fit, json, pdf).
+CREATE TABLE IF NOT EXISTS study_file_types (
+    study_id  TEXT NOT NULL,
+    file_type TEXT NOT NULL,
+    PRIMARY KEY (study_id, file_type)
+);
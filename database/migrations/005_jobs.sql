@@ -0,0 +1,22 @@
+-- Durable queue for post-upload processing. Workers claim jobs with
+-- FOR UPDATE SKIP LOCKED so several servers can share the queue.
+CREATE TABLE IF NOT EXISTS jobs (
+    job_id       BIGSERIAL   PRIMARY KEY,
+    kind         TEXT        NOT NULL,
+    payload      JSONB       NOT NULL,
+    status       TEXT        NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'done', 'dead')),
+    attempts     INTEGER     NOT NULL DEFAULT 0,
+    max_attempts INTEGER     NOT NULL DEFAULT 8,
+    run_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_at    TIMESTAMPTZ,
+    last_error   TEXT        NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS jobs_queued_idx ON jobs (run_at) WHERE status = 'queued';
+
+-- Jobs that ran out of attempts or failed permanently.
+CREATE OR REPLACE VIEW dead_jobs AS
+SELECT job_id, kind, payload, attempts, last_error, created_at, updated_at
+FROM jobs WHERE status = 'dead';
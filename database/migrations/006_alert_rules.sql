@@ -0,0 +1,17 @@
+-- Clinical alert rules. A row with participant_id NULL applies to the whole
+-- study, a row with participant_id set overrides the study rule of the same
+-- kind for that participant. Kinds without any row use the defaults in
+-- alerts/rules.go. params holds only the values to override, e.g.
+-- {"sbp": 150, "dbp": 100} or {"count": 3, "windowHours": 12}.
+CREATE TABLE IF NOT EXISTS alert_rules (
+    rule_id        BIGSERIAL PRIMARY KEY,
+    study_id       TEXT      NOT NULL,
+    participant_id BIGINT,
+    kind           TEXT      NOT NULL CHECK (kind IN ('severe_bp', 'mild_bp_repeat', 'pulse_range', 'symptoms', 'symptoms_with_bp')),
+    enabled        BOOLEAN   NOT NULL DEFAULT TRUE,
+    severity       TEXT      CHECK (severity IN ('severe', 'warning')),
+    params         JSONB     NOT NULL DEFAULT '{}'
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS alert_rules_study_idx ON alert_rules (study_id, kind) WHERE participant_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS alert_rules_participant_idx ON alert_rules (study_id, participant_id, kind) WHERE participant_id IS NOT NULL;
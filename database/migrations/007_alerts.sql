@@ -0,0 +1,52 @@
+-- Alerts raised by the rules in alert_rules. reading_at is the time of the
+-- reading or symptoms report that fired the rule, so a retried upload job
+-- finds the existing alert instead of raising it twice.
+CREATE TABLE IF NOT EXISTS alerts (
+    alert_id        BIGSERIAL   PRIMARY KEY,
+    participant_id  BIGINT      NOT NULL,
+    study_id        TEXT        NOT NULL,
+    rule            TEXT        NOT NULL,
+    severity        TEXT        NOT NULL,
+    message         TEXT        NOT NULL,
+    reading_at      TIMESTAMPTZ NOT NULL,
+    status          TEXT        NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'acknowledged', 'resolved')),
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    notified_at     TIMESTAMPTZ,
+    escalated_at    TIMESTAMPTZ,
+    acknowledged_at TIMESTAMPTZ,
+    acknowledged_by BIGINT,
+    resolved_at     TIMESTAMPTZ,
+    resolved_by     BIGINT,
+    UNIQUE (participant_id, rule, reading_at)
+);
+
+CREATE INDEX IF NOT EXISTS alerts_study_status_idx ON alerts (study_id, status);
+CREATE INDEX IF NOT EXISTS alerts_escalation_idx ON alerts (created_at) WHERE status = 'open' AND escalated_at IS NULL;
+
+-- Audit trail of every change to an alert. actor_id is the coordinator for
+-- acknowledge/resolve and NULL for events raised by the server.
+CREATE TABLE IF NOT EXISTS alert_events (
+    event_id   BIGSERIAL   PRIMARY KEY,
+    alert_id   BIGINT      NOT NULL REFERENCES alerts (alert_id),
+    event      TEXT        NOT NULL CHECK (event IN ('opened', 'notified', 'escalated', 'acknowledged', 'resolved')),
+    actor_id   BIGINT,
+    note       TEXT        NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS alert_events_alert_idx ON alert_events (alert_id);
+
+-- Severe alerts still open after escalate_after_minutes are sent to the
+-- secondary contacts of the study.
+CREATE TABLE IF NOT EXISTS alert_escalation_settings (
+    study_id               TEXT    PRIMARY KEY,
+    escalate_after_minutes INTEGER NOT NULL DEFAULT 30
+);
+
+CREATE TABLE IF NOT EXISTS alert_contacts (
+    contact_id BIGSERIAL PRIMARY KEY,
+    study_id   TEXT      NOT NULL,
+    name       TEXT      NOT NULL DEFAULT '',
+    phone      TEXT      NOT NULL,
+    level      TEXT      NOT NULL DEFAULT 'secondary' CHECK (level IN ('secondary'))
+);
@@ -0,0 +1,19 @@
+-- Transactional outbox of every notification. Messages are written here
+-- first and delivered by the relay, so a provider outage delays messages
+-- instead of losing them.
+CREATE TABLE IF NOT EXISTS notification_outbox (
+    outbox_id       BIGSERIAL   PRIMARY KEY,
+    channel         TEXT        NOT NULL CHECK (channel IN ('email', 'sms', 'topic')),
+    recipient       TEXT        NOT NULL DEFAULT '',
+    subject         TEXT        NOT NULL DEFAULT '',
+    body            TEXT        NOT NULL,
+    status          TEXT        NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'failed')),
+    attempts        INTEGER     NOT NULL DEFAULT 0,
+    max_attempts    INTEGER     NOT NULL DEFAULT 10,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error      TEXT        NOT NULL DEFAULT '',
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    sent_at         TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS notification_outbox_pending_idx ON notification_outbox (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,6 @@
+-- Preferred language of participant messages (e.g. "en", "es", "zu").
+-- NULL uses the default locale of the study branding.
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS locale TEXT;
+
+-- HTML alternative of templated emails.
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS body_html TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,32 @@
+-- Missed measurement reminders. Only studies with a row here get reminders.
+-- Participants are reminded when nothing was uploaded for the window, never
+-- during quiet hours of their local time, at most max_per_day times a day,
+-- max_per_gap times for one missed stretch and not more often than
+-- repeat_after_hours.
+CREATE TABLE IF NOT EXISTS reminder_settings (
+    study_id              TEXT    PRIMARY KEY,
+    enabled               BOOLEAN NOT NULL DEFAULT TRUE,
+    vitals_window_hours   INTEGER NOT NULL DEFAULT 24,
+    symptoms_window_hours INTEGER NOT NULL DEFAULT 24,
+    quiet_start_hour      INTEGER NOT NULL DEFAULT 21 CHECK (quiet_start_hour BETWEEN 0 AND 23),
+    quiet_end_hour        INTEGER NOT NULL DEFAULT 8 CHECK (quiet_end_hour BETWEEN 0 AND 23),
+    max_per_day           INTEGER NOT NULL DEFAULT 2,
+    max_per_gap           INTEGER NOT NULL DEFAULT 5,
+    repeat_after_hours    INTEGER NOT NULL DEFAULT 6,
+    sms_enabled           BOOLEAN NOT NULL DEFAULT FALSE,
+    timezone              TEXT    NOT NULL DEFAULT 'UTC'
+);
+
+-- IANA time zone of the participant, e.g. "Africa/Johannesburg". NULL uses
+-- the timezone of the study reminder settings.
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS timezone TEXT;
+
+CREATE TABLE IF NOT EXISTS participant_reminders (
+    reminder_id    BIGSERIAL   PRIMARY KEY,
+    participant_id BIGINT      NOT NULL,
+    data_type      TEXT        NOT NULL CHECK (data_type IN ('vitals', 'symptoms')),
+    channels       TEXT        NOT NULL,
+    sent_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS participant_reminders_participant_idx ON participant_reminders (participant_id, data_type, sent_at);
@@ -0,0 +1,22 @@
+-- Every reviewer's transcription of a blood pressure photo. A reading becomes
+-- verified when two reviewers agree on all three values, or by adjudication
+-- when the reviews disagree. Diffs are the reviewer's values minus the values
+-- the participant entered.
+CREATE TABLE IF NOT EXISTS bp_verifications (
+    verification_id BIGSERIAL   PRIMARY KEY,
+    participant_id  BIGINT      NOT NULL,
+    created_at      BIGINT      NOT NULL,
+    reviewer_id     BIGINT      NOT NULL,
+    kind            TEXT        NOT NULL DEFAULT 'review' CHECK (kind IN ('review', 'adjudication')),
+    systolic_bp     INTEGER     NOT NULL,
+    diastolic_bp    INTEGER     NOT NULL,
+    pulse           INTEGER     NOT NULL,
+    sbp_diff        INTEGER     NOT NULL,
+    dbp_diff        INTEGER     NOT NULL,
+    pulse_diff      INTEGER     NOT NULL,
+    note            TEXT        NOT NULL DEFAULT '',
+    reviewed_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (participant_id, created_at, reviewer_id, kind)
+);
+
+CREATE INDEX IF NOT EXISTS bp_verifications_reading_idx ON bp_verifications (participant_id, created_at);
@@ -0,0 +1,36 @@
+-- Append-only history of the values of every blood pressure reading.
+-- Revision 0 holds the values the participant entered, each later revision a
+-- change with who made it and why. csv_s3_key is the csv written for the
+-- revision, edits write a new versioned key and never replace an object.
+CREATE TABLE IF NOT EXISTS bp_reading_revisions (
+    revision_id    BIGSERIAL   PRIMARY KEY,
+    participant_id BIGINT      NOT NULL,
+    created_at     BIGINT      NOT NULL,
+    revision       INTEGER     NOT NULL,
+    systolic_bp    INTEGER     NOT NULL,
+    diastolic_bp   INTEGER     NOT NULL,
+    pulse          INTEGER     NOT NULL,
+    csv_s3_key     TEXT        NOT NULL DEFAULT '',
+    source         TEXT        NOT NULL CHECK (source IN ('upload', 'baseline', 'verification', 'adjudication')),
+    changed_by     BIGINT,
+    reason         TEXT        NOT NULL DEFAULT '',
+    changed_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (participant_id, created_at, revision)
+);
+
+CREATE OR REPLACE FUNCTION bp_reading_revisions_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'bp_reading_revisions is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS bp_reading_revisions_append_only ON bp_reading_revisions;
+CREATE TRIGGER bp_reading_revisions_append_only BEFORE UPDATE OR DELETE ON bp_reading_revisions
+    FOR EACH ROW EXECUTE PROCEDURE bp_reading_revisions_append_only();
+
+-- readings stored before the history existed start from their current values
+INSERT INTO bp_reading_revisions (participant_id, created_at, revision, systolic_bp, diastolic_bp, pulse, csv_s3_key, source, reason)
+SELECT b.participant_id, b.created_at, 0, b.systolic_bp, b.diastolic_bp, b.pulse, COALESCE(b.csv_s3_key, ''), 'baseline',
+       'values when the revision history was introduced'
+FROM bp_readings b
+WHERE NOT EXISTS (SELECT 1 FROM bp_reading_revisions r WHERE r.participant_id = b.participant_id AND r.created_at = b.created_at);
@@ -0,0 +1,15 @@
+-- Values a BPImageReader proposed for an uploaded blood pressure photo, one
+-- row per reading, replaced when the photo is read again. The values are
+-- null and error is set when the reader found no blood pressure.
+CREATE TABLE IF NOT EXISTS bp_image_readings (
+    participant_id BIGINT           NOT NULL,
+    created_at     BIGINT           NOT NULL,
+    reader         TEXT             NOT NULL,
+    systolic_bp    INTEGER,
+    diastolic_bp   INTEGER,
+    pulse          INTEGER,
+    confidence     DOUBLE PRECISION NOT NULL DEFAULT 0,
+    error          TEXT             NOT NULL DEFAULT '',
+    read_at        TIMESTAMPTZ      NOT NULL DEFAULT now(),
+    PRIMARY KEY (participant_id, created_at)
+);
@@ -0,0 +1,8 @@
+-- When a participant was enrolled, readings taken before it are rejected.
+-- Participants enrolled before this column existed keep it null and are not checked.
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS enrolled_at TIMESTAMPTZ;
+ALTER TABLE participants ALTER COLUMN enrolled_at SET DEFAULT now();
+
+-- Comma separated reasons a stored reading is implausible but possible,
+-- empty for readings that passed every check
+ALTER TABLE bp_readings ADD COLUMN IF NOT EXISTS plausibility_flags TEXT NOT NULL DEFAULT '';
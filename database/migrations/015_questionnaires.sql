@@ -0,0 +1,25 @@
+-- Instruments a study offers to its participants. Studies without rows offer
+-- every instrument loaded from the questionnaires/instruments definitions.
+CREATE TABLE IF NOT EXISTS study_instruments (
+    study_id      TEXT NOT NULL,
+    instrument_id TEXT NOT NULL,
+    PRIMARY KEY (study_id, instrument_id)
+);
+
+-- One completed questionnaire. Answers hold only the items that were shown
+-- and answered, scores the results of the instrument version it was answered
+-- with. created_at is the app's unix millis, a retried submission is ignored.
+CREATE TABLE IF NOT EXISTS questionnaire_responses (
+    response_id        BIGSERIAL   PRIMARY KEY,
+    participant_id     BIGINT      NOT NULL,
+    study_id           TEXT        NOT NULL,
+    instrument_id      TEXT        NOT NULL,
+    instrument_version INTEGER     NOT NULL,
+    created_at         BIGINT      NOT NULL,
+    answers            JSONB       NOT NULL,
+    scores             JSONB       NOT NULL,
+    submitted_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (participant_id, instrument_id, created_at)
+);
+
+CREATE INDEX IF NOT EXISTS questionnaire_responses_study_idx ON questionnaire_responses (study_id, instrument_id, created_at);
@@ -0,0 +1,27 @@
+-- Study registry. Settings handlers used to hardcode: the token lifetime,
+-- the folder of the study's uploads in s3 (empty uses the study id) and the
+-- apk the app download serves. Enabled file types live in study_file_types,
+-- alert rules in alert_rules.
+CREATE TABLE IF NOT EXISTS studies (
+    study_id TEXT PRIMARY KEY
+);
+
+ALTER TABLE studies ADD COLUMN IF NOT EXISTS name                TEXT    NOT NULL DEFAULT '';
+ALTER TABLE studies ADD COLUMN IF NOT EXISTS status              TEXT    NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'paused', 'closed'));
+ALTER TABLE studies ADD COLUMN IF NOT EXISTS start_date          DATE;
+ALTER TABLE studies ADD COLUMN IF NOT EXISTS end_date            DATE;
+ALTER TABLE studies ADD COLUMN IF NOT EXISTS token_lifetime_days INTEGER NOT NULL DEFAULT 365 CHECK (token_lifetime_days > 0);
+ALTER TABLE studies ADD COLUMN IF NOT EXISTS s3_prefix           TEXT    NOT NULL DEFAULT '';
+ALTER TABLE studies ADD COLUMN IF NOT EXISTS apk_key             TEXT    NOT NULL DEFAULT '';
+
+-- the studies registration accepted before the registry
+INSERT INTO studies (study_id) VALUES ('hf'), ('chf'), ('depression monitoring'), ('moyo'), ('test'), ('super'),
+    ('pCRF'), ('sleepBank'), ('utsw'), ('sleep technology'), ('ptsd-vns'), ('ptsd_twin'), ('ptsd_grc'), ('otsuka'),
+    ('Anytime Fitness Study'), ('PRO-C study'), ('vismet'), ('cfd-sleep-study-test'), ('cfd-sleep_study'), ('cfd-classroom-audio')
+ON CONFLICT (study_id) DO NOTHING;
+
+UPDATE studies SET name = study_id WHERE name = '';
+UPDATE studies SET token_lifetime_days = 1095 WHERE study_id IN ('cfd-sleep-study-test', 'cfd-classroom-audio', 'cfd-sleep-study');
+UPDATE studies SET apk_key = 'moyo-utsw-v1.0.0.0.apk' WHERE study_id = 'utsw' AND apk_key = '';
+UPDATE studies SET apk_key = 'amoss-moyo-release.apk' WHERE study_id = 'moyo' AND apk_key = '';
+UPDATE studies SET apk_key = 'amoss-hf-release-v1.0.0.0.apk' WHERE study_id = 'hf' AND apk_key = '';
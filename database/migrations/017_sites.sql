@@ -0,0 +1,32 @@
+-- Sites of a study, e.g. the hospitals a multi-site study runs at.
+-- alert_topic is the topic the site's clinicians subscribe to, empty sends
+-- the site's alerts to the default alert topic.
+CREATE TABLE IF NOT EXISTS sites (
+    study_id    TEXT NOT NULL,
+    site_id     TEXT NOT NULL,
+    name        TEXT NOT NULL DEFAULT '',
+    alert_topic TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (study_id, site_id)
+);
+
+-- Participants belong to at most one site of their study. Participants
+-- without a site are only seen by coordinators that are not scoped to sites.
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS site_id TEXT;
+
+-- Sites a coordinator works at. A coordinator without rows sees every site
+-- of the study.
+CREATE TABLE IF NOT EXISTS coordinator_sites (
+    coordinator_id BIGINT NOT NULL,
+    study_id       TEXT   NOT NULL,
+    site_id        TEXT   NOT NULL,
+    PRIMARY KEY (coordinator_id, site_id),
+    FOREIGN KEY (study_id, site_id) REFERENCES sites (study_id, site_id) ON DELETE CASCADE
+);
+
+-- the site of the participant when the alert was raised, NULL for
+-- participants without a site
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS site_id TEXT;
+CREATE INDEX IF NOT EXISTS alerts_study_site_idx ON alerts (study_id, site_id, status);
+
+-- secondary contacts of one site, NULL are contacts for the whole study
+ALTER TABLE alert_contacts ADD COLUMN IF NOT EXISTS site_id TEXT;
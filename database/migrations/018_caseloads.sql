@@ -0,0 +1,26 @@
+-- Coordinator each participant is assigned to. Participants without a row
+-- are unassigned.
+CREATE TABLE IF NOT EXISTS caseload_assignments (
+    participant_id BIGINT      PRIMARY KEY,
+    study_id       TEXT        NOT NULL,
+    coordinator_id BIGINT      NOT NULL,
+    assigned_by    BIGINT      NOT NULL,
+    assigned_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS caseload_assignments_coordinator_idx ON caseload_assignments (study_id, coordinator_id);
+
+-- Every assignment, reassignment and unassignment. coordinator_id is NULL
+-- when the participant was unassigned, previous_coordinator_id when it was
+-- not assigned before.
+CREATE TABLE IF NOT EXISTS caseload_events (
+    event_id                BIGSERIAL   PRIMARY KEY,
+    participant_id          BIGINT      NOT NULL,
+    study_id                TEXT        NOT NULL,
+    coordinator_id          BIGINT,
+    previous_coordinator_id BIGINT,
+    actor_id                BIGINT      NOT NULL,
+    created_at              TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS caseload_events_participant_idx ON caseload_events (participant_id);
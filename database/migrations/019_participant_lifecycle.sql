@@ -0,0 +1,19 @@
+-- Lifecycle state of every participant. Participants enrolled before the
+-- states existed are active, new participants start in enrollment.
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS lifecycle_state TEXT NOT NULL DEFAULT 'active'
+    CHECK (lifecycle_state IN ('enrollment', 'active', 'withdrawn', 'completed'));
+ALTER TABLE participants ALTER COLUMN lifecycle_state SET DEFAULT 'enrollment';
+
+-- Every change of a participant's lifecycle state with the reason given for it
+CREATE TABLE IF NOT EXISTS participant_state_events (
+    event_id       BIGSERIAL   PRIMARY KEY,
+    participant_id BIGINT      NOT NULL,
+    study_id       TEXT        NOT NULL,
+    from_state     TEXT        NOT NULL,
+    to_state       TEXT        NOT NULL,
+    reason         TEXT        NOT NULL,
+    actor_id       BIGINT      NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS participant_state_events_participant_idx ON participant_state_events (participant_id);
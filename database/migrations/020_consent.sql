@@ -0,0 +1,31 @@
+-- Versioned consent documents of a study. A version is a draft until it is
+-- published, the latest published version is the one participants sign.
+-- document_hash is the sha256 of the body, a published body never changes.
+CREATE TABLE IF NOT EXISTS consent_documents (
+    study_id      TEXT        NOT NULL REFERENCES studies (study_id),
+    version       INTEGER     NOT NULL CHECK (version > 0),
+    title         TEXT        NOT NULL,
+    body          TEXT        NOT NULL,
+    document_hash TEXT        NOT NULL,
+    created_by    BIGINT      NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    published_at  TIMESTAMPTZ,
+    PRIMARY KEY (study_id, version)
+);
+
+-- Signature of one participant on one version with the typed name, the
+-- address it was sent from and the hash of the document that was signed
+CREATE TABLE IF NOT EXISTS consent_signatures (
+    signature_id   BIGSERIAL   PRIMARY KEY,
+    participant_id BIGINT      NOT NULL,
+    study_id       TEXT        NOT NULL,
+    version        INTEGER     NOT NULL,
+    typed_name     TEXT        NOT NULL,
+    ip_address     TEXT        NOT NULL,
+    document_hash  TEXT        NOT NULL,
+    signed_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (participant_id, study_id, version),
+    FOREIGN KEY (study_id, version) REFERENCES consent_documents (study_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS consent_signatures_study_idx ON consent_signatures (study_id, version);
@@ -0,0 +1,3 @@
+-- Messages carrying credentials. Their bodies are cleared once the message
+-- was sent or failed for good so passwords do not stay in the outbox.
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS sensitive BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,8 @@
+-- Secondary contacts an escalated alert was sent to, so a contact is never
+-- texted twice for the same alert.
+CREATE TABLE IF NOT EXISTS alert_escalation_deliveries (
+    alert_id BIGINT      NOT NULL REFERENCES alerts (alert_id),
+    phone    TEXT        NOT NULL,
+    sent_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (alert_id, phone)
+);
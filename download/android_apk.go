@@ -8,25 +8,24 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cliffordlab/amoss_services/studies"
 )
 
 type APKDownloadHandler struct {
 	Name string
-	Svc  *s3.S3
+	// study whose apk_key is served
+	Study string
+	Svc   *s3.S3
 }
 
 func (U APKDownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Serving AMoSS APK " + U.Name)
 
-	var key string
-
-	switch U.Name {
-	case "Download UTSW handler":
-		key = "moyo-utsw-v1.0.0.0.apk"
-	case "Download MSM handler":
-		key = "amoss-moyo-release.apk"
-	case "Download HF handler":
-		key = "amoss-hf-release-v1.0.0.0.apk"
+	key, err := studies.APKKey(U.Study)
+	if err != nil || key == "" {
+		log.Printf("no apk for study %s\n", U.Study)
+		http.Error(w, "No app to download", http.StatusNotFound)
+		return
 	}
 
 	log.Println("key: " + key)
@@ -0,0 +1,400 @@
+package enrollment
+
+import (
+	"crypto/aes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/cryptography"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/mathb"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/cliffordlab/amoss_services/studies"
+	"github.com/cliffordlab/amoss_services/support"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// MaxRows largest file accepted in one import
+	MaxRows = 2000
+
+	passwordLength = 12
+	saltLength     = 58
+
+	selectExistingID    = `SELECT EXISTS(SELECT 1 FROM participants WHERE participant_id = $1)`
+	selectExistingEmail = `SELECT EXISTS(SELECT 1 FROM participants WHERE email_hash = $1)`
+	// imports running at the same time would not see each other's emails
+	lockImports   = `SELECT pg_advisory_xact_lock(hashtext('enrollment_import'))`
+	insertPatient = `INSERT INTO participants (participant_id, password_hash, password_salt, capacity_id, study_id, site_id,
+encrypted_email, encryption_iv, email_hash, encrypted_phone, phone_iv, locale)
+VALUES ($1, $2, $3, (SELECT capacity_id FROM participant_capacity WHERE capacity_id = 'patient'),
+(SELECT study_id FROM studies WHERE study_id = $4), NULLIF($5, ''), $6, $7, NULLIF($8, ''), $9, $10, NULLIF($11, ''))`
+)
+
+// Columns of the csv. Only participant_id and the contact columns may be
+// left empty, study too when a coordinator imports into their own study.
+var Columns = []string{"participant_id", "study", "site", "email", "phone", "language"}
+
+var (
+	// ErrInvalidRows returned when any row of the file is invalid, nothing is created
+	ErrInvalidRows = errors.New("invalid rows")
+
+	emailPattern    = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	phonePattern    = regexp.MustCompile(`^\+?[0-9]{10,15}$`)
+	languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+)
+
+// Options of an import. Study and CoordinatorID are set for coordinators,
+// who only enroll into their own study and at their sites.
+type Options struct {
+	Study           string
+	CoordinatorID   int64
+	SendCredentials bool
+	DryRun          bool
+}
+
+// RowError problem with one cell of the file. Row counts the data rows from
+// 1, the header is not counted. Column is empty for problems with the row.
+type RowError struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column"`
+	Message string `json:"message"`
+}
+
+// Enrolled participant created from one row. Password is only returned
+// when no credentials email was queued for it.
+type Enrolled struct {
+	Row               int    `json:"row"`
+	ParticipantID     int64  `json:"participantID"`
+	Login             string `json:"login"`
+	Study             string `json:"study"`
+	Site              string `json:"site"`
+	CredentialsQueued bool   `json:"credentialsQueued"`
+	Password          string `json:"password,omitempty"`
+}
+
+// row one validated participant of the file
+type row struct {
+	number   int
+	login    string
+	id       int64
+	study    string
+	site     string
+	email    string
+	phone    string
+	language string
+}
+
+// Import validates every row of the csv and, when all are valid, creates the
+// participants in one transaction. With DryRun the file is only validated.
+// ErrInvalidRows is returned with the problems of every row.
+func Import(r io.Reader, opts Options) ([]Enrolled, []RowError, error) {
+	rows, rowErrors, err := parse(r, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rowErrors) > 0 {
+		return nil, rowErrors, ErrInvalidRows
+	}
+	enrolled := make([]Enrolled, len(rows))
+	for i, rw := range rows {
+		enrolled[i] = Enrolled{Row: rw.number, ParticipantID: rw.id, Login: rw.login, Study: rw.study, Site: rw.site}
+	}
+	if opts.DryRun {
+		return enrolled, nil, nil
+	}
+	rowErrors, err = create(rows, enrolled, opts.SendCredentials)
+	if err != nil {
+		return nil, rowErrors, err
+	}
+	return enrolled, nil, nil
+}
+
+// parse reads and validates the whole file before anything is written
+func parse(r io.Reader, opts Options) ([]row, []RowError, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, []RowError{{Message: "the file is empty"}}, nil
+	}
+	if err != nil {
+		return nil, []RowError{{Message: err.Error()}}, nil
+	}
+	index, headerErrors := columnIndex(header)
+	if len(headerErrors) > 0 {
+		return nil, headerErrors, nil
+	}
+
+	var rows []row
+	var rowErrors []RowError
+	ids := map[int64]int{}
+	emails := map[string]int{}
+	for number := 1; ; number++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, RowError{Row: number, Message: err.Error()})
+			continue
+		}
+		if number > MaxRows {
+			return nil, []RowError{{Message: "the file has more than " + strconv.Itoa(MaxRows) + " rows"}}, nil
+		}
+		cell := func(column string) string {
+			return strings.TrimSpace(record[index[column]])
+		}
+		rw := row{number: number, login: cell("participant_id"), study: cell("study"), site: cell("site"),
+			email: cell("email"), phone: cell("phone"), language: cell("language")}
+		problems := validate(&rw, opts)
+
+		if rw.id != 0 {
+			if first, ok := ids[rw.id]; ok {
+				problems = append(problems, RowError{Column: "participant_id", Message: "same participant as row " + strconv.Itoa(first)})
+			} else {
+				ids[rw.id] = number
+			}
+		}
+		if rw.email != "" {
+			email := strings.ToLower(rw.email)
+			if first, ok := emails[email]; ok {
+				problems = append(problems, RowError{Column: "email", Message: "same email as row " + strconv.Itoa(first)})
+			} else {
+				emails[email] = number
+			}
+		}
+		for _, p := range problems {
+			p.Row = number
+			rowErrors = append(rowErrors, p)
+		}
+		rows = append(rows, rw)
+	}
+	if len(rows) == 0 && len(rowErrors) == 0 {
+		return nil, []RowError{{Message: "the file has no participants"}}, nil
+	}
+	if len(rowErrors) > 0 {
+		return nil, rowErrors, nil
+	}
+
+	// ids are generated once the file is known to be valid so they cannot
+	// collide with ids further down the file
+	for i := range rows {
+		if rows[i].id != 0 {
+			continue
+		}
+		login, id, err := uniqueID(ids)
+		if err != nil {
+			return nil, nil, err
+		}
+		rows[i].login, rows[i].id = login, id
+		ids[id] = rows[i].number
+	}
+	return rows, nil, nil
+}
+
+func columnIndex(header []string) (map[string]int, []RowError) {
+	index := map[string]int{}
+	var problems []RowError
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, column := range Columns {
+			known = known || column == name
+		}
+		if !known {
+			problems = append(problems, RowError{Column: name, Message: "unknown column, expected " + strings.Join(Columns, ", ")})
+			continue
+		}
+		if _, ok := index[name]; ok {
+			problems = append(problems, RowError{Column: name, Message: "column appears twice"})
+			continue
+		}
+		index[name] = i
+	}
+	for _, column := range Columns {
+		if _, ok := index[column]; !ok {
+			problems = append(problems, RowError{Column: column, Message: "column is missing"})
+		}
+	}
+	return index, problems
+}
+
+// validate checks one row against the database, the id is padded to ten
+// digits like the ids of /api/createPatient
+func validate(rw *row, opts Options) []RowError {
+	var problems []RowError
+
+	if rw.login != "" {
+		short, err := strconv.ParseInt(rw.login, 10, 64)
+		if err != nil || short <= 0 || len(rw.login) > 10 {
+			problems = append(problems, RowError{Column: "participant_id", Message: "must be a number of up to 10 digits"})
+		} else {
+			rw.id = padID(short)
+			var exists bool
+			if err := database.ADB.Db.QueryRow(selectExistingID, rw.id).Scan(&exists); err != nil {
+				log.Println(err)
+				problems = append(problems, RowError{Column: "participant_id", Message: "could not be checked"})
+			} else if exists {
+				problems = append(problems, RowError{Column: "participant_id", Message: "participant already exists"})
+			}
+		}
+	}
+
+	if rw.study == "" {
+		rw.study = opts.Study
+	}
+	switch {
+	case rw.study == "":
+		problems = append(problems, RowError{Column: "study", Message: "is required"})
+	case opts.Study != "" && rw.study != opts.Study:
+		problems = append(problems, RowError{Column: "study", Message: "coordinators only enroll into their own study"})
+	default:
+		enrolling, err := studies.Enrolling(rw.study)
+		if err != nil {
+			log.Println(err)
+		}
+		if !enrolling {
+			problems = append(problems, RowError{Column: "study", Message: "study does not exist or is not enrolling"})
+		} else if site, ok := sites.EnrollmentSite(rw.study, opts.CoordinatorID, rw.site); !ok {
+			problems = append(problems, RowError{Column: "site", Message: "site invalid or not one of the coordinator's sites"})
+		} else {
+			rw.site = site
+		}
+	}
+
+	if rw.email == "" && opts.SendCredentials {
+		problems = append(problems, RowError{Column: "email", Message: "is required to send credentials"})
+	} else if rw.email != "" && !emailPattern.MatchString(rw.email) {
+		problems = append(problems, RowError{Column: "email", Message: "is not an email address"})
+	} else if rw.email != "" {
+		var exists bool
+		if err := database.ADB.Db.QueryRow(selectExistingEmail, cryptography.HashEmail(rw.email)).Scan(&exists); err != nil {
+			log.Println(err)
+			problems = append(problems, RowError{Column: "email", Message: "could not be checked"})
+		} else if exists {
+			problems = append(problems, RowError{Column: "email", Message: "participant with this email already exists"})
+		}
+	}
+	rw.phone = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(rw.phone)
+	if rw.phone != "" && !phonePattern.MatchString(rw.phone) {
+		problems = append(problems, RowError{Column: "phone", Message: "must have 10 to 15 digits"})
+	}
+	if rw.language != "" && !languagePattern.MatchString(rw.language) {
+		problems = append(problems, RowError{Column: "language", Message: "must be a language code like en or es-MX"})
+	}
+	return problems
+}
+
+// padID appends zeros until the id has ten digits
+func padID(id int64) int64 {
+	for id < 1000000000 {
+		id *= 10
+	}
+	return id
+}
+
+// uniqueID generates a six digit login like /api/getUniqueID whose padded id
+// is neither in the file nor in the database
+func uniqueID(taken map[int64]int) (string, int64, error) {
+	for {
+		short := mathb.RandInt(100000, 999999)
+		id := padID(short)
+		if _, ok := taken[id]; ok {
+			continue
+		}
+		var exists bool
+		if err := database.ADB.Db.QueryRow(selectExistingID, id).Scan(&exists); err != nil {
+			return "", 0, err
+		}
+		if !exists {
+			return strconv.FormatInt(short, 10), id, nil
+		}
+	}
+}
+
+// create inserts every participant and queues their credentials in one
+// transaction, a failing row rolls back the whole file. Emails enrolled since
+// the file was validated are returned as row errors with ErrInvalidRows.
+func create(rows []row, enrolled []Enrolled, sendCredentials bool) ([]RowError, error) {
+	key := []byte(capacity.CryptoKey)
+	src := mathb.CryptoSource{}
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(lockImports); err != nil {
+		return nil, err
+	}
+	var rowErrors []RowError
+	for _, rw := range rows {
+		if rw.email == "" {
+			continue
+		}
+		var exists bool
+		if err := tx.QueryRow(selectExistingEmail, cryptography.HashEmail(rw.email)).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if exists {
+			rowErrors = append(rowErrors, RowError{Row: rw.number, Column: "email", Message: "participant with this email already exists"})
+		}
+	}
+	if len(rowErrors) > 0 {
+		return rowErrors, ErrInvalidRows
+	}
+
+	for i, rw := range rows {
+		password := mathb.RandString(passwordLength, src)
+		salt := mathb.RandString(saltLength, src)
+		hash, err := bcrypt.GenerateFromPassword([]byte(salt+password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+
+		var encryptedEmail, emailIV, encryptedPhone, phoneIV []byte
+		var emailHash string
+		if rw.email != "" {
+			emailHash = cryptography.HashEmail(rw.email)
+			emailIV = make([]byte, aes.BlockSize)
+			if encryptedEmail, err = cryptography.Encrypt(key, []byte(rw.email), emailIV); err != nil {
+				return nil, err
+			}
+		}
+		if rw.phone != "" {
+			phoneIV = make([]byte, aes.BlockSize)
+			if encryptedPhone, err = cryptography.Encrypt(key, []byte(rw.phone), phoneIV); err != nil {
+				return nil, err
+			}
+		}
+
+		_, err = tx.Exec(insertPatient, rw.id, string(hash), salt, rw.study, rw.site,
+			encryptedEmail, emailIV, emailHash, encryptedPhone, phoneIV, rw.language)
+		if err != nil {
+			log.Printf("failed to enroll row %d\n", rw.number)
+			return nil, err
+		}
+
+		if sendCredentials {
+			if err := support.QueueCredentialsEmail(tx, rw.study, rw.language, rw.login, password, rw.email); err != nil {
+				log.Printf("failed to queue credentials of row %d\n", rw.number)
+				return nil, err
+			}
+			enrolled[i].CredentialsQueued = true
+		} else {
+			enrolled[i].Password = password
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	log.Printf("Enrolled %d participants\n", len(rows))
+	return nil, nil
+}
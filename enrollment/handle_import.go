@@ -0,0 +1,80 @@
+package enrollment
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+)
+
+const (
+	maxFileSize     = 5 << 20
+	notAllowedErr   = `{"error":"only admins and coordinators can enroll participants"}`
+	importFailedErr = `{"error":"unable to enroll participants, nobody was enrolled"}`
+)
+
+// ImportHandler enrolls the participants of a csv file sent as the body.
+// Admins enroll into any study, coordinators into their own study at their
+// sites. The whole file is validated first and row errors return 422.
+// POST /api/participants/import[?sendCredentials=true][&dryRun=true]
+type ImportHandler struct {
+	Name string
+}
+
+// ImportResponse participants of an import, on a dry run the participants
+// that would be created
+type ImportResponse struct {
+	DryRun   bool       `json:"dryRun"`
+	Enrolled []Enrolled `json:"enrolled"`
+}
+
+func (h ImportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "HTTP Method needs to be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	opts := Options{
+		SendCredentials: r.URL.Query().Get("sendCredentials") == "true",
+		DryRun:          r.URL.Query().Get("dryRun") == "true",
+	}
+	switch claims.Capacity {
+	case "admin":
+	case "coordinator":
+		opts.Study = claims.Study
+		opts.CoordinatorID = claims.ID
+	default:
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(notAllowedErr))
+		return
+	}
+
+	log.Printf("Importing participants for %d...\n", claims.ID)
+	enrolled, rowErrors, err := Import(http.MaxBytesReader(w, r.Body, maxFileSize), opts)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	if err == ErrInvalidRows {
+		body, _ := json.Marshal(map[string]interface{}{"error": "invalid rows", "rows": rowErrors})
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write(body)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(importFailedErr))
+		return
+	}
+	body, _ := json.Marshal(ImportResponse{DryRun: opts.DryRun, Enrolled: enrolled})
+	if opts.DryRun {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(body)
+}
@@ -0,0 +1,100 @@
+package file_catalog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	insertFile = `INSERT INTO files
+(participant_id, study_id, week_millis, s3_key, extension, size_bytes, checksum, etag, content_type, uploaded_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (s3_key) DO UPDATE SET size_bytes = EXCLUDED.size_bytes, checksum = EXCLUDED.checksum,
+etag = EXCLUDED.etag, content_type = EXCLUDED.content_type, uploaded_at = EXCLUDED.uploaded_at`
+)
+
+// File row of the files table describing one object in the bucket
+type File struct {
+	ParticipantID int64     `json:"participantID"`
+	Study         string    `json:"study"`
+	WeekMillis    string    `json:"weekMillis"`
+	Key           string    `json:"key"`
+	Size          int64     `json:"size"`
+	Checksum      string    `json:"checksum"`
+	ETag          string    `json:"etag"`
+	ContentType   string    `json:"contentType"`
+	UploadedAt    time.Time `json:"uploadedAt"`
+}
+
+// Extension lower case file extension of the key without the dot
+func (f File) Extension() string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(f.Key), "."))
+}
+
+// RecordFile inserts the file into the catalog. Uploading the same key twice
+// replaces the size, checksum and upload time of the existing row.
+func RecordFile(f File) error {
+	if f.UploadedAt.IsZero() {
+		f.UploadedAt = time.Now().UTC()
+	}
+	_, err := database.ADB.Db.Exec(insertFile, f.ParticipantID, f.Study, f.WeekMillis, f.Key, f.Extension(),
+		f.Size, f.Checksum, f.ETag, f.ContentType, f.UploadedAt)
+	if err != nil {
+		log.Printf("failed to record file %s in catalog: %s\n", f.Key, err.Error())
+		return err
+	}
+	log.Printf("Recorded file in catalog {Key: %s, Size: %d}\n", f.Key, f.Size)
+	return nil
+}
+
+// Describe computes the sha256 checksum and size of the body and rewinds it
+// so it can still be sent to s3
+func Describe(body io.ReadSeeker) (checksum string, size int64, err error) {
+	h := sha256.New()
+	size, err = io.Copy(h, body)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err = body.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// ParseKey recovers participant, study and week from a key written with the
+// setKey layout: [dev/|test/]prefix/participantID/weekMillis/filename.
+// prefixes maps the s3 folder of each study to the study id, the longest
+// matching folder wins and an unknown folder is taken as the study id.
+func ParseKey(key string, prefixes map[string]string) (File, bool) {
+	rest := key
+	if strings.HasPrefix(rest, "dev/") || strings.HasPrefix(rest, "test/") {
+		rest = rest[strings.Index(rest, "/")+1:]
+	}
+	var folder, study string
+	for prefix, id := range prefixes {
+		if strings.HasPrefix(rest, prefix+"/") && len(prefix) > len(folder) {
+			folder, study = prefix, id
+		}
+	}
+	if folder == "" {
+		folder = strings.Split(rest, "/")[0]
+		study = folder
+	}
+	parts := strings.Split(strings.TrimPrefix(rest, folder+"/"), "/")
+	if folder == "" || len(parts) < 3 {
+		return File{}, false
+	}
+	ptid, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return File{}, false
+	}
+	return File{ParticipantID: ptid, Study: study, WeekMillis: parts[1], Key: key}, true
+}
@@ -0,0 +1,138 @@
+package file_catalog
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	errorResJSON = `{"error":"json parsing error","error description":"key or value of json is formatted incorrectly"}`
+	queryFiles   = `SELECT extension, COUNT(*), COALESCE(SUM(size_bytes), 0) FROM files
+WHERE ($1::bigint = 0 OR participant_id = $1)
+AND ($2 = '' OR study_id = $2)
+AND ($3 = '' OR extension = $3)
+AND uploaded_at BETWEEN $4 AND $5
+GROUP BY extension ORDER BY extension`
+)
+
+// FileQueryHandler counts and sizes files in the catalog
+type FileQueryHandler struct {
+	Name string
+}
+
+// FileQueryRequest payload for time of query needed. StartTime and EndTime are
+// unix timestamps in milliseconds, an empty value leaves that end of the range open.
+type FileQueryRequest struct {
+	ParticipantID int64  `json:"participantID"`
+	Study         string `json:"study"`
+	Type          string `json:"type"`
+	StartTime     string `json:"startTime"`
+	EndTime       string `json:"endTime"`
+}
+
+// TypeSummary count and total size of the files of one type
+type TypeSummary struct {
+	Type  string `json:"type"`
+	Count int64  `json:"count"`
+	Size  int64  `json:"size"`
+}
+
+// FileQueryResponse totals for the query and the breakdown by file type
+type FileQueryResponse struct {
+	Count int64         `json:"count"`
+	Size  int64         `json:"size"`
+	Types []TypeSummary `json:"types"`
+}
+
+func (fh FileQueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Mars")
+	if err != nil {
+		claims, _, err = capacity.ClaimsFromHeader(r, "Bearer")
+	}
+	if err != nil {
+		log.Println("unable to parse with claims")
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var fqr FileQueryRequest
+	if err := dec.Decode(&fqr); err != nil {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.Write([]byte(errorResJSON))
+		return
+	}
+
+	// participants can only see their own files, coordinators their own study
+	switch claims.Capacity {
+	case "coordinator":
+		fqr.Study = claims.Study
+	default:
+		fqr.ParticipantID = claims.ID
+		fqr.Study = claims.Study
+	}
+
+	from, to, ok := parseRange(fqr.StartTime, fqr.EndTime)
+	if !ok {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"startTime and endTime must be unix millis"}`))
+		return
+	}
+
+	rows, err := database.ADB.Db.Query(queryFiles, fqr.ParticipantID, fqr.Study, fqr.Type, from, to)
+	if err != nil {
+		log.Println("failed to execute file query")
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"Unable to complete query"}`))
+		return
+	}
+	defer rows.Close()
+
+	response := FileQueryResponse{Types: []TypeSummary{}}
+	for rows.Next() {
+		var ts TypeSummary
+		if err := rows.Scan(&ts.Type, &ts.Count, &ts.Size); err != nil {
+			log.Println("failed to scan file summary row")
+			log.Println(err)
+			continue
+		}
+		response.Count += ts.Count
+		response.Size += ts.Size
+		response.Types = append(response.Types, ts)
+	}
+
+	resultsJSON, _ := json.Marshal(response)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resultsJSON)
+}
+
+func parseRange(start string, end string) (time.Time, time.Time, bool) {
+	from := time.Unix(0, 0).UTC()
+	to := time.Now().UTC().Add(time.Hour * 24)
+	if start != "" {
+		ms, err := strconv.ParseInt(start, 10, 64)
+		if err != nil {
+			return from, to, false
+		}
+		from = time.Unix(0, ms*int64(time.Millisecond)).UTC()
+	}
+	if end != "" {
+		ms, err := strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			return from, to, false
+		}
+		to = time.Unix(0, ms*int64(time.Millisecond)).UTC()
+	}
+	return from, to, true
+}
@@ -0,0 +1,41 @@
+package file_catalog
+
+import (
+	"io"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Upload puts the body in the bucket under f.Key and records the object in the
+// catalog once s3 accepted it. A failure to record is logged but does not fail
+// the upload since the object is already stored.
+func Upload(svc *s3.S3, bucket string, f File, body io.ReadSeeker) (*s3.PutObjectOutput, error) {
+	checksum, size, err := Describe(body)
+	if err != nil {
+		log.Printf("failed to read %s before upload: %s\n", f.Key, err.Error())
+		return &s3.PutObjectOutput{}, err
+	}
+	f.Checksum = checksum
+	f.Size = size
+
+	input := &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &f.Key,
+		Body:   body,
+	}
+	if f.ContentType != "" {
+		input.ContentType = aws.String(f.ContentType)
+	}
+	uploadResult, err := svc.PutObject(input)
+	if err != nil {
+		return uploadResult, err
+	}
+	if uploadResult.ETag != nil {
+		f.ETag = strings.Trim(*uploadResult.ETag, `"`)
+	}
+	RecordFile(f)
+	return uploadResult, nil
+}
@@ -42,7 +42,25 @@ func HandleReq(h http.Handler) http.Handler {
 	})
 }
 
+//HandleReqWithBearerToken wrapper for requests of coordinators
 func HandleReqWithBearerToken(h http.Handler) http.Handler {
+	return handleReqWithCapacity(h, "coordinator")
+}
+
+//HandleReqWithAdminToken wrapper for requests of admins
+func HandleReqWithAdminToken(h http.Handler) http.Handler {
+	return handleReqWithCapacity(h, "admin")
+}
+
+//HandleReqWithAdminOrCoordinatorToken wrapper for requests admins and
+//coordinators both make, the handler tells them apart by the claims
+func HandleReqWithAdminOrCoordinatorToken(h http.Handler) http.Handler {
+	return handleReqWithCapacity(h, "admin", "coordinator")
+}
+
+// handleReqWithCapacity serves requests with a valid bearer token of one of
+// the capacities
+func handleReqWithCapacity(h http.Handler, capacities ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Stop here if its Preflighted OPTIONS request
 		if r.Method == "OPTIONS" {
@@ -80,7 +98,7 @@ func HandleReqWithBearerToken(h http.Handler) http.Handler {
 		}
 
 		if claims, ok := token.Claims.(*capacity.NonAdminClaims); ok && token.Valid {
-			if claims.Capacity == "coordinator" {
+			if allowed(claims.Capacity, capacities) {
 				h.ServeHTTP(w, r)
 			} else {
 				log.Println("token not valid")
@@ -98,3 +116,12 @@ func HandleReqWithBearerToken(h http.Handler) http.Handler {
 		log.Printf("%s request latency: %d\n", h, (after - before))
 	})
 }
+
+func allowed(capacity string, capacities []string) bool {
+	for _, c := range capacities {
+		if c == capacity {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	TypeJPEG = "jpeg"
+	TypeCSV  = "csv"
+	TypeWAV  = "wav"
+	TypeFIT  = "fit"
+	TypeJSON = "json"
+	TypePDF  = "pdf"
+
+	maxFilenameLength = 200
+	sniffLength       = 512
+
+	selectStudyFileTypes = `SELECT file_type FROM study_file_types WHERE study_id = $1`
+)
+
+var (
+	// ErrInvalidFilename returned when nothing usable is left of the client filename
+	ErrInvalidFilename = errors.New("invalid filename")
+	// ErrUnknownType returned when the content matches none of the known formats
+	ErrUnknownType = errors.New("unrecognised file format")
+	// ErrInvalidPath returned when a client path leaves the participant's namespace
+	ErrInvalidPath = errors.New("path outside of participant folder")
+
+	contentTypes = map[string]string{
+		TypeJPEG: "image/jpeg",
+		TypeCSV:  "text/csv",
+		TypeWAV:  "audio/wav",
+		TypeFIT:  "application/vnd.ant.fit",
+		TypeJSON: "application/json",
+		TypePDF:  "application/pdf",
+	}
+
+	// extensions maps the file extensions the apps use to the detected type
+	extensions = map[string]string{
+		"jpg":  TypeJPEG,
+		"jpeg": TypeJPEG,
+		"csv":  TypeCSV,
+		"txt":  TypeCSV,
+		"wav":  TypeWAV,
+		"fit":  TypeFIT,
+		"json": TypeJSON,
+		"pdf":  TypePDF,
+	}
+)
+
+// Checked result of validating one uploaded file
+type Checked struct {
+	Filename    string
+	Type        string
+	ContentType string
+}
+
+// SanitizeFilename keeps only the last element of the client filename and
+// replaces every character outside [A-Za-z0-9._-] with an underscore
+func SanitizeFilename(name string) (string, error) {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	var b strings.Builder
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	clean := strings.TrimLeft(b.String(), ".")
+	if clean == "" || strings.Trim(clean, "_") == "" {
+		return "", ErrInvalidFilename
+	}
+	if len(clean) > maxFilenameLength {
+		clean = clean[len(clean)-maxFilenameLength:]
+	}
+	return clean, nil
+}
+
+// Sniff detects the file format from its first bytes and rewinds the body
+func Sniff(body io.ReadSeeker) (string, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return detect(head, n < sniffLength), nil
+}
+
+// detect the format of head, complete when head holds the whole file
+func detect(head []byte, complete bool) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return TypeJPEG
+	case len(head) >= 12 && bytes.Equal(head[0:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WAVE")):
+		return TypeWAV
+	case len(head) >= 12 && (head[0] == 12 || head[0] == 14) && bytes.Equal(head[8:12], []byte(".FIT")):
+		return TypeFIT
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return TypePDF
+	}
+
+	text := bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF"))
+	if len(text) == 0 || bytes.IndexByte(text, 0) >= 0 || !validUTF8Prefix(text) {
+		return ""
+	}
+	trimmed := bytes.TrimLeft(text, " \t\r\n")
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return TypeJSON
+	}
+	if delimited(string(text), complete) {
+		return TypeCSV
+	}
+	return ""
+}
+
+// delimited reports whether every line of text splits into the same number
+// of at least two fields on one of the usual delimiters. The last line is
+// left out when the sniffed window may have cut it.
+func delimited(text string, complete bool) bool {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	if !complete && len(lines) > 1 {
+		lines = lines[:len(lines)-1]
+	}
+	for _, delimiter := range []rune{',', ';', '\t'} {
+		columns := 0
+		consistent := true
+		for _, line := range lines {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			n := countFields(line, delimiter)
+			if columns == 0 {
+				columns = n
+			} else if n != columns {
+				consistent = false
+				break
+			}
+		}
+		if consistent && columns > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// countFields fields of one csv line, delimiters inside quotes do not count
+func countFields(line string, delimiter rune) int {
+	fields := 1
+	quoted := false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == delimiter && !quoted:
+			fields++
+		}
+	}
+	return fields
+}
+
+// validUTF8Prefix allows the sniffed window to cut a multi byte rune in half
+func validUTF8Prefix(b []byte) bool {
+	for i := 0; i < utf8.UTFMax && len(b) > 0; i++ {
+		if utf8.Valid(b) {
+			return true
+		}
+		b = b[:len(b)-1]
+	}
+	return utf8.Valid(b)
+}
+
+// TypeForFilename type implied by the extension of the filename
+func TypeForFilename(filename string) string {
+	return extensions[strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))]
+}
+
+// ContentType mime type for a detected file type
+func ContentType(fileType string) string {
+	return contentTypes[fileType]
+}
+
+// StudyAllows reports whether the study accepts the file type
+func StudyAllows(study string, fileType string) (bool, error) {
+	rows, err := database.ADB.Db.Query(selectStudyFileTypes, study)
+	if err != nil {
+		log.Println("failed to query study file types")
+		return false, err
+	}
+	defer rows.Close()
+
+	configured := false
+	for rows.Next() {
+		var allowed string
+		if err := rows.Scan(&allowed); err != nil {
+			return false, err
+		}
+		configured = true
+		if allowed == fileType {
+			return true, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	// studies without an allowlist accept every known type
+	return !configured && contentTypes[fileType] != "", nil
+}
+
+// CheckFilename sanitizes the filename and checks its extension against the
+// study allowlist. Used when the content itself never reaches the server.
+func CheckFilename(study string, filename string) (Checked, error) {
+	clean, err := SanitizeFilename(filename)
+	if err != nil {
+		return Checked{}, err
+	}
+	fileType := TypeForFilename(clean)
+	if fileType == "" {
+		return Checked{}, fmt.Errorf("%s: unsupported file extension", clean)
+	}
+	allowed, err := StudyAllows(study, fileType)
+	if err != nil {
+		return Checked{}, err
+	}
+	if !allowed {
+		return Checked{}, fmt.Errorf("%s: %s files are not accepted for this study", clean, fileType)
+	}
+	return Checked{Filename: clean, Type: fileType, ContentType: ContentType(fileType)}, nil
+}
+
+// Check sanitizes the filename, sniffs the content and makes sure the format
+// matches the extension and is accepted by the study
+func Check(study string, filename string, body io.ReadSeeker) (Checked, error) {
+	checked, err := CheckFilename(study, filename)
+	if err != nil {
+		return checked, err
+	}
+	sniffed, err := Sniff(body)
+	if err != nil {
+		return Checked{}, err
+	}
+	if sniffed == "" {
+		return Checked{}, fmt.Errorf("%s: %s", checked.Filename, ErrUnknownType.Error())
+	}
+	if sniffed != checked.Type {
+		return Checked{}, fmt.Errorf("%s: content is %s but extension is %s", checked.Filename, sniffed, checked.Type)
+	}
+	return checked, nil
+}
+
+// CheckFiles validates every file of a multipart upload before any of them is
+// sent to s3 so a request is either accepted or rejected as a whole
+func CheckFiles(study string, files []*multipart.FileHeader) ([]Checked, error) {
+	var checked []Checked
+	for _, fh := range files {
+		file, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		c, err := Check(study, fh.Filename, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		checked = append(checked, c)
+	}
+	return checked, nil
+}
+
+// ResolvePath restricts the client supplied folder to the participant's
+// namespace. Relative folders are placed under the namespace, folders that
+// already start with the namespace are kept, anything else is rejected.
+func ResolvePath(clientPath string, namespace string) (string, error) {
+	clientPath = strings.Replace(clientPath, "\\", "/", -1)
+	for _, segment := range strings.Split(clientPath, "/") {
+		if segment == ".." {
+			return "", ErrInvalidPath
+		}
+	}
+	cleaned := strings.Trim(path.Clean("/"+clientPath), "/")
+	if cleaned == "" || cleaned == namespace {
+		return namespace, nil
+	}
+	if strings.HasPrefix(cleaned, namespace+"/") {
+		return cleaned, nil
+	}
+	return namespace + "/" + cleaned, nil
+}
+
+// ErrorJSON body returned to the apps for a rejected upload
+func ErrorJSON(err error) string {
+	body, _ := json.Marshal(map[string]string{"error": "upload rejected", "error description": err.Error()})
+	return string(body)
+}
@@ -0,0 +1,61 @@
+package jobs
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/gorilla/mux"
+)
+
+const (
+	selectDeadJobs = `SELECT job_id, kind, payload::text, attempts, last_error, created_at::text, updated_at::text
+FROM dead_jobs ORDER BY updated_at DESC LIMIT 500`
+	requeueDeadJob = `UPDATE jobs SET status = 'queued', attempts = 0, run_at = now(), updated_at = now()
+WHERE job_id = $1 AND status = 'dead'`
+)
+
+// DeadJobsHandler lists jobs that failed permanently. Jobs of every study
+// are listed with their payloads, so it is routed for admin tokens only.
+// GET /api/jobs/dead lists them, POST /api/jobs/dead/{job_id} queues one again.
+type DeadJobsHandler struct {
+	Name string
+}
+
+func (h DeadJobsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rows, err := database.ADB.Db.Query(selectDeadJobs)
+		if err != nil {
+			log.Println("failed to query dead jobs")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"unable to list dead jobs"}`))
+			return
+		}
+		result := database.PgToJSON(rows)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusOK)
+		w.Write(result)
+	case "POST":
+		jobID := mux.Vars(r)["job_id"]
+		result, err := database.ADB.Db.Exec(requeueDeadJob, jobID)
+		if err != nil {
+			log.Println("failed to requeue dead job")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"unable to requeue job"}`))
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"no dead job with this id"}`))
+			return
+		}
+		log.Println("Requeued dead job " + jobID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.Write([]byte(`{"success":"job queued again"}`))
+	default:
+		http.Error(w, "HTTP Method needs to be GET or POST", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,220 @@
+package jobs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	pollInterval = 2 * time.Second
+	// a running job holds a lease renewed by its worker, a job whose lease
+	// expired belongs to a worker that died
+	leaseDuration  = 3 * time.Minute
+	leaseRenewal   = time.Minute
+	baseBackoff    = 30 * time.Second
+	maxBackoff     = time.Hour
+	maxErrorLength = 2000
+
+	insertJob = `INSERT INTO jobs (kind, payload) VALUES ($1, $2) RETURNING job_id`
+	claimJob  = `UPDATE jobs SET status = 'running', attempts = attempts + 1, locked_at = now(), updated_at = now()
+WHERE job_id = (SELECT job_id FROM jobs WHERE status = 'queued' AND run_at <= now()
+ORDER BY run_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+RETURNING job_id, kind, payload, attempts, max_attempts`
+	// the attempt of the claim fences off a worker whose lease was reclaimed
+	ownJob      = `job_id = $1 AND attempts = $2 AND status = 'running'`
+	renewLease  = `UPDATE jobs SET locked_at = now() WHERE ` + ownJob
+	completeJob = `UPDATE jobs SET status = 'done', locked_at = NULL, last_error = '', updated_at = now() WHERE ` + ownJob
+	retryJob    = `UPDATE jobs SET status = 'queued', locked_at = NULL, last_error = $3, run_at = $4, updated_at = now() WHERE ` + ownJob
+	buryJob     = `UPDATE jobs SET status = 'dead', locked_at = NULL, last_error = $3, updated_at = now() WHERE ` + ownJob
+	reclaimJobs = `UPDATE jobs SET status = 'queued', locked_at = NULL, updated_at = now()
+WHERE status = 'running' AND locked_at < $1`
+)
+
+// Handler processes the payload of one job. Returning an error retries the
+// job with backoff unless the error is Permanent.
+type Handler func(payload json.RawMessage) error
+
+// Job claimed row of the jobs table
+type Job struct {
+	ID          int64
+	Kind        string
+	Payload     json.RawMessage
+	Attempts    int
+	MaxAttempts int
+}
+
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+// Permanent marks an error that retrying cannot fix, the job goes straight
+// to the dead letter view
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+var (
+	handlersMutex sync.RWMutex
+	handlers      = map[string]Handler{}
+)
+
+// Register sets the handler for a kind of job. Must be called before StartWorkers.
+func Register(kind string, h Handler) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	handlers[kind] = h
+}
+
+// Enqueue adds a job to the queue. The payload is stored as json.
+func Enqueue(kind string, payload interface{}) (int64, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	var jobID int64
+	if err := database.ADB.Db.QueryRow(insertJob, kind, b).Scan(&jobID); err != nil {
+		log.Printf("failed to enqueue %s job: %s\n", kind, err.Error())
+		return 0, err
+	}
+	log.Printf("Enqueued job {ID: %d, Kind: %s}\n", jobID, kind)
+	return jobID, nil
+}
+
+// StartWorkers starts n goroutines polling the queue, and one reclaiming jobs
+// whose lease expired because their worker died
+func StartWorkers(n int) {
+	log.Printf("Starting %d job workers...\n", n)
+	for i := 0; i < n; i++ {
+		go work(i)
+	}
+	go reclaim()
+}
+
+func work(worker int) {
+	for {
+		job, err := claim()
+		if err == sql.ErrNoRows {
+			time.Sleep(pollInterval)
+			continue
+		}
+		if err != nil {
+			log.Printf("worker %d failed to claim job: %s\n", worker, err.Error())
+			time.Sleep(pollInterval)
+			continue
+		}
+		run(job)
+	}
+}
+
+func claim() (Job, error) {
+	var job Job
+	err := database.ADB.Db.QueryRow(claimJob).Scan(&job.ID, &job.Kind, &job.Payload, &job.Attempts, &job.MaxAttempts)
+	return job, err
+}
+
+func run(job Job) {
+	handlersMutex.RLock()
+	h, ok := handlers[job.Kind]
+	handlersMutex.RUnlock()
+
+	var err error
+	if !ok {
+		err = Permanent(errors.New("no handler registered for " + job.Kind))
+	} else {
+		done := make(chan struct{})
+		go holdLease(job, done)
+		err = safeCall(h, job.Payload)
+		close(done)
+	}
+
+	if err == nil {
+		if _, dbErr := database.ADB.Db.Exec(completeJob, job.ID, job.Attempts); dbErr != nil {
+			log.Printf("failed to complete job %d: %s\n", job.ID, dbErr.Error())
+		}
+		log.Printf("Job done {ID: %d, Kind: %s, Attempts: %d}\n", job.ID, job.Kind, job.Attempts)
+		return
+	}
+
+	message := err.Error()
+	if len(message) > maxErrorLength {
+		message = message[:maxErrorLength]
+	}
+	_, permanent := err.(permanentError)
+	if permanent || job.Attempts >= job.MaxAttempts {
+		log.Printf("Job dead {ID: %d, Kind: %s, Attempts: %d, Error: %s}\n", job.ID, job.Kind, job.Attempts, message)
+		if _, dbErr := database.ADB.Db.Exec(buryJob, job.ID, job.Attempts, message); dbErr != nil {
+			log.Printf("failed to bury job %d: %s\n", job.ID, dbErr.Error())
+		}
+		return
+	}
+	runAt := time.Now().UTC().Add(Backoff(job.Attempts))
+	log.Printf("Job failed, retrying at %s {ID: %d, Kind: %s, Attempts: %d, Error: %s}\n", runAt.Format(time.RFC3339), job.ID, job.Kind, job.Attempts, message)
+	if _, dbErr := database.ADB.Db.Exec(retryJob, job.ID, job.Attempts, message, runAt); dbErr != nil {
+		log.Printf("failed to reschedule job %d: %s\n", job.ID, dbErr.Error())
+	}
+}
+
+// holdLease renews the lease of a running job until done is closed
+func holdLease(job Job, done chan struct{}) {
+	ticker := time.NewTicker(leaseRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			result, err := database.ADB.Db.Exec(renewLease, job.ID, job.Attempts)
+			if err != nil {
+				log.Printf("failed to renew lease of job %d: %s\n", job.ID, err.Error())
+			} else if n, _ := result.RowsAffected(); n == 0 {
+				log.Printf("lost lease of job %d, it was reclaimed\n", job.ID)
+				return
+			}
+		}
+	}
+}
+
+// safeCall keeps a panicking handler from killing the worker
+func safeCall(h Handler, payload json.RawMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("job handler panic: %v\n", r)
+			err = errors.New("job handler panicked")
+		}
+	}()
+	return h(payload)
+}
+
+// Backoff delay before the next attempt: 30s doubling each attempt, capped at an hour
+func Backoff(attempts int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+func reclaim() {
+	for {
+		result, err := database.ADB.Db.Exec(reclaimJobs, time.Now().UTC().Add(-leaseDuration))
+		if err != nil {
+			log.Printf("failed to reclaim jobs with an expired lease: %s\n", err.Error())
+		} else if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf("Reclaimed %d jobs with an expired lease\n", n)
+		}
+		time.Sleep(leaseRenewal)
+	}
+}
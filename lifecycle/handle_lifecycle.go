@@ -0,0 +1,115 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/gorilla/mux"
+)
+
+const (
+	invalidBodyErr       = `{"error":"invalid request body"}`
+	noParticipantErr     = `{"error":"no such participant"}`
+	unknownStateErr      = `{"error":"state must be one of enrollment, active, withdrawn, completed"}`
+	invalidTransitionErr = `{"error":"participant cannot move from its current state to this state"}`
+	noReasonErr          = `{"error":"a reason is required"}`
+	transitionFailedErr  = `{"error":"unable to update participant state"}`
+)
+
+// StateHandler lifecycle state of a participant and its transitions. Admins
+// use the study in the path, coordinators their own study and only for
+// participants at their sites.
+// GET, POST /participants/{participant_id}/state with {"state": "withdrawn", "reason": "moved away"}
+// GET, POST /api/studies/{study_id}/participants/{participant_id}/state
+type StateHandler struct {
+	Name string
+}
+
+// TransitionRequest body of a transition
+type TransitionRequest struct {
+	State  string `json:"state"`
+	Reason string `json:"reason"`
+}
+
+func (h StateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	params := mux.Vars(r)
+	participantID, err := strconv.ParseInt(params["participant_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid participant id", http.StatusBadRequest)
+		return
+	}
+
+	study := claims.Study
+	if claims.Capacity == "admin" {
+		study = params["study_id"]
+	} else {
+		visible, err := sites.Visible(study, claims.ID, participantID)
+		if err != nil {
+			log.Println(err)
+		}
+		if !visible {
+			writeError(w, ErrNoParticipant)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var tr TransitionRequest
+		if err := json.NewDecoder(r.Body).Decode(&tr); err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(invalidBodyErr))
+			return
+		}
+		if err := Transition(study, participantID, tr.State, tr.Reason, claims.ID); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Participant %d moved to %s by %d\n", participantID, tr.State, claims.ID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := Get(study, participantID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resultsJSON, _ := json.Marshal(status)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resultsJSON)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	switch err {
+	case ErrNoParticipant:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(noParticipantErr))
+	case ErrUnknownState:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(unknownStateErr))
+	case ErrNoReason:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(noReasonErr))
+	case ErrInvalidTransition:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(invalidTransitionErr))
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(transitionFailedErr))
+	}
+}
@@ -0,0 +1,156 @@
+package lifecycle
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+// Lifecycle states of a participant
+const (
+	StateEnrollment = "enrollment"
+	StateActive     = "active"
+	StateWithdrawn  = "withdrawn"
+	StateCompleted  = "completed"
+)
+
+const (
+	selectState = `SELECT lifecycle_state FROM participants
+WHERE participant_id = $1 AND study_id = $2 AND capacity_id = 'patient'`
+	selectStateForUpdate = selectState + ` FOR UPDATE`
+	selectWithdrawn      = `SELECT lifecycle_state = 'withdrawn' FROM participants WHERE participant_id = $1`
+	updateState          = `UPDATE participants SET lifecycle_state = $3 WHERE participant_id = $1 AND study_id = $2`
+	insertEvent          = `INSERT INTO participant_state_events (participant_id, study_id, from_state, to_state, reason, actor_id)
+VALUES ($1, $2, $3, $4, $5, $6)`
+	selectEvents = `SELECT from_state, to_state, reason, actor_id, created_at FROM participant_state_events
+WHERE participant_id = $1 AND study_id = $2 ORDER BY created_at, event_id`
+)
+
+// transitions states each state may move to, withdrawn is final
+var transitions = map[string][]string{
+	StateEnrollment: {StateActive, StateWithdrawn},
+	StateActive:     {StateCompleted, StateWithdrawn},
+	StateCompleted:  {StateWithdrawn},
+	StateWithdrawn:  {},
+}
+
+var (
+	// ErrNoParticipant returned for a participant that is not a patient of the study
+	ErrNoParticipant = errors.New("no such participant")
+	// ErrUnknownState returned for a state that is not a lifecycle state
+	ErrUnknownState = errors.New("unknown lifecycle state")
+	// ErrInvalidTransition returned when the participant's state cannot move to the requested state
+	ErrInvalidTransition = errors.New("invalid lifecycle transition")
+	// ErrNoReason returned for a transition without a reason
+	ErrNoReason = errors.New("a reason is required")
+)
+
+// Event one change of a participant's state
+type Event struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+	ActorID   int64     `json:"actorID"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Status current state of a participant with the history of its transitions
+// and the states it may move to
+type Status struct {
+	ParticipantID int64    `json:"participantID"`
+	State         string   `json:"state"`
+	Allowed       []string `json:"allowed"`
+	Events        []Event  `json:"events"`
+}
+
+// Allowed reports whether a participant in state from may move to state to
+func Allowed(from string, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Withdrawn reports whether the participant withdrew from its study. A
+// failing query is logged and not treated as withdrawn.
+func Withdrawn(participantID int64) bool {
+	var withdrawn bool
+	err := database.ADB.Db.QueryRow(selectWithdrawn, participantID).Scan(&withdrawn)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("failed to read lifecycle state of participant %d: %s\n", participantID, err.Error())
+	}
+	return withdrawn
+}
+
+// Transition moves the participant to a new state and records the reason
+// and who made the change
+func Transition(study string, participantID int64, to string, reason string, actorID int64) error {
+	if _, ok := transitions[to]; !ok {
+		return ErrUnknownState
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return ErrNoReason
+	}
+
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from string
+	err = tx.QueryRow(selectStateForUpdate, participantID, study).Scan(&from)
+	if err == sql.ErrNoRows {
+		return ErrNoParticipant
+	}
+	if err != nil {
+		return err
+	}
+	if !Allowed(from, to) {
+		return ErrInvalidTransition
+	}
+	if _, err := tx.Exec(updateState, participantID, study, to); err != nil {
+		log.Println("failed to update lifecycle state")
+		return err
+	}
+	if _, err := tx.Exec(insertEvent, participantID, study, from, to, reason, actorID); err != nil {
+		log.Println("failed to insert lifecycle event")
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get state of a participant with its transitions
+func Get(study string, participantID int64) (Status, error) {
+	status := Status{ParticipantID: participantID, Allowed: []string{}, Events: []Event{}}
+	err := database.ADB.Db.QueryRow(selectState, participantID, study).Scan(&status.State)
+	if err == sql.ErrNoRows {
+		return status, ErrNoParticipant
+	}
+	if err != nil {
+		return status, err
+	}
+	status.Allowed = append(status.Allowed, transitions[status.State]...)
+
+	rows, err := database.ADB.Db.Query(selectEvents, participantID, study)
+	if err != nil {
+		log.Println("failed to query lifecycle events")
+		return status, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.From, &e.To, &e.Reason, &e.ActorID, &e.CreatedAt); err != nil {
+			return status, err
+		}
+		status.Events = append(status.Events, e)
+	}
+	return status, rows.Err()
+}
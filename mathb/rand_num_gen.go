@@ -1,6 +1,10 @@
 package mathb
 
-import "math/rand"
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+)
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const (
@@ -31,3 +35,19 @@ func RandString(n int, src rand.Source) string {
 func RandInt(min, max int64) int64 {
 	return min + rand.Int63n(max-min)
 }
+
+// CryptoSource rand.Source reading crypto/rand, for passwords and salts that
+// must not be predictable from the time they were generated
+type CryptoSource struct{}
+
+// Int63 63 random bits from crypto/rand
+func (CryptoSource) Int63() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) & (1<<63 - 1))
+}
+
+// Seed does nothing, crypto/rand cannot be seeded
+func (CryptoSource) Seed(int64) {}
@@ -0,0 +1,44 @@
+package messages
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/gorilla/mux"
+)
+
+// PreviewHandler renders a message with sample data for the coordinator's study.
+// GET /api/messages/{name}/preview[?locale=es]
+type PreviewHandler struct {
+	Name string
+}
+
+func (h PreviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	sample, ok := Sample(name)
+	if !ok {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"no such message"}`))
+		return
+	}
+
+	rendered, err := Render(claims.Study, r.URL.Query().Get("locale"), name, sample)
+	if err != nil {
+		log.Printf("failed to render preview of %s: %s\n", name, err.Error())
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"unable to render message"}`))
+		return
+	}
+	jsonObject, _ := json.Marshal(rendered)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.Write(jsonObject)
+}
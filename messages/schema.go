@@ -0,0 +1,79 @@
+package messages
+
+// Schema variables a message template may use. Templates referencing any
+// other variable are rejected at load time, Render rejects data missing one.
+// Sample is used by the coordinator preview.
+type Schema struct {
+	Vars   []string
+	Sample map[string]interface{}
+}
+
+// names of the messages sent by the server
+const (
+	Registration        = "registration"
+	Credentials         = "credentials"
+	AlertSevereBP       = "alert_severe_bp"
+	AlertMildBPRepeat   = "alert_mild_bp_repeat"
+	AlertPulseRange     = "alert_pulse_range"
+	AlertSymptoms       = "alert_symptoms"
+	AlertSymptomsWithBP = "alert_symptoms_with_bp"
+	Escalation          = "escalation"
+	ReminderVitals      = "reminder_vitals"
+	ReminderSymptoms    = "reminder_symptoms"
+)
+
+var symptomVars = []string{"BlurriedVision", "Headache", "DifficultyBreathing", "SidePain"}
+
+var schemas = map[string]Schema{
+	Registration: {
+		Vars:   []string{"Email", "MoyoID", "Password"},
+		Sample: map[string]interface{}{"Email": "participant@example.com", "MoyoID": int64(1234567890), "Password": "sample-password"},
+	},
+	Credentials: {
+		Vars:   []string{"Login", "Password"},
+		Sample: map[string]interface{}{"Login": "1234", "Password": "sample-password"},
+	},
+	AlertSevereBP: {
+		Vars:   []string{"ParticipantID", "SBP", "DBP", "Pulse"},
+		Sample: map[string]interface{}{"ParticipantID": int64(1234567890), "SBP": 165, "DBP": 112, "Pulse": 88},
+	},
+	AlertMildBPRepeat: {
+		Vars:   []string{"ParticipantID", "Count", "WindowHours", "SBP", "DBP"},
+		Sample: map[string]interface{}{"ParticipantID": int64(1234567890), "Count": 2, "WindowHours": 24, "SBP": 145, "DBP": 92},
+	},
+	AlertPulseRange: {
+		Vars:   []string{"ParticipantID", "Pulse", "PulseMin", "PulseMax"},
+		Sample: map[string]interface{}{"ParticipantID": int64(1234567890), "Pulse": 130, "PulseMin": 50, "PulseMax": 120},
+	},
+	AlertSymptoms: {
+		Vars: append([]string{"ParticipantID"}, symptomVars...),
+		Sample: map[string]interface{}{"ParticipantID": int64(1234567890),
+			"BlurriedVision": true, "Headache": true, "DifficultyBreathing": false, "SidePain": false},
+	},
+	AlertSymptomsWithBP: {
+		Vars: append([]string{"ParticipantID", "SBP", "DBP"}, symptomVars...),
+		Sample: map[string]interface{}{"ParticipantID": int64(1234567890), "SBP": 145, "DBP": 92,
+			"BlurriedVision": false, "Headache": true, "DifficultyBreathing": false, "SidePain": false},
+	},
+	ReminderVitals: {
+		Vars:   []string{"HoursSince"},
+		Sample: map[string]interface{}{"HoursSince": 30},
+	},
+	ReminderSymptoms: {
+		Vars:   []string{"HoursSince"},
+		Sample: map[string]interface{}{"HoursSince": 30},
+	},
+	Escalation: {
+		Vars:   []string{"Message"},
+		Sample: map[string]interface{}{"Message": "Severe range blood pressure for participant: 1234567890 SBP: 165 DBP: 112 Pulse: 88"},
+	},
+}
+
+// Names every message with a schema
+func Names() []string {
+	var names []string
+	for name := range schemas {
+		names = append(names, name)
+	}
+	return names
+}
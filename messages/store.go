@@ -0,0 +1,337 @@
+package messages
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"text/template/parse"
+)
+
+const (
+	defaultScope  = "default"
+	defaultLocale = "en"
+	brandingFile  = "branding.json"
+)
+
+// ErrNoTemplate returned when no variant of a message exists
+var ErrNoTemplate = errors.New("no template for message")
+
+// Brand per study branding available to every template as .Brand
+type Brand struct {
+	Name          string `json:"name"`
+	Team          string `json:"team"`
+	Website       string `json:"website"`
+	Email         string `json:"email"`
+	IOSAppURL     string `json:"iosAppURL"`
+	AndroidAppURL string `json:"androidAppURL"`
+	DefaultLocale string `json:"defaultLocale"`
+}
+
+// Rendered message ready to send. HTML is empty for plain text messages.
+type Rendered struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+}
+
+type variant struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// Store message templates of the default scope and of every study with overrides
+type Store struct {
+	brands   map[string]Brand
+	variants map[string]variant
+}
+
+var (
+	storeMutex sync.RWMutex
+	current    = &Store{brands: map[string]Brand{}, variants: map[string]variant{}}
+)
+
+// embedded templates shipped with the binary, used unless a directory is given
+//
+//go:embed templates
+var embedded embed.FS
+
+// Init loads the templates under dir, or the embedded templates when dir is
+// empty, and makes them the current store. The directory holds default/ and
+// one folder per study, each with an optional branding.json and
+// <message>/<locale>.txt (and .html) files.
+func Init(dir string) error {
+	var fsys fs.FS
+	source := dir
+	if dir == "" {
+		fsys, _ = fs.Sub(embedded, "templates")
+		source = "the binary"
+	} else {
+		fsys = os.DirFS(dir)
+	}
+	s, err := Load(fsys)
+	if err != nil {
+		return err
+	}
+	storeMutex.Lock()
+	current = s
+	storeMutex.Unlock()
+	log.Printf("Loaded %d message templates from %s\n", len(s.variants), source)
+	return nil
+}
+
+// Load parses and checks every template of fsys against its schema
+func Load(fsys fs.FS) (*Store, error) {
+	s := &Store{brands: map[string]Brand{}, variants: map[string]variant{}}
+	if _, err := fs.Stat(fsys, path.Join(defaultScope, brandingFile)); err != nil {
+		return nil, fmt.Errorf("%s/%s is missing", defaultScope, brandingFile)
+	}
+	// studies start from the default branding so it is loaded first
+	if err := s.loadScope(fsys, defaultScope); err != nil {
+		return nil, err
+	}
+	scopes, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range scopes {
+		if !scope.IsDir() || scope.Name() == defaultScope {
+			continue
+		}
+		if err := s.loadScope(fsys, scope.Name()); err != nil {
+			return nil, err
+		}
+	}
+	for name := range schemas {
+		if _, ok := s.variants[key(defaultScope, name, defaultLocale)]; !ok {
+			return nil, fmt.Errorf("%s/%s/%s.txt is missing", defaultScope, name, defaultLocale)
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) loadScope(fsys fs.FS, scope string) error {
+	brand := Brand{}
+	if scope != defaultScope {
+		brand = s.brands[defaultScope]
+	}
+	b, err := fs.ReadFile(fsys, path.Join(scope, brandingFile))
+	if err == nil {
+		// unmarshal over the default so a study only lists what it changes
+		if err := json.Unmarshal(b, &brand); err != nil {
+			return fmt.Errorf("%s: %s", path.Join(scope, brandingFile), err.Error())
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if brand.DefaultLocale == "" {
+		brand.DefaultLocale = defaultLocale
+	}
+	s.brands[scope] = brand
+
+	files, err := fs.Glob(fsys, path.Join(scope, "*", "*.txt"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := path.Base(path.Dir(file))
+		locale := strings.TrimSuffix(path.Base(file), ".txt")
+		schema, ok := schemas[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown message %s", file, name)
+		}
+		v, err := loadVariant(fsys, file, schema)
+		if err != nil {
+			return err
+		}
+		s.variants[key(scope, name, locale)] = v
+	}
+	return nil
+}
+
+func loadVariant(fsys fs.FS, textFile string, schema Schema) (variant, error) {
+	var v variant
+	b, err := fs.ReadFile(fsys, textFile)
+	if err != nil {
+		return v, err
+	}
+	v.text, err = texttemplate.New(path.Base(textFile)).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return v, err
+	}
+	if v.text.Lookup("body") == nil {
+		return v, fmt.Errorf(`%s: {{define "body"}} is missing`, textFile)
+	}
+	for _, t := range v.text.Templates() {
+		if err := checkVars(t.Tree, schema); err != nil {
+			return v, fmt.Errorf("%s: %s", textFile, err.Error())
+		}
+	}
+
+	htmlFile := strings.TrimSuffix(textFile, ".txt") + ".html"
+	b, err = fs.ReadFile(fsys, htmlFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return v, err
+	}
+	v.html, err = htmltemplate.New(path.Base(htmlFile)).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return v, err
+	}
+	if v.html.Lookup("body") == nil {
+		return v, fmt.Errorf(`%s: {{define "body"}} is missing`, htmlFile)
+	}
+	for _, t := range v.html.Templates() {
+		if err := checkVars(t.Tree, schema); err != nil {
+			return v, fmt.Errorf("%s: %s", htmlFile, err.Error())
+		}
+	}
+	return v, nil
+}
+
+// checkVars walks the template and rejects variables outside the schema.
+// Bodies of range and with are skipped because the dot changes there.
+func checkVars(tree *parse.Tree, schema Schema) error {
+	if tree == nil || tree.Root == nil {
+		return nil
+	}
+	allowed := map[string]bool{"Brand": true}
+	for _, v := range schema.Vars {
+		allowed[v] = true
+	}
+	var walk func(node parse.Node) error
+	walk = func(node parse.Node) error {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return nil
+			}
+			for _, child := range n.Nodes {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case *parse.ActionNode:
+			return walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return nil
+			}
+			for _, cmd := range n.Cmds {
+				for _, arg := range cmd.Args {
+					if err := walk(arg); err != nil {
+						return err
+					}
+				}
+			}
+		case *parse.FieldNode:
+			if !allowed[n.Ident[0]] {
+				return fmt.Errorf("unknown variable .%s", n.Ident[0])
+			}
+		case *parse.IfNode:
+			if err := walk(n.Pipe); err != nil {
+				return err
+			}
+			if err := walk(n.List); err != nil {
+				return err
+			}
+			return walk(n.ElseList)
+		case *parse.RangeNode:
+			return walk(n.Pipe)
+		case *parse.WithNode:
+			return walk(n.Pipe)
+		case *parse.TemplateNode:
+			return walk(n.Pipe)
+		}
+		return nil
+	}
+	return walk(tree.Root)
+}
+
+func key(scope string, name string, locale string) string {
+	return scope + "/" + name + "/" + locale
+}
+
+// Render renders a message for a study in the requested locale. Falls back
+// to the study's default locale, then to the default templates.
+func Render(study string, locale string, name string, data map[string]interface{}) (Rendered, error) {
+	storeMutex.RLock()
+	s := current
+	storeMutex.RUnlock()
+	return s.Render(study, locale, name, data)
+}
+
+func (s *Store) Render(study string, locale string, name string, data map[string]interface{}) (Rendered, error) {
+	var r Rendered
+	schema, ok := schemas[name]
+	if !ok {
+		return r, ErrNoTemplate
+	}
+	for _, v := range schema.Vars {
+		if _, ok := data[v]; !ok {
+			return r, fmt.Errorf("%s: missing variable %s", name, v)
+		}
+	}
+
+	brand, ok := s.brands[study]
+	if !ok {
+		brand = s.brands[defaultScope]
+	}
+	v, ok := s.lookup(study, locale, name, brand.DefaultLocale)
+	if !ok {
+		return r, ErrNoTemplate
+	}
+
+	values := map[string]interface{}{"Brand": brand}
+	for k, value := range data {
+		values[k] = value
+	}
+	var buf bytes.Buffer
+	if v.text.Lookup("subject") != nil {
+		if err := v.text.ExecuteTemplate(&buf, "subject", values); err != nil {
+			return r, err
+		}
+		r.Subject = strings.TrimSpace(buf.String())
+		buf.Reset()
+	}
+	if err := v.text.ExecuteTemplate(&buf, "body", values); err != nil {
+		return r, err
+	}
+	r.Text = strings.TrimSpace(buf.String())
+	if v.html != nil {
+		buf.Reset()
+		if err := v.html.ExecuteTemplate(&buf, "body", values); err != nil {
+			return r, err
+		}
+		r.HTML = strings.TrimSpace(buf.String())
+	}
+	return r, nil
+}
+
+func (s *Store) lookup(study string, locale string, name string, studyLocale string) (variant, bool) {
+	for _, scope := range []string{study, defaultScope} {
+		for _, l := range []string{locale, studyLocale, defaultLocale} {
+			if v, ok := s.variants[key(scope, name, l)]; ok && l != "" && scope != "" {
+				return v, true
+			}
+		}
+	}
+	return variant{}, false
+}
+
+// Sample schema sample data of a message, used by the preview
+func Sample(name string) (map[string]interface{}, bool) {
+	schema, ok := schemas[name]
+	return schema.Sample, ok
+}
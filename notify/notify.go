@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	// ChannelEmail message to an email address
+	ChannelEmail = "email"
+	// ChannelSMS text message to a phone number
+	ChannelSMS = "sms"
+	// ChannelTopic message published to a topic the clinicians subscribe to.
+	// An empty recipient means the default alert topic.
+	ChannelTopic = "topic"
+)
+
+// ErrNoSink returned when no notifier is configured for the channel
+var ErrNoSink = errors.New("no notifier configured for channel")
+
+// Message one notification. Recipient is an email address, a phone number
+// or a topic depending on the channel. HTML is an optional alternative body
+// used by the email sinks. Sensitive messages carry credentials, their body
+// is cleared from the outbox once delivered and never written to files.
+type Message struct {
+	Channel   string `json:"channel"`
+	Recipient string `json:"recipient"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	HTML      string `json:"html,omitempty"`
+	Sensitive bool   `json:"sensitive,omitempty"`
+}
+
+// Notifier delivers messages to one provider
+type Notifier interface {
+	Send(m Message) error
+}
+
+var (
+	sinksMutex sync.RWMutex
+	sinks      = map[string]Notifier{}
+)
+
+// SetNotifier selects the notifier used by the outbox relay for a channel
+func SetNotifier(channel string, n Notifier) {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	sinks[channel] = n
+}
+
+// Send delivers a message right away with the notifier of its channel,
+// bypassing the outbox
+func Send(m Message) error {
+	sinksMutex.RLock()
+	n, ok := sinks[m.Channel]
+	sinksMutex.RUnlock()
+	if !ok {
+		return ErrNoSink
+	}
+	return n.Send(m)
+}
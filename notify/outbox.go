@@ -0,0 +1,112 @@
+package notify
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/jobs"
+)
+
+const (
+	relayBatch = 20
+
+	insertOutbox = `INSERT INTO notification_outbox (channel, recipient, subject, body, body_html, sensitive)
+VALUES ($1, $2, $3, $4, $5, $6) RETURNING outbox_id`
+	claimOutbox = `UPDATE notification_outbox SET attempts = attempts + 1, next_attempt_at = now() + interval '10 minutes'
+WHERE outbox_id IN (SELECT outbox_id FROM notification_outbox WHERE status = 'pending' AND next_attempt_at <= now()
+ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED)
+RETURNING outbox_id, channel, recipient, subject, body, body_html, sensitive, attempts, max_attempts`
+	// bodies of sensitive messages are only kept until they are delivered
+	redactSensitive = `body = CASE WHEN sensitive THEN '' ELSE body END, body_html = CASE WHEN sensitive THEN '' ELSE body_html END`
+	markSent        = `UPDATE notification_outbox SET status = 'sent', sent_at = now(), last_error = '', ` + redactSensitive + ` WHERE outbox_id = $1`
+	markRetry       = `UPDATE notification_outbox SET next_attempt_at = $2, last_error = $3 WHERE outbox_id = $1`
+	markFail        = `UPDATE notification_outbox SET status = 'failed', last_error = $2, ` + redactSensitive + ` WHERE outbox_id = $1`
+)
+
+// Queue writes the message to the outbox. The relay delivers it.
+func Queue(m Message) (int64, error) {
+	var outboxID int64
+	err := database.ADB.Db.QueryRow(insertOutbox, m.Channel, m.Recipient, m.Subject, m.Body, m.HTML, m.Sensitive).Scan(&outboxID)
+	if err != nil {
+		log.Printf("failed to queue %s notification: %s\n", m.Channel, err.Error())
+		return 0, err
+	}
+	return outboxID, nil
+}
+
+// QueueTx writes the message to the outbox as part of the caller's
+// transaction so it is only sent if the transaction commits
+func QueueTx(tx *sql.Tx, m Message) (int64, error) {
+	var outboxID int64
+	err := tx.QueryRow(insertOutbox, m.Channel, m.Recipient, m.Subject, m.Body, m.HTML, m.Sensitive).Scan(&outboxID)
+	if err != nil {
+		log.Printf("failed to queue %s notification: %s\n", m.Channel, err.Error())
+		return 0, err
+	}
+	return outboxID, nil
+}
+
+// StartRelay delivers pending outbox messages every interval. Claimed rows
+// are pushed back ten minutes so a relay that dies mid-send does not block them.
+func StartRelay(interval time.Duration) {
+	log.Println("Starting notification outbox relay...")
+	go func() {
+		for {
+			// keep draining while full batches come back
+			if relay() < relayBatch {
+				time.Sleep(interval)
+			}
+		}
+	}()
+}
+
+type pending struct {
+	id          int64
+	message     Message
+	attempts    int
+	maxAttempts int
+}
+
+// relay sends one batch and returns how many messages it claimed
+func relay() int {
+	rows, err := database.ADB.Db.Query(claimOutbox, relayBatch)
+	if err != nil {
+		log.Println("failed to claim outbox messages")
+		log.Println(err)
+		return 0
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		m := &p.message
+		if err := rows.Scan(&p.id, &m.Channel, &m.Recipient, &m.Subject, &m.Body, &m.HTML, &m.Sensitive, &p.attempts, &p.maxAttempts); err != nil {
+			log.Println(err)
+			continue
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+
+	for _, p := range batch {
+		err := Send(p.message)
+		if err == nil {
+			if _, dbErr := database.ADB.Db.Exec(markSent, p.id); dbErr != nil {
+				log.Printf("failed to mark notification %d sent: %s\n", p.id, dbErr.Error())
+			}
+			log.Printf("Notification sent {ID: %d, Channel: %s}\n", p.id, p.message.Channel)
+			continue
+		}
+		log.Printf("Notification failed {ID: %d, Channel: %s, Attempts: %d, Error: %s}\n", p.id, p.message.Channel, p.attempts, err.Error())
+		if p.attempts >= p.maxAttempts {
+			_, err = database.ADB.Db.Exec(markFail, p.id, err.Error())
+		} else {
+			_, err = database.ADB.Db.Exec(markRetry, p.id, time.Now().UTC().Add(jobs.Backoff(p.attempts)), err.Error())
+		}
+		if err != nil {
+			log.Printf("failed to update notification %d: %s\n", p.id, err.Error())
+		}
+	}
+	return len(batch)
+}
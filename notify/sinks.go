@@ -0,0 +1,156 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// SNSNotifier publishes topic messages and sends SMS through AWS SNS
+type SNSNotifier struct {
+	Region   string
+	TopicArn string
+}
+
+func (n SNSNotifier) Send(m Message) error {
+	input := &sns.PublishInput{Message: aws.String(m.Body)}
+	switch m.Channel {
+	case ChannelSMS:
+		input.PhoneNumber = aws.String(m.Recipient)
+	case ChannelTopic:
+		topic := m.Recipient
+		if topic == "" {
+			topic = n.TopicArn
+		}
+		if topic == "" {
+			return errors.New("no topic arn configured")
+		}
+		input.TopicArn = aws.String(topic)
+		input.Subject = aws.String(m.Subject)
+	default:
+		return fmt.Errorf("sns cannot send %s messages", m.Channel)
+	}
+
+	svc := sns.New(session.New(&aws.Config{Region: aws.String(n.Region)}))
+	result, err := svc.Publish(input)
+	if err != nil {
+		return err
+	}
+	log.Printf("Published %s message to sns {MessageID: %s}\n", m.Channel, aws.StringValue(result.MessageId))
+	return nil
+}
+
+// LambdaEmailNotifier sends email through the API Gateway lambda backed by SES
+type LambdaEmailNotifier struct {
+	URL    string
+	APIKey string
+}
+
+func (n LambdaEmailNotifier) Send(m Message) error {
+	if m.Channel != ChannelEmail {
+		return fmt.Errorf("email lambda cannot send %s messages", m.Channel)
+	}
+	if n.URL == "" {
+		return errors.New("no email lambda url configured")
+	}
+	content := m.Body
+	if m.HTML != "" {
+		content = m.HTML
+	}
+	body, err := json.Marshal(map[string]string{"email": m.Recipient, "body": content, "subject": m.Subject})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.URL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "text/html")
+	req.Header.Add("x-api-key", n.APIKey)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	// the lambda answers 202 when the email had no body, nothing was sent
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("email lambda returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SMTPNotifier sends email through an SMTP server with PLAIN auth
+type SMTPNotifier struct {
+	Addr     string
+	User     string
+	Password string
+	From     string
+}
+
+func (n SMTPNotifier) Send(m Message) error {
+	if m.Channel != ChannelEmail {
+		return fmt.Errorf("smtp cannot send %s messages", m.Channel)
+	}
+	var auth smtp.Auth
+	if n.User != "" {
+		host := n.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.User, n.Password, host)
+	}
+	// header values must not break out of their line
+	clean := strings.NewReplacer("\r", " ", "\n", " ")
+	msg := "From: " + n.From + "\r\n" +
+		"To: " + clean.Replace(m.Recipient) + "\r\n" +
+		"Subject: " + clean.Replace(m.Subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n"
+	if m.HTML == "" {
+		msg += "Content-Type: text/plain; charset=UTF-8\r\n\r\n" + m.Body
+	} else {
+		boundary := fmt.Sprintf("amoss-%d", time.Now().UnixNano())
+		msg += "Content-Type: multipart/alternative; boundary=" + boundary + "\r\n\r\n" +
+			"--" + boundary + "\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n" + m.Body + "\r\n" +
+			"--" + boundary + "\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n" + m.HTML + "\r\n" +
+			"--" + boundary + "--\r\n"
+	}
+	return smtp.SendMail(n.Addr, auth, n.From, []string{m.Recipient}, []byte(msg))
+}
+
+// FileNotifier writes every message as a json file to a local directory.
+// Used for local development so nothing leaves the machine. The body of
+// sensitive messages is left out.
+type FileNotifier struct {
+	Dir string
+}
+
+func (n FileNotifier) Send(m Message) error {
+	if err := os.MkdirAll(n.Dir, 0700); err != nil {
+		return err
+	}
+	if m.Sensitive {
+		m.Body, m.HTML = "[redacted]", ""
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d_%s.json", time.Now().UTC().UnixNano(), m.Channel)
+	return ioutil.WriteFile(filepath.Join(n.Dir, name), b, 0600)
+}
@@ -2,6 +2,7 @@ package participant
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,22 +11,37 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cliffordlab/amoss_services/alerts"
+	"github.com/cliffordlab/amoss_services/bp_readings"
+	"github.com/cliffordlab/amoss_services/capacity"
 	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/sites"
 	"github.com/gorilla/mux"
 )
 
 const (
-	defaultMaxMemory                 = 32 << 20
-	selectParticipants               = `SELECT participant_id, Count(*) FROM bp_readings WHERE is_verified=FALSE GROUP BY participant_id;`
-	selectParticipantVitals          = `SELECT created_at FROM bp_readings WHERE participant_id=$1 AND is_verified=FALSE;`
-	selectParticipantVitalUploadData = `SELECT created_at, participant_id, systolic_bp, diastolic_bp, pulse, csv_s3_key, jpg_s3_key, s3_presigned_url, is_verified FROM bp_readings WHERE participant_id=$1 AND created_at=$2 AND is_verified=false;`
-	updates3Key                      = `UPDATE bp_readings SET (s3_key, is_verified) VALUES ($1, true) where participant_id=$2 and created_at=$3;`
-	updateIsVerified                 = `UPDATE bp_readings SET is_verified=true WHERE jpg_s3_key=$1 AND participant_id=$2 AND created_at=$3;`
+	defaultMaxMemory = 32 << 20
+	// participants of the coordinator's study and sites with unverified readings
+	selectParticipants = `SELECT b.participant_id, p.site_id, Count(*) FROM bp_readings b
+JOIN participants p ON p.participant_id = b.participant_id
+WHERE b.is_verified=FALSE AND p.study_id=$1 AND `
+	selectParticipantVitals = `SELECT created_at FROM bp_readings WHERE participant_id=$1 AND is_verified=FALSE;`
+	// the values read from the photo come alongside the entered ones, a confident
+	// proposal more than 10 mmHg or beats per minute off the entered values is flagged
+	selectParticipantVitalUploadData = `SELECT b.created_at, b.participant_id, b.systolic_bp, b.diastolic_bp, b.pulse, b.csv_s3_key, b.jpg_s3_key,
+b.s3_presigned_url, b.is_verified, b.plausibility_flags, i.systolic_bp AS proposed_sbp, i.diastolic_bp AS proposed_dbp, i.pulse AS proposed_pulse,
+i.confidence AS proposal_confidence, i.reader AS proposal_reader,
+COALESCE(i.confidence >= 0.5 AND (abs(i.systolic_bp - b.systolic_bp) > 10 OR abs(i.diastolic_bp - b.diastolic_bp) > 10
+OR abs(i.pulse - b.pulse) > 10), false) AS proposal_disagrees
+FROM bp_readings b LEFT JOIN bp_image_readings i ON i.participant_id = b.participant_id AND i.created_at = b.created_at
+WHERE b.participant_id=$1 AND b.created_at=$2 AND b.is_verified=false;`
+	updates3Key = `UPDATE bp_readings SET (s3_key, is_verified) VALUES ($1, true) where participant_id=$2 and created_at=$3;`
 	//updateParticipantVitalFile  = `UPDATE bp_readings SET s3_presigned_url=$3 where participant_id=$1 and created_at=$2 returning *;`
-	selectParticipantJPGS3Key  = `SELECT jpg_s3_key FROM bp_readings WHERE participant_id=$1 AND created_at=$2`
-	selectParticipantCSVS3Key  = `SELECT csv_s3_key FROM bp_readings WHERE participant_id=$1 AND created_at=$2`
-	insertS3PresignedURL       = `UPDATE bp_readings SET s3_presigned_url = $1 WHERE participant_id=$2 AND created_at=$3 AND jpg_s3_key=$4`
-	updateParticipantVitalFile = `UPDATE bp_readings SET systolic_bp=$1, diastolic_bp=$2, pulse=$3, is_verified=true WHERE participant_id=$4 AND csv_s3_key=$5;`
+	selectParticipantJPGS3Key = `SELECT jpg_s3_key FROM bp_readings WHERE participant_id=$1 AND created_at=$2`
+	selectParticipantCSVS3Key = `SELECT csv_s3_key FROM bp_readings WHERE participant_id=$1 AND created_at=$2`
+	insertS3PresignedURL      = `UPDATE bp_readings SET s3_presigned_url = $1 WHERE participant_id=$2 AND created_at=$3 AND jpg_s3_key=$4`
+	chartFailedErr            = `{"error":"unable to build vital chart"}`
+	noParticipantErr          = `{"error":"no such participant"}`
 )
 
 type ListParticipantsHandler struct {
@@ -40,22 +56,44 @@ type ListUnverifiedFilesHandler struct {
 	Name string
 }
 
+// UnverifiedBPFileHandler GET returns the photo and entered values of a reading,
+// PUT confirms the entered values and POST records corrected values as one
+// review of the double verification
 type UnverifiedBPFileHandler struct {
 	Name string
 	Svc  *s3.S3
 }
 
-func (l ListParticipantsHandler) ServeHTTP(writer http.ResponseWriter, _ *http.Request) {
+// VerificationHandler reviews of a reading.
+// GET /participants/{participant_id}/vitals/unverified_uploads/{created_at}/verifications
+// POST /participants/{participant_id}/vitals/unverified_uploads/{created_at}/adjudicate with sbp, dbp, pulse and note
+type VerificationHandler struct {
+	Name string
+	Svc  *s3.S3
+}
+
+// RevisionsHandler history of the values of a reading.
+// GET /participants/{participant_id}/vitals/{created_at}/revisions
+type RevisionsHandler struct {
+	Name string
+}
+
+func (l ListParticipantsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	log.Println("Listing all distinct participants")
+	claims, _, err := capacity.ClaimsFromHeader(request, "Bearer")
+	if err != nil {
+		http.Error(writer, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
 
-	stmt, err := database.ADB.Db.Prepare(selectParticipants)
+	stmt, err := database.ADB.Db.Prepare(selectParticipants + sites.Condition("p.site_id", 2) + ` GROUP BY b.participant_id, p.site_id;`)
 	if err != nil {
 		log.Println("failed to prepare create participant statement")
 		log.Fatalln(err)
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query()
+	rows, err := stmt.Query(claims.Study, claims.ID)
 	if err != nil {
 		log.Println("failed to execute query statement")
 		log.Fatalln(err)
@@ -67,17 +105,98 @@ func (l ListParticipantsHandler) ServeHTTP(writer http.ResponseWriter, _ *http.R
 	writer.Write(results)
 }
 
+// VitalChart combined chart of one participant for the Emory dashboard. Vitals
+// are raw readings split by verification, paging applies to them only.
+type VitalChart struct {
+	ParticipantID int64                     `json:"participantID"`
+	Paging        bp_readings.Paging        `json:"paging"`
+	Vitals        []bp_readings.SeriesChart `json:"vitals"`
+	Symptoms      []bp_readings.SeriesChart `json:"symptoms"`
+	Alerts        []AlertMarker             `json:"alerts"`
+}
+
+// AlertMarker alert placed on the chart at the time of the reading that fired
+// it. Name is formatted like the series names.
+type AlertMarker struct {
+	Name     string `json:"name"`
+	AlertID  int64  `json:"alertID"`
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Status   string `json:"status"`
+	Message  string `json:"message"`
+}
+
+// ServeHTTP GET /participants/{participant_id}/charts with optional from, to,
+// page and pageSize as for the vitals chart
 func (v VitalChartHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	//id, err := strconv.ParseInt(strings.TrimPrefix(request.URL.Path, "/id: /"), 10, 64)
-	//if err == nil {
-	//	fmt.Printf("%d of type %T")
-	//}
+	claims, _, err := capacity.ClaimsFromHeader(request, "Bearer")
+	if err != nil {
+		http.Error(writer, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	id := mux.Vars(request)["participant_id"]
+	if !authorizeParticipant(writer, request, id) {
+		return
+	}
+	participantID, _ := strconv.ParseInt(id, 10, 64)
+
+	loc := bp_readings.ParticipantLocation(participantID)
+	query, err := bp_readings.ParseChartQuery(request.URL.Query(), bp_readings.Body{}, loc)
+	if err != nil {
+		errorJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
+		writer.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write(errorJSON)
+		return
+	}
+
+	chart, err := vitalChart(claims.Study, participantID, query)
+	if err != nil {
+		log.Println("failed to build vital chart")
+		log.Println(err)
+		writer.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(chartFailedErr))
+		return
+	}
+	jsonObject, _ := json.Marshal(chart)
+	writer.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	writer.Header().Add("Content-Type", "application/json; charset=UTF-8")
+	writer.Write(jsonObject)
+}
+
+func vitalChart(study string, participantID int64, query bp_readings.ChartQuery) (VitalChart, error) {
+	chart := VitalChart{ParticipantID: participantID, Alerts: []AlertMarker{}}
+	var err error
+	if chart.Vitals, chart.Paging, err = bp_readings.VerificationChart(participantID, query); err != nil {
+		return chart, err
+	}
+	if chart.Symptoms, err = bp_readings.SymptomsChart(participantID, query); err != nil {
+		return chart, err
+	}
+	records, err := alerts.ParticipantHistory(study, participantID)
+	if err != nil {
+		return chart, err
+	}
+	// history is newest first, markers go in chart order
+	for i := len(records) - 1; i >= 0; i-- {
+		a := records[i]
+		if (!query.From.IsZero() && a.ReadingAt.Before(query.From)) || (!query.To.IsZero() && !a.ReadingAt.Before(query.To)) {
+			continue
+		}
+		chart.Alerts = append(chart.Alerts, AlertMarker{Name: a.ReadingAt.In(query.Location).Format(time.RFC3339),
+			AlertID: a.AlertID, Rule: a.Rule, Severity: a.Severity, Status: a.Status, Message: a.Message})
+	}
+	return chart, nil
 }
 
 func (l ListUnverifiedFilesHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	log.Println("Listing participant's unverified file uploads...")
 	params := mux.Vars(request)
 	id := params["participant_id"]
+	if !authorizeParticipant(writer, request, id) {
+		return
+	}
 	stmt, err := database.ADB.Db.Prepare(selectParticipantVitals)
 	if err != nil {
 		log.Println("failed to prepare select vitals statement")
@@ -95,12 +214,41 @@ func (l ListUnverifiedFilesHandler) ServeHTTP(writer http.ResponseWriter, reques
 	writer.Write(result)
 }
 
+// authorizeParticipant allows coordinators of the participant's study that
+// are not scoped to other sites, anyone else gets a 404
+func authorizeParticipant(writer http.ResponseWriter, request *http.Request, id string) bool {
+	claims, _, err := capacity.ClaimsFromHeader(request, "Bearer")
+	if err != nil {
+		http.Error(writer, "Invalid token type", http.StatusUnauthorized)
+		return false
+	}
+	participantID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.Error(writer, "Invalid participant id", http.StatusBadRequest)
+		return false
+	}
+	visible, err := sites.Visible(claims.Study, claims.ID, participantID)
+	if err != nil {
+		log.Println(err)
+	}
+	if !visible {
+		writer.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte(noParticipantErr))
+		return false
+	}
+	return true
+}
+
 func (u UnverifiedBPFileHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	method := request.Method
 	params := mux.Vars(request)
 	id := params["participant_id"]
 	creationTime := params["created_at"]
 	log.Println("This is id: " + id + " Thiis is the time: " + creationTime)
+	if !authorizeParticipant(writer, request, id) {
+		return
+	}
 	switch method {
 	case "GET":
 		log.Println("GET request:")
@@ -108,40 +256,142 @@ func (u UnverifiedBPFileHandler) ServeHTTP(writer http.ResponseWriter, request *
 		getParticipantVitalData(writer, id, creationTime)
 	case "PUT":
 		log.Println("PUT request:")
-		updateVitalIsVerified(id, creationTime, writer)
+		reviewParticipantVitals(id, creationTime, writer, request, u, KindReview, true)
 	case "POST":
 		log.Println("POST request:")
-		updateParticipantVitals(id, creationTime, writer, request, u)
+		reviewParticipantVitals(id, creationTime, writer, request, u, KindReview, false)
 	}
 }
 
-func updateVitalIsVerified(id string, creationTime string, writer http.ResponseWriter) {
-	// update db
-	s3Key := getS3Key(id, creationTime, "jpg")
-	updateDBIsVerified(s3Key, id, creationTime, writer)
+// ServeHTTP GET lists the reviews of a reading, POST adjudicates it
+func (h VerificationHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	params := mux.Vars(request)
+	if !authorizeParticipant(writer, request, params["participant_id"]) {
+		return
+	}
+	switch request.Method {
+	case "GET":
+		claims, _, err := capacity.ClaimsFromHeader(request, "Bearer")
+		if err != nil {
+			http.Error(writer, "Invalid token type", http.StatusUnauthorized)
+			return
+		}
+		participantID, err1 := strconv.ParseInt(params["participant_id"], 10, 64)
+		createdAt, err2 := strconv.ParseInt(params["created_at"], 10, 64)
+		if err1 != nil || err2 != nil {
+			http.Error(writer, "Invalid reading", http.StatusBadRequest)
+			return
+		}
+		state, err := ReadingVerification(claims.Study, participantID, createdAt)
+		writeVerification(writer, state, err)
+	case "POST":
+		reviewParticipantVitals(params["participant_id"], params["created_at"], writer, request, UnverifiedBPFileHandler{Svc: h.Svc}, KindAdjudication, false)
+	default:
+		http.Error(writer, "HTTP Method needs to be GET or POST", http.StatusMethodNotAllowed)
+	}
 }
 
-func updateDBIsVerified(key string, id string, creationTime string, writer http.ResponseWriter) {
-	println("Updating database vital verification...")
-
-	stmt, err := database.ADB.Db.Prepare(updateIsVerified)
+// reviewParticipantVitals records the coordinator's transcription of a reading.
+// confirm records the values the participant entered, else sbp, dbp and pulse
+// are read from the form.
+func reviewParticipantVitals(id string, creationTime string, writer http.ResponseWriter, request *http.Request, u UnverifiedBPFileHandler, kind string, confirm bool) {
+	claims, _, err := capacity.ClaimsFromHeader(request, "Bearer")
 	if err != nil {
-		log.Println("failed to prepare update participant's vital statements")
-		log.Fatalln(err)
+		http.Error(writer, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	participantID, err1 := strconv.ParseInt(id, 10, 64)
+	createdAt, err2 := strconv.ParseInt(creationTime, 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(writer, "Invalid reading", http.StatusBadRequest)
+		return
+	}
+	if err := request.ParseMultipartForm(defaultMaxMemory); err != nil && err != http.ErrNotMultipart {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var values Values
+	if confirm {
+		state, err := ReadingVerification(claims.Study, participantID, createdAt)
+		if err != nil {
+			writeVerification(writer, state, err)
+			return
+		}
+		values = state.Entered
+	} else {
+		var errs [3]error
+		values.SBP, errs[0] = strconv.Atoi(request.Form.Get("sbp"))
+		values.DBP, errs[1] = strconv.Atoi(request.Form.Get("dbp"))
+		values.Pulse, errs[2] = strconv.Atoi(request.Form.Get("pulse"))
+		if errs[0] != nil || errs[1] != nil || errs[2] != nil {
+			http.Error(writer, "sbp, dbp and pulse must be numbers", http.StatusBadRequest)
+			return
+		}
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query(key, id, creationTime)
-	if err != nil {
-		log.Println("failed to execute query statement")
-		log.Fatalln(err)
+	write := func(key string, v Values) error {
+		return uploadNewFile(u, key, VitalsRequest{SBP: v.SBP, DBP: v.DBP, Pulse: v.Pulse})
 	}
-	rows.Close()
+	state, err := Review(claims.Study, participantID, createdAt, claims.ID, kind, values, request.Form.Get("note"), write)
+	writeVerification(writer, state, err)
+}
 
-	fmt.Printf("Successfully updated db for: ", key)
+// ServeHTTP GET every revision of a reading's values
+func (h RevisionsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(request, "Bearer")
+	if err != nil {
+		http.Error(writer, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	params := mux.Vars(request)
+	if !authorizeParticipant(writer, request, params["participant_id"]) {
+		return
+	}
+	participantID, err1 := strconv.ParseInt(params["participant_id"], 10, 64)
+	createdAt, err2 := strconv.ParseInt(params["created_at"], 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(writer, "Invalid reading", http.StatusBadRequest)
+		return
+	}
+	revisions, err := ReadingRevisions(claims.Study, participantID, createdAt)
+	writer.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	if err != nil {
+		log.Println("failed to query reading revisions")
+		log.Println(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(`{"error":"unable to query revisions"}`))
+		return
+	}
+	if len(revisions) == 0 {
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte(`{"error":"no such reading in this study"}`))
+		return
+	}
+	jsonObject, _ := json.Marshal(revisions)
+	writer.Header().Add("Content-Type", "application/json; charset=UTF-8")
+	writer.Write(jsonObject)
+}
 
-	writer.WriteHeader(http.StatusOK)
-	writer.Write([]byte("{\"success\": \"you have completed update to awsS3Bucket/moyo-mom-emory/\"}"))
+func writeVerification(writer http.ResponseWriter, state VerificationState, err error) {
+	writer.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	switch err {
+	case nil:
+		jsonObject, _ := json.Marshal(state)
+		writer.Header().Add("Content-Type", "application/json; charset=UTF-8")
+		writer.Write(jsonObject)
+	case ErrNoReading:
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte(`{"error":"no such reading in this study"}`))
+	case ErrAlreadyVerified, ErrAlreadyReviewed, ErrNotDisputed, ErrOwnReview:
+		errorJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
+		writer.WriteHeader(http.StatusConflict)
+		writer.Write(errorJSON)
+	default:
+		log.Println("failed to record verification")
+		log.Println(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(`{"error":"unable to record verification"}`))
+	}
 }
 
 func insertS3PresignedURLtoDB(id string, creationTime string, u UnverifiedBPFileHandler) {
@@ -234,68 +484,13 @@ func getParticipantVitalData(writer http.ResponseWriter, id string, creationTime
 	writer.Write(result)
 }
 
-func updateParticipantVitals(id string, creationTime string, writer http.ResponseWriter, request *http.Request, u UnverifiedBPFileHandler) {
-	log.Println("Updating participant vitals...")
-	var vr VitalsRequest
-	err := request.ParseMultipartForm(defaultMaxMemory)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		log.Println("This is the error: ")
-		log.Println(err)
-		return
-	}
-	m := request.Form
-
-	vr.SBP, _ = strconv.Atoi(m.Get("sbp"))
-	vr.DBP, _ = strconv.Atoi(m.Get("dbp"))
-	vr.Pulse, _ = strconv.Atoi(m.Get("pulse"))
-	log.Println("request.Form.Get(sbp): " + request.Form.Get("sbp"))
-	log.Println("dbp: " + request.Form.Get("dbp"))
-	log.Println("pulse: " + request.Form.Get("pulse"))
-
-	log.Println("strconv.Itoa(vr.SBP: " + strconv.Itoa(vr.SBP))
-	log.Println("strconv.Itoa(vr.DBP: " + strconv.Itoa(vr.DBP))
-	log.Println("strconv.Itoa(vr.Pulse: " + strconv.Itoa(vr.Pulse))
-
-	s3Key := getS3Key(id, creationTime, "csv")
-	// s3 copy original file and name pid_timestamp.file_old
-	renameS3Object(u, s3Key)
-	// write new file with approved values
-	uploadNewFile(u, s3Key, vr)
-	// update db
-	updateDB(s3Key, vr, id)
-	writer.WriteHeader(http.StatusOK)
-	writer.Write([]byte("{\"success\": \"you have completed update to awsS3Bucket/moyo-mom-emory/\"}"))
-}
-
-func updateDB(s3Key string, vr VitalsRequest, id string) {
-	println("Updating database with verified bp values.")
-
-	stmt, err := database.ADB.Db.Prepare(updateParticipantVitalFile)
-	if err != nil {
-		log.Println("failed to prepare update participant's vital statements")
-		log.Fatalln(err)
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query(vr.SBP, vr.DBP, vr.Pulse, id, s3Key)
-	if err != nil {
-		log.Println("failed to execute query statement")
-		log.Fatalln(err)
-	}
-	rows.Close()
-
-	fmt.Printf("Successfully update db for: ", s3Key)
-
-}
-
 type VitalsRequest struct {
 	SBP   int
 	DBP   int
 	Pulse int
 }
 
-func uploadNewFile(u UnverifiedBPFileHandler, s3Key string, vr VitalsRequest) {
+func uploadNewFile(u UnverifiedBPFileHandler, s3Key string, vr VitalsRequest) error {
 	log.Println("Creating new BP CSV File...")
 	// init byte buffer var
 	var bb bytes.Buffer
@@ -312,52 +507,14 @@ func uploadNewFile(u UnverifiedBPFileHandler, s3Key string, vr VitalsRequest) {
 		Key:    &key,
 	})
 	if err != nil {
-		log.Fatalf("Failed to upload data to %s/%s, %s\n", bucket, key, err.Error())
-		return
+		log.Printf("Failed to upload data to %s/%s, %s\n", bucket, key, err.Error())
+		return err
 	}
 	log.Printf("This is the result of the upload with key %s: %s\n", key, uploadResult.GoString())
+	return nil
 }
 
-func renameS3Object(u UnverifiedBPFileHandler, s3Key string) {
-	log.Println("Renaming S3 Object...")
-
-	log.Println("Copying S3 Object...")
-	// Copy the item
-	_, err := u.Svc.CopyObject(&s3.CopyObjectInput{Bucket: aws.String("awsS3Bucket"), CopySource: aws.String("awsS3Bucket/" + s3Key), Key: aws.String(s3Key + "_old")})
-	if err != nil {
-		fmt.Printf("Item %q copy unsuccessful: " + s3Key)
-		return
-	}
-	fmt.Printf("Item %q successfully copied: " + s3Key)
-
-	// Wait to see if the item got copied
-	err = u.Svc.WaitUntilObjectExists(&s3.HeadObjectInput{Bucket: aws.String("awsS3Bucket"), Key: aws.String(s3Key + "_old")})
-	if err != nil {
-		fmt.Printf("Item %q copy unsuccessful: " + s3Key)
-		return
-	}
-	fmt.Printf("Item %q successfully copied: " + s3Key)
-
-	log.Println("Deleting Old S3 Object...")
-
-	// delete original file
-	_, err = u.Svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("awsS3Bucket"), Key: aws.String(s3Key)})
-	if err != nil {
-		fmt.Printf("Item %q delete unsucessful: " + s3Key)
-		return
-	}
-	fmt.Printf("Item %q successfully delete: " + s3Key)
-
-	err = u.Svc.WaitUntilObjectNotExists(&s3.HeadObjectInput{Bucket: aws.String("awsS3Bucket"), Key: aws.String(s3Key)})
-	if err != nil {
-		fmt.Printf("Item %q delete unsucessful: " + s3Key)
-		return
-	}
-	fmt.Printf("Item %q successfully delete: " + s3Key)
-
-}
-
-//func GetS3PreSignedUrl(bucket string, key string, region string, expiration time.Duration) {
+// func GetS3PreSignedUrl(bucket string, key string, region string, expiration time.Duration) {
 func GetS3PreSignedUrl(key string, u UnverifiedBPFileHandler) string {
 	expiration := time.Duration(10080)
 	log.Println("Creating presigned URL...")
@@ -22,14 +22,14 @@ const (
 	insertAdmin = `INSERT INTO participants (participant_id, password_hash, password_salt, capacity_id)
     VALUES ($1, $2, $3, (SELECT capacity_id FROM participant_capacity WHERE capacity_id=$4))`
 
-	insertParticipant = `INSERT INTO participants (participant_id, password_hash, password_salt, capacity_id, study_id)
+	insertParticipant = `INSERT INTO participants (participant_id, password_hash, password_salt, capacity_id, study_id, site_id)
 	VALUES ($1, $2, $3, (SELECT capacity_id FROM participant_capacity WHERE capacity_id=$4),
-	(SELECT study_id FROM studies WHERE study_id=$5))`
+	(SELECT study_id FROM studies WHERE study_id=$5), NULLIF($6, ''))`
 
-	insertMoyoParticipant = `INSERT INTO participants (participant_id, password_hash, password_salt, capacity_id, study_id, email_hash, encryption_iv, encrypted_email, encrypted_phone, phone_iv, is_consented)
+	insertMoyoParticipant = `INSERT INTO participants (participant_id, password_hash, password_salt, capacity_id, study_id, email_hash, encryption_iv, encrypted_email, encrypted_phone, phone_iv, is_consented, locale)
 	VALUES ($1, $2, $3, (SELECT capacity_id FROM participant_capacity WHERE capacity_id=$4),
 	(SELECT study_id FROM studies WHERE study_id=$5),
-	$6, $7, $8, $9, $10, $11)`
+	$6, $7, $8, $9, $10, $11, NULLIF($12, ''))`
 
 	selectMoyoParticipant = `SELECT email_hash FROM participants where (email_hash) = ($1)`
 
@@ -47,11 +47,13 @@ type Participant struct {
 	Salt         string
 	PasswordHash string
 	Study        string
+	Site         string
 	IV           []byte
 	PhoneIV      []byte
 	EmailHash    string
 	Password     string
 	HasConsented bool
+	Locale       string
 }
 
 //Salt gets the salt for the participant
@@ -186,7 +188,7 @@ func CreateNonAdmin(pt Participant, w http.ResponseWriter) {
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(pt.ID, pt.PasswordHash, pt.Salt, pt.Capacity, pt.Study)
+	rows, err := stmt.Query(pt.ID, pt.PasswordHash, pt.Salt, pt.Capacity, pt.Study, pt.Site)
 	if err != nil {
 		log.Println("failed to execute query statement")
 		log.Println(err)
@@ -230,7 +232,7 @@ func CreateMoyoNonAdmin(pt Participant, w http.ResponseWriter) (int int64, email
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(pt.ID, pt.PasswordHash, pt.Salt, pt.Capacity, pt.Study, pt.EmailHash, pt.IV, pt.EmailEncoded, pt.Phone, pt.PhoneIV, true)
+	rows, err := stmt.Query(pt.ID, pt.PasswordHash, pt.Salt, pt.Capacity, pt.Study, pt.EmailHash, pt.IV, pt.EmailEncoded, pt.Phone, pt.PhoneIV, true, pt.Locale)
 	if err != nil {
 		log.Println("failed to execute query statement")
 		log.Println(err)
@@ -240,7 +242,7 @@ func CreateMoyoNonAdmin(pt Participant, w http.ResponseWriter) (int int64, email
 	rows.Close()
 	log.Println("participant created successfully. Participant ID: " + string(pt.ID))
 	// send email with participant ID and password if everything is successful
-	emailStatus := support.EmailMoyoParticipant(pt.Email, pt.ID, pt.Password, w)
+	emailStatus := support.EmailMoyoParticipant(pt.Study, pt.Locale, pt.Email, pt.ID, pt.Password, w)
 	//decrypt(w, pt)
 	return pid, emailStatus, nil
 }
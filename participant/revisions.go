@@ -0,0 +1,91 @@
+package participant
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	SourceUpload       = "upload"
+	SourceVerification = "verification"
+	SourceAdjudication = "adjudication"
+
+	insertRevision = `INSERT INTO bp_reading_revisions (participant_id, created_at, revision, systolic_bp, diastolic_bp, pulse,
+csv_s3_key, source, changed_by, reason) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	selectNextRevision = `SELECT COALESCE(MAX(revision) + 1, 0) FROM bp_reading_revisions WHERE participant_id = $1 AND created_at = $2`
+	selectRevisions    = `SELECT r.revision, r.systolic_bp, r.diastolic_bp, r.pulse, r.csv_s3_key, r.source, r.changed_by, r.reason, r.changed_at
+FROM bp_reading_revisions r JOIN participants p ON p.participant_id = r.participant_id
+WHERE r.participant_id = $1 AND r.created_at = $2 AND p.study_id = $3 ORDER BY r.revision`
+)
+
+// Revision one version of the values of a reading. ChangedBy is nil for
+// readings that predate the history.
+type Revision struct {
+	Revision  int       `json:"revision"`
+	Values    Values    `json:"values"`
+	CSVS3Key  string    `json:"csvS3Key"`
+	Source    string    `json:"source"`
+	ChangedBy *int64    `json:"changedBy"`
+	Reason    string    `json:"reason"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// RecordUpload saves the participant entered values as revision 0 of a new
+// reading, in the transaction inserting the reading
+func RecordUpload(tx *sql.Tx, participantID int64, createdAt int64, values Values, csvKey string) error {
+	_, err := tx.Exec(insertRevision, participantID, createdAt, 0, values.SBP, values.DBP, values.Pulse,
+		csvKey, SourceUpload, participantID, "entered by participant")
+	return err
+}
+
+// nextRevision number of the next revision of a reading. The caller holds
+// the lock on the bp_readings row.
+func nextRevision(tx *sql.Tx, participantID int64, createdAt int64) (int, error) {
+	var revision int
+	err := tx.QueryRow(selectNextRevision, participantID, createdAt).Scan(&revision)
+	return revision, err
+}
+
+func recordRevision(tx *sql.Tx, participantID int64, createdAt int64, revision int, values Values, csvKey string, source string, changedBy int64, reason string) error {
+	_, err := tx.Exec(insertRevision, participantID, createdAt, revision, values.SBP, values.DBP, values.Pulse,
+		csvKey, source, changedBy, reason)
+	return err
+}
+
+// VersionedCSVKey key of the csv of a revision, next to the uploaded one:
+// test/emory/1234560000/1628467200000/bp.csv becomes .../bp_r1.csv
+func VersionedCSVKey(key string, revision int) string {
+	if strings.HasSuffix(key, ".csv") {
+		return fmt.Sprintf("%s_r%d.csv", strings.TrimSuffix(key, ".csv"), revision)
+	}
+	return fmt.Sprintf("%s_r%d", key, revision)
+}
+
+// ReadingRevisions every revision of a reading in the coordinator's study, oldest first
+func ReadingRevisions(study string, participantID int64, createdAt int64) ([]Revision, error) {
+	rows, err := database.ADB.Db.Query(selectRevisions, participantID, createdAt, study)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var r Revision
+		var changedBy sql.NullInt64
+		err := rows.Scan(&r.Revision, &r.Values.SBP, &r.Values.DBP, &r.Values.Pulse, &r.CSVS3Key, &r.Source,
+			&changedBy, &r.Reason, &r.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		if changedBy.Valid {
+			r.ChangedBy = &changedBy.Int64
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
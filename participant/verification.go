@@ -0,0 +1,272 @@
+package participant
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	VerificationPending           = "pending"
+	VerificationNeedsAdjudication = "needs_adjudication"
+	VerificationVerified          = "verified"
+
+	KindReview       = "review"
+	KindAdjudication = "adjudication"
+
+	selectReadingForUpdate = `SELECT b.systolic_bp, b.diastolic_bp, b.pulse, b.is_verified, COALESCE(b.csv_s3_key, '') FROM bp_readings b
+JOIN participants p ON p.participant_id = b.participant_id
+WHERE b.participant_id = $1 AND b.created_at = $2 AND p.study_id = $3 FOR UPDATE OF b`
+	selectReading = `SELECT b.systolic_bp, b.diastolic_bp, b.pulse, b.is_verified FROM bp_readings b
+JOIN participants p ON p.participant_id = b.participant_id
+WHERE b.participant_id = $1 AND b.created_at = $2 AND p.study_id = $3`
+	selectVerifications = `SELECT verification_id, reviewer_id, kind, systolic_bp, diastolic_bp, pulse,
+sbp_diff, dbp_diff, pulse_diff, note, reviewed_at FROM bp_verifications
+WHERE participant_id = $1 AND created_at = $2 ORDER BY reviewed_at, verification_id`
+	insertVerification = `INSERT INTO bp_verifications (participant_id, created_at, reviewer_id, kind, systolic_bp, diastolic_bp, pulse,
+sbp_diff, dbp_diff, pulse_diff, note) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	updateVerifiedReading = `UPDATE bp_readings SET systolic_bp = $3, diastolic_bp = $4, pulse = $5, is_verified = true,
+csv_s3_key = COALESCE(NULLIF($6, ''), csv_s3_key) WHERE participant_id = $1 AND created_at = $2`
+)
+
+var (
+	// ErrNoReading returned when the reading does not exist in the reviewer's study
+	ErrNoReading = errors.New("no such reading")
+	// ErrAlreadyVerified returned for reviews of a verified reading
+	ErrAlreadyVerified = errors.New("reading is already verified")
+	// ErrAlreadyReviewed returned when the reviewer already reviewed the reading
+	ErrAlreadyReviewed = errors.New("reading was already reviewed by this coordinator")
+	// ErrNotDisputed returned when adjudicating a reading whose reviews do not disagree
+	ErrNotDisputed = errors.New("reading does not need adjudication")
+	// ErrOwnReview returned when a reviewer of the reading tries to adjudicate it
+	ErrOwnReview = errors.New("reviewers of a reading cannot adjudicate it")
+)
+
+// Values one transcription of a blood pressure photo
+type Values struct {
+	SBP   int `json:"sbp"`
+	DBP   int `json:"dbp"`
+	Pulse int `json:"pulse"`
+}
+
+// Verification one reviewer's transcription with the diff against the
+// values the participant entered
+type Verification struct {
+	VerificationID int64     `json:"verificationID"`
+	ReviewerID     int64     `json:"reviewerID"`
+	Kind           string    `json:"kind"`
+	Values         Values    `json:"values"`
+	Diff           Values    `json:"diff"`
+	Note           string    `json:"note"`
+	ReviewedAt     time.Time `json:"reviewedAt"`
+}
+
+// VerificationState reviews of a reading and where it stands. Verified holds
+// the values the reading was verified with.
+type VerificationState struct {
+	ParticipantID int64          `json:"participantID"`
+	CreatedAt     int64          `json:"createdAt"`
+	Status        string         `json:"status"`
+	Entered       Values         `json:"entered"`
+	Verified      *Values        `json:"verified"`
+	Reviews       []Verification `json:"reviews"`
+}
+
+// CSVWriter writes the derived csv of a revision to a new key. It runs before
+// the verification is committed so a failed upload leaves the reading unverified.
+type CSVWriter func(key string, values Values) error
+
+// Review records a reviewer's transcription of a reading. The reading is
+// verified once two reviewers agree, or right away for an adjudication,
+// which needs disagreeing reviews and a coordinator who did not review it.
+func Review(study string, participantID int64, createdAt int64, reviewerID int64, kind string, values Values, note string, write CSVWriter) (VerificationState, error) {
+	state := VerificationState{ParticipantID: participantID, CreatedAt: createdAt}
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return state, err
+	}
+	defer tx.Rollback()
+
+	var verified bool
+	var csvKey string
+	err = tx.QueryRow(selectReadingForUpdate, participantID, createdAt, study).
+		Scan(&state.Entered.SBP, &state.Entered.DBP, &state.Entered.Pulse, &verified, &csvKey)
+	if err == sql.ErrNoRows {
+		return state, ErrNoReading
+	}
+	if err != nil {
+		return state, err
+	}
+	if verified {
+		return state, ErrAlreadyVerified
+	}
+	if state.Reviews, err = verifications(tx, participantID, createdAt); err != nil {
+		return state, err
+	}
+	for _, r := range state.Reviews {
+		if r.ReviewerID != reviewerID {
+			continue
+		}
+		if kind == KindReview && r.Kind == KindReview {
+			return state, ErrAlreadyReviewed
+		}
+		if kind == KindAdjudication {
+			return state, ErrOwnReview
+		}
+	}
+	if kind == KindAdjudication && status(state.Reviews) != VerificationNeedsAdjudication {
+		return state, ErrNotDisputed
+	}
+
+	diff := Values{SBP: values.SBP - state.Entered.SBP, DBP: values.DBP - state.Entered.DBP, Pulse: values.Pulse - state.Entered.Pulse}
+	_, err = tx.Exec(insertVerification, participantID, createdAt, reviewerID, kind,
+		values.SBP, values.DBP, values.Pulse, diff.SBP, diff.DBP, diff.Pulse, note)
+	if err != nil {
+		return state, err
+	}
+	if state.Reviews, err = verifications(tx, participantID, createdAt); err != nil {
+		return state, err
+	}
+	state.Status = status(state.Reviews)
+	state.Verified = agreed(state.Reviews)
+	if state.Verified != nil {
+		v := *state.Verified
+		// changed values become a new revision with its own csv, nothing is overwritten
+		versionedKey := ""
+		if v != state.Entered {
+			revision, err := nextRevision(tx, participantID, createdAt)
+			if err != nil {
+				return state, err
+			}
+			if csvKey != "" && write != nil {
+				versionedKey = VersionedCSVKey(csvKey, revision)
+				if err := write(versionedKey, v); err != nil {
+					return state, err
+				}
+			}
+			source, reason := revisionReason(state.Reviews)
+			if err := recordRevision(tx, participantID, createdAt, revision, v, versionedKey, source, reviewerID, reason); err != nil {
+				return state, err
+			}
+		}
+		if _, err := tx.Exec(updateVerifiedReading, participantID, createdAt, v.SBP, v.DBP, v.Pulse, versionedKey); err != nil {
+			return state, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return state, err
+	}
+	log.Printf("Reading %d/%d reviewed by %d, status %s\n", participantID, createdAt, reviewerID, state.Status)
+	return state, nil
+}
+
+// revisionReason source and reason of the revision made by a verification
+func revisionReason(reviews []Verification) (string, string) {
+	for _, r := range reviews {
+		if r.Kind == KindAdjudication {
+			reason := fmt.Sprintf("adjudicated by %d", r.ReviewerID)
+			if r.Note != "" {
+				reason += ": " + r.Note
+			}
+			return SourceAdjudication, reason
+		}
+	}
+	for i, a := range reviews {
+		for _, b := range reviews[i+1:] {
+			if a.Values == b.Values {
+				return SourceVerification, fmt.Sprintf("transcribed alike by reviewers %d and %d", a.ReviewerID, b.ReviewerID)
+			}
+		}
+	}
+	return SourceVerification, "verified"
+}
+
+// ReadingVerification the reviews of a reading in the coordinator's study
+func ReadingVerification(study string, participantID int64, createdAt int64) (VerificationState, error) {
+	state := VerificationState{ParticipantID: participantID, CreatedAt: createdAt}
+	var verified bool
+	err := database.ADB.Db.QueryRow(selectReading, participantID, createdAt, study).
+		Scan(&state.Entered.SBP, &state.Entered.DBP, &state.Entered.Pulse, &verified)
+	if err == sql.ErrNoRows {
+		return state, ErrNoReading
+	}
+	if err != nil {
+		return state, err
+	}
+	if state.Reviews, err = verifications(database.ADB.Db, participantID, createdAt); err != nil {
+		return state, err
+	}
+	// bp_readings holds the verified values by now, the diffs keep what was entered
+	if len(state.Reviews) > 0 {
+		r := state.Reviews[0]
+		state.Entered = Values{SBP: r.Values.SBP - r.Diff.SBP, DBP: r.Values.DBP - r.Diff.DBP, Pulse: r.Values.Pulse - r.Diff.Pulse}
+	}
+	state.Status = status(state.Reviews)
+	state.Verified = agreed(state.Reviews)
+	// readings verified before reviews were recorded have none
+	if verified && state.Verified == nil {
+		state.Status = VerificationVerified
+		entered := state.Entered
+		state.Verified = &entered
+	}
+	return state, nil
+}
+
+// queryer is a *sql.DB or a *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func verifications(q queryer, participantID int64, createdAt int64) ([]Verification, error) {
+	rows, err := q.Query(selectVerifications, participantID, createdAt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := []Verification{}
+	for rows.Next() {
+		var v Verification
+		err := rows.Scan(&v.VerificationID, &v.ReviewerID, &v.Kind, &v.Values.SBP, &v.Values.DBP, &v.Values.Pulse,
+			&v.Diff.SBP, &v.Diff.DBP, &v.Diff.Pulse, &v.Note, &v.ReviewedAt)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, v)
+	}
+	return reviews, rows.Err()
+}
+
+// agreed values the reading is verified with: the adjudication if there is
+// one, else the values two reviewers transcribed alike
+func agreed(reviews []Verification) *Values {
+	for _, r := range reviews {
+		if r.Kind == KindAdjudication {
+			v := r.Values
+			return &v
+		}
+	}
+	for i, a := range reviews {
+		for _, b := range reviews[i+1:] {
+			if a.Kind == KindReview && b.Kind == KindReview && a.Values == b.Values {
+				v := a.Values
+				return &v
+			}
+		}
+	}
+	return nil
+}
+
+func status(reviews []Verification) string {
+	if agreed(reviews) != nil {
+		return VerificationVerified
+	}
+	if len(reviews) >= 2 {
+		return VerificationNeedsAdjudication
+	}
+	return VerificationPending
+}
@@ -0,0 +1,211 @@
+package questionnaires
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// AnswerError why the answer to one item was rejected
+type AnswerError struct {
+	Item    string `json:"item"`
+	Message string `json:"message"`
+}
+
+// Result value of one score and the band it falls in
+type Result struct {
+	ID    string  `json:"id"`
+	Value float64 `json:"value"`
+	Band  string  `json:"band,omitempty"`
+}
+
+// Check validates submitted answers against the definition, in item order so
+// skip logic sees the earlier answers. Answers are returned as bool, float64
+// or string, keeping only the items that were shown and answered.
+func (inst Instrument) Check(submitted map[string]json.RawMessage) (map[string]interface{}, []AnswerError) {
+	answers := map[string]interface{}{}
+	var errs []AnswerError
+	known := map[string]bool{}
+
+	for _, item := range inst.Items {
+		known[item.ID] = true
+		raw, answered := submitted[item.ID]
+		if answered && strings.TrimSpace(string(raw)) == "null" {
+			answered = false
+		}
+		if !inst.shown(item, answers) {
+			if answered {
+				errs = append(errs, AnswerError{Item: item.ID, Message: "is skipped by an earlier answer"})
+			}
+			continue
+		}
+		if !answered {
+			if item.Required {
+				errs = append(errs, AnswerError{Item: item.ID, Message: "is required"})
+			}
+			continue
+		}
+		value, message := item.parse(raw)
+		if message != "" {
+			errs = append(errs, AnswerError{Item: item.ID, Message: message})
+			continue
+		}
+		answers[item.ID] = value
+	}
+	var unknown []string
+	for id := range submitted {
+		if !known[id] {
+			unknown = append(unknown, id)
+		}
+	}
+	sort.Strings(unknown)
+	for _, id := range unknown {
+		errs = append(errs, AnswerError{Item: id, Message: "is not an item of " + inst.ID})
+	}
+	return answers, errs
+}
+
+func (item Item) parse(raw json.RawMessage) (interface{}, string) {
+	switch item.Type {
+	case TypeBoolean:
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return nil, "must be true or false"
+		}
+		return b, ""
+	case TypeChoice:
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, "must be the value of an option"
+		}
+		for _, o := range item.Options {
+			if o.Value == v {
+				return v, ""
+			}
+		}
+		return nil, "must be the value of an option"
+	case TypeNumber:
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, "must be a number"
+		}
+		if (item.Min != nil && v < *item.Min) || (item.Max != nil && v > *item.Max) {
+			return nil, fmt.Sprintf("must be between %s and %s", bound(item.Min), bound(item.Max))
+		}
+		return v, ""
+	case TypeText:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, "must be text"
+		}
+		if len(s) > maxTextLength {
+			return nil, fmt.Sprintf("must be at most %d characters", maxTextLength)
+		}
+		return s, ""
+	}
+	return nil, "has an unknown type"
+}
+
+func bound(b *float64) string {
+	if b == nil {
+		return "any"
+	}
+	return fmt.Sprint(*b)
+}
+
+// shown reports whether the item is asked given the answers so far. A
+// condition on an unanswered item does not hold.
+func (inst Instrument) shown(item Item, answers map[string]interface{}) bool {
+	c := item.ShowIf
+	if c == nil {
+		return true
+	}
+	var value float64
+	if c.Score != "" {
+		for _, s := range inst.Scores {
+			if s.ID == c.Score {
+				value = s.compute(answers)
+			}
+		}
+	} else {
+		v, ok := numeric(answers[c.Item])
+		if !ok {
+			return false
+		}
+		value = v
+	}
+	switch c.Op {
+	case "eq":
+		return value == c.Value
+	case "ne":
+		return value != c.Value
+	case "gt":
+		return value > c.Value
+	case "gte":
+		return value >= c.Value
+	case "lt":
+		return value < c.Value
+	case "lte":
+		return value <= c.Value
+	}
+	return false
+}
+
+// Score every score of the instrument from checked answers
+func (inst Instrument) Score(answers map[string]interface{}) []Result {
+	results := []Result{}
+	for _, s := range inst.Scores {
+		r := Result{ID: s.ID, Value: s.compute(answers)}
+		for _, b := range s.Bands {
+			if r.Value >= b.Min && r.Value <= b.Max {
+				r.Band = b.Label
+				break
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// compute skips unanswered items, the mean is of the answered ones
+func (s Score) compute(answers map[string]interface{}) float64 {
+	var total float64
+	n := 0
+	for _, id := range s.Items {
+		v, ok := numeric(answers[id])
+		if !ok {
+			continue
+		}
+		switch s.Method {
+		case MethodCount:
+			if v >= s.CountMin {
+				total++
+			}
+		default:
+			total += v
+		}
+		n++
+	}
+	if s.Method == MethodMean {
+		if n == 0 {
+			return 0
+		}
+		return math.Round(total/float64(n)*100) / 100
+	}
+	return total
+}
+
+func numeric(answer interface{}) (float64, bool) {
+	switch v := answer.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
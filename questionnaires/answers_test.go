@@ -0,0 +1,313 @@
+package questionnaires
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+// embeddedInstrument the latest shipped version of id
+func embeddedInstrument(t *testing.T, id string) Instrument {
+	t.Helper()
+	fsys, err := fs.Sub(embedded, "instruments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(fsys)
+	if err != nil {
+		t.Fatalf("loading the embedded instruments: %v", err)
+	}
+	versions := loaded[id]
+	if len(versions) == 0 {
+		t.Fatalf("no embedded definition of %s", id)
+	}
+	return versions[len(versions)-1]
+}
+
+// submission answers the items q1, q2, ... with values in order
+func submission(values ...float64) map[string]json.RawMessage {
+	submitted := map[string]json.RawMessage{}
+	for i, v := range values {
+		submitted[fmt.Sprintf("q%d", i+1)] = json.RawMessage(fmt.Sprint(v))
+	}
+	return submitted
+}
+
+func repeat(v float64, n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = v
+	}
+	return values
+}
+
+func resultsByID(results []Result) map[string]Result {
+	byID := map[string]Result{}
+	for _, r := range results {
+		byID[r.ID] = r
+	}
+	return byID
+}
+
+func TestEmbeddedInstrumentsLoad(t *testing.T) {
+	for _, id := range []string{"phq9", "pcl5", "moyo_symptoms"} {
+		embeddedInstrument(t, id)
+	}
+}
+
+func TestCheckRejectsInvalidAnswers(t *testing.T) {
+	phq9 := embeddedInstrument(t, "phq9")
+	tests := []struct {
+		name      string
+		submitted map[string]json.RawMessage
+		want      []AnswerError
+	}{
+		{
+			name:      "all answered",
+			submitted: submission(0, 1, 2, 3, 0, 1, 2, 3, 0, 1),
+		},
+		{
+			name:      "missing required item",
+			submitted: submission(0, 0, 0, 0, 0, 0, 0, 0),
+			want:      []AnswerError{{Item: "q9", Message: "is required"}},
+		},
+		{
+			name:      "null is unanswered",
+			submitted: map[string]json.RawMessage{"q1": json.RawMessage("null")},
+			want: []AnswerError{
+				{Item: "q1", Message: "is required"}, {Item: "q2", Message: "is required"},
+				{Item: "q3", Message: "is required"}, {Item: "q4", Message: "is required"},
+				{Item: "q5", Message: "is required"}, {Item: "q6", Message: "is required"},
+				{Item: "q7", Message: "is required"}, {Item: "q8", Message: "is required"},
+				{Item: "q9", Message: "is required"},
+			},
+		},
+		{
+			name:      "value of no option",
+			submitted: submission(4, 0, 0, 0, 0, 0, 0, 0, 0),
+			want:      []AnswerError{{Item: "q1", Message: "must be the value of an option"}},
+		},
+		{
+			name: "text for a choice",
+			submitted: func() map[string]json.RawMessage {
+				s := submission(repeat(0, 9)...)
+				s["q2"] = json.RawMessage(`"never"`)
+				return s
+			}(),
+			want: []AnswerError{{Item: "q2", Message: "must be the value of an option"}},
+		},
+		{
+			name: "unknown items sorted",
+			submitted: func() map[string]json.RawMessage {
+				s := submission(repeat(0, 9)...)
+				s["q12"] = json.RawMessage("0")
+				s["q11"] = json.RawMessage("0")
+				return s
+			}(),
+			want: []AnswerError{
+				{Item: "q11", Message: "is not an item of phq9"},
+				{Item: "q12", Message: "is not an item of phq9"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := phq9.Check(tt.submitted)
+			if !reflect.DeepEqual(errs, tt.want) {
+				t.Errorf("errors %v, want %v", errs, tt.want)
+			}
+		})
+	}
+}
+
+// PHQ-9 asks the difficulty question only when some problem was checked
+func TestCheckSkipLogic(t *testing.T) {
+	phq9 := embeddedInstrument(t, "phq9")
+	q10 := phq9.Items[len(phq9.Items)-1]
+	if q10.ID != "q10" {
+		t.Fatalf("last phq9 item is %s, want q10", q10.ID)
+	}
+	tests := []struct {
+		name      string
+		submitted map[string]json.RawMessage
+		shown     bool
+		want      []AnswerError
+	}{
+		{
+			name:      "no problems hides difficulty",
+			submitted: submission(repeat(0, 9)...),
+			shown:     false,
+		},
+		{
+			name:      "answering a hidden item",
+			submitted: submission(append(repeat(0, 9), 2)...),
+			shown:     false,
+			want:      []AnswerError{{Item: "q10", Message: "is skipped by an earlier answer"}},
+		},
+		{
+			name:      "one problem shows difficulty",
+			submitted: submission(0, 0, 0, 0, 0, 0, 0, 0, 1),
+			shown:     true,
+			want:      []AnswerError{{Item: "q10", Message: "is required"}},
+		},
+		{
+			name:      "difficulty answered",
+			submitted: submission(1, 0, 0, 0, 0, 0, 0, 0, 0, 3),
+			shown:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers, errs := phq9.Check(tt.submitted)
+			if got := phq9.shown(q10, answers); got != tt.shown {
+				t.Errorf("q10 shown %v, want %v", got, tt.shown)
+			}
+			if !reflect.DeepEqual(errs, tt.want) {
+				t.Errorf("errors %v, want %v", errs, tt.want)
+			}
+			if _, kept := answers["q10"]; kept && !tt.shown {
+				t.Error("answer of a hidden item was kept")
+			}
+		})
+	}
+}
+
+func TestShownItemCondition(t *testing.T) {
+	inst := Instrument{
+		Items: []Item{
+			{ID: "fever", Type: TypeBoolean},
+			{ID: "temp", Type: TypeNumber, ShowIf: &Condition{Item: "fever", Op: "eq", Value: 1}},
+		},
+	}
+	tests := []struct {
+		answers map[string]interface{}
+		want    bool
+	}{
+		{map[string]interface{}{"fever": true}, true},
+		{map[string]interface{}{"fever": false}, false},
+		{map[string]interface{}{}, false},
+	}
+	for _, tt := range tests {
+		if got := inst.shown(inst.Items[1], tt.answers); got != tt.want {
+			t.Errorf("shown with %v = %v, want %v", tt.answers, got, tt.want)
+		}
+	}
+}
+
+// severity cut points of Kroenke, Spitzer and Williams 2001
+func TestScorePHQ9(t *testing.T) {
+	phq9 := embeddedInstrument(t, "phq9")
+	tests := []struct {
+		name     string
+		values   []float64
+		total    float64
+		band     string
+		selfHarm string
+	}{
+		{"no symptoms", repeat(0, 9), 0, "minimal", "none"},
+		{"upper minimal", []float64{1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, 4, "minimal", "none"},
+		{"lower mild", []float64{1, 1, 1, 1, 1, 0, 0, 0, 0, 1}, 5, "mild", "none"},
+		{"several days each", []float64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, 9, "mild", "reported"},
+		{"lower moderate", []float64{2, 2, 2, 2, 2, 0, 0, 0, 0, 1}, 10, "moderate", "none"},
+		{"lower moderately severe", []float64{3, 3, 3, 2, 2, 2, 0, 0, 0, 2}, 15, "moderately severe", "none"},
+		{"upper moderately severe", []float64{3, 3, 3, 2, 2, 2, 2, 2, 0, 2}, 19, "moderately severe", "none"},
+		{"lower severe", []float64{3, 3, 3, 3, 2, 2, 2, 2, 0, 2}, 20, "severe", "none"},
+		{"maximum", []float64{3, 3, 3, 3, 3, 3, 3, 3, 3, 3}, 27, "severe", "reported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers, errs := phq9.Check(submission(tt.values...))
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors %v", errs)
+			}
+			results := resultsByID(phq9.Score(answers))
+			if r := results["total"]; r.Value != tt.total || r.Band != tt.band {
+				t.Errorf("total %v %q, want %v %q", r.Value, r.Band, tt.total, tt.band)
+			}
+			if r := results["self_harm"]; r.Band != tt.selfHarm {
+				t.Errorf("self_harm %q, want %q", r.Band, tt.selfHarm)
+			}
+		})
+	}
+}
+
+// total and DSM-5 cluster scores of Weathers et al. 2013, probable PTSD from 33
+func TestScorePCL5(t *testing.T) {
+	pcl5 := embeddedInstrument(t, "pcl5")
+	tests := []struct {
+		name   string
+		values []float64
+		want   map[string]float64
+		band   string
+	}{
+		{
+			name:   "no symptoms",
+			values: repeat(0, 20),
+			want:   map[string]float64{"total": 0, "intrusion": 0, "avoidance": 0, "cognition_mood": 0, "arousal_reactivity": 0},
+			band:   "below cutoff",
+		},
+		{
+			name:   "below cutoff",
+			values: []float64{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 0, 0, 0, 0},
+			want:   map[string]float64{"total": 32, "intrusion": 10, "avoidance": 4, "cognition_mood": 14, "arousal_reactivity": 4},
+			band:   "below cutoff",
+		},
+		{
+			name:   "at cutoff",
+			values: []float64{3, 3, 2, 2, 1, 2, 1, 1, 2, 2, 1, 2, 1, 1, 2, 2, 1, 2, 1, 1},
+			want:   map[string]float64{"total": 33, "intrusion": 11, "avoidance": 3, "cognition_mood": 10, "arousal_reactivity": 9},
+			band:   "probable PTSD",
+		},
+		{
+			name:   "extremely for every item",
+			values: repeat(4, 20),
+			want:   map[string]float64{"total": 80, "intrusion": 20, "avoidance": 8, "cognition_mood": 28, "arousal_reactivity": 24},
+			band:   "probable PTSD",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers, errs := pcl5.Check(submission(tt.values...))
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors %v", errs)
+			}
+			results := resultsByID(pcl5.Score(answers))
+			for id, want := range tt.want {
+				if got := results[id].Value; got != want {
+					t.Errorf("%s %v, want %v", id, got, want)
+				}
+			}
+			if band := results["total"].Band; band != tt.band {
+				t.Errorf("total band %q, want %q", band, tt.band)
+			}
+		})
+	}
+}
+
+func TestScoreMeanAndCount(t *testing.T) {
+	inst := Instrument{
+		Scores: []Score{
+			{ID: "mean", Method: MethodMean, Items: []string{"a", "b", "c"}},
+			{ID: "count", Method: MethodCount, Items: []string{"a", "b", "c"}, CountMin: 2},
+		},
+	}
+	tests := []struct {
+		answers map[string]interface{}
+		mean    float64
+		count   float64
+	}{
+		{map[string]interface{}{}, 0, 0},
+		{map[string]interface{}{"a": 1.0, "b": 2.0}, 1.5, 1},
+		{map[string]interface{}{"a": 1.0, "b": 1.0, "c": 2.0}, 1.33, 1},
+		{map[string]interface{}{"a": 3.0, "b": true, "c": 2.0}, 2, 2},
+	}
+	for _, tt := range tests {
+		results := resultsByID(inst.Score(tt.answers))
+		if results["mean"].Value != tt.mean || results["count"].Value != tt.count {
+			t.Errorf("%v scored mean %v count %v, want %v %v",
+				tt.answers, results["mean"].Value, results["count"].Value, tt.mean, tt.count)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package questionnaires
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/consent"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/sites"
+	"github.com/gorilla/mux"
+)
+
+const (
+	selectAccessToken  = `SELECT access_token FROM participants WHERE participant_id = $1 AND access_token = $2 AND lifecycle_state <> 'withdrawn'`
+	invalidAccessToken = `{"logout user":"Invalid access token."}`
+	invalidRequestErr  = `{"error":"body must be {\"instrument\", \"version\", \"createdAt\", \"answers\"}"}`
+	queryFailedErr     = `{"error":"unable to query questionnaires"}`
+	saveFailedErr      = `{"error":"unable to save questionnaire, please try again"}`
+	consentRequiredErr = `{"error":"the current consent document has not been signed"}`
+	noParticipantErr   = `{"error":"no such participant"}`
+)
+
+// InstrumentsHandler latest definitions of the instruments offered by the
+// study of the app or coordinator token.
+// GET /api/questionnaires
+type InstrumentsHandler struct {
+	Name string
+}
+
+// SubmitHandler validates, scores and stores a participant's answers once
+// the participant signed the current consent document.
+// POST /api/questionnaires/responses
+type SubmitHandler struct {
+	Name string
+}
+
+// ResponsesHandler scored responses of a participant, or of every patient at
+// the coordinator's sites.
+// GET /participants/{participant_id}/questionnaires[?instrument=phq9] or /questionnaires[?instrument=phq9]
+type ResponsesHandler struct {
+	Name string
+}
+
+// SubmitRequest body of a submission. Version 0 answers the latest version.
+type SubmitRequest struct {
+	Instrument string                     `json:"instrument"`
+	Version    int                        `json:"version"`
+	CreatedAt  int64                      `json:"createdAt"`
+	Answers    map[string]json.RawMessage `json:"answers"`
+}
+
+// SubmitResponse scores of an accepted submission
+type SubmitResponse struct {
+	Instrument string   `json:"instrument"`
+	Version    int      `json:"version"`
+	Scores     []Result `json:"scores"`
+}
+
+func (h InstrumentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, bearerToken, err := capacity.ClaimsFromHeader(r, "Mars")
+	if err == nil {
+		// app tokens are only valid until the next login or withdrawal
+		var accessTokenDB string
+		err = database.ADB.Db.QueryRow(selectAccessToken, claims.ID, bearerToken).Scan(&accessTokenDB)
+		if err != nil || accessTokenDB != bearerToken {
+			log.Println("Access token does not match that of the database")
+			log.Println("Participant_ID: ", claims.ID)
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(invalidAccessToken))
+			return
+		}
+	} else {
+		claims, _, err = capacity.ClaimsFromHeader(r, "Bearer")
+	}
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+
+	instruments, err := StudyInstruments(claims.Study)
+	if err != nil {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(queryFailedErr))
+		return
+	}
+	resultsJSON, _ := json.Marshal(instruments)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resultsJSON)
+}
+
+func (h SubmitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, bearerToken, err := capacity.ClaimsFromHeader(r, "Mars")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	var accessTokenDB string
+	err = database.ADB.Db.QueryRow(selectAccessToken, claims.ID, bearerToken).Scan(&accessTokenDB)
+	if err != nil || accessTokenDB != bearerToken {
+		log.Println("Access token does not match that of the database")
+		log.Println("Participant_ID: ", claims.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(invalidAccessToken))
+		return
+	}
+	if !consent.Current(claims.Study, claims.ID) {
+		log.Printf("Rejected questionnaire of participant %d without a current consent\n", claims.ID)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(consentRequiredErr))
+		return
+	}
+
+	var sr SubmitRequest
+	if err := json.NewDecoder(r.Body).Decode(&sr); err != nil || sr.Instrument == "" || sr.CreatedAt <= 0 {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(invalidRequestErr))
+		return
+	}
+	offered, err := StudyOffers(claims.Study, sr.Instrument)
+	if err != nil {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(saveFailedErr))
+		return
+	}
+	inst, err := Get(sr.Instrument, sr.Version)
+	if err != nil || !offered {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"instrument is not offered by this study"}`))
+		return
+	}
+
+	answers, answerErrors := inst.Check(sr.Answers)
+	if len(answerErrors) > 0 {
+		body, _ := json.Marshal(map[string]interface{}{"error": "invalid answers", "items": answerErrors})
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write(body)
+		return
+	}
+	scores, err := Save(claims.ID, claims.Study, inst, sr.CreatedAt, answers)
+	if err != nil {
+		log.Printf("failed to save %s response of participant %d: %s\n", inst.ID, claims.ID, err.Error())
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(saveFailedErr))
+		return
+	}
+	err = runHook(inst.ID, Submission{ParticipantID: claims.ID, Study: claims.Study, CreatedAt: sr.CreatedAt, Answers: answers})
+	if err != nil {
+		log.Printf("failed to process %s response of participant %d: %s\n", inst.ID, claims.ID, err.Error())
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(saveFailedErr))
+		return
+	}
+	resultsJSON, _ := json.Marshal(SubmitResponse{Instrument: inst.ID, Version: inst.Version, Scores: scores})
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resultsJSON)
+}
+
+func (h ResponsesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, _, err := capacity.ClaimsFromHeader(r, "Bearer")
+	if err != nil {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+	var participantID int64
+	if id, ok := mux.Vars(r)["participant_id"]; ok {
+		participantID, err = strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid participant id", http.StatusBadRequest)
+			return
+		}
+		visible, err := sites.Visible(claims.Study, claims.ID, participantID)
+		if err != nil {
+			log.Println(err)
+		}
+		if !visible {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(noParticipantErr))
+			return
+		}
+	}
+
+	responses, err := Responses(claims.Study, claims.ID, participantID, r.URL.Query().Get("instrument"))
+	if err != nil {
+		log.Println(err)
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(queryFailedErr))
+		return
+	}
+	resultsJSON, _ := json.Marshal(responses)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resultsJSON)
+}
@@ -0,0 +1,284 @@
+package questionnaires
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// item types
+const (
+	TypeBoolean = "boolean"
+	TypeChoice  = "choice"
+	TypeNumber  = "number"
+	TypeText    = "text"
+)
+
+// scoring methods
+const (
+	MethodSum   = "sum"
+	MethodMean  = "mean"
+	MethodCount = "count"
+)
+
+const maxTextLength = 2000
+
+// ErrNoInstrument returned when no definition exists for an instrument or version
+var ErrNoInstrument = errors.New("no such instrument")
+
+// Instrument one version of a questionnaire. Versions are never edited, a
+// changed questionnaire is a new file with the next version.
+type Instrument struct {
+	ID      string  `json:"id"`
+	Version int     `json:"version"`
+	Title   string  `json:"title"`
+	Prompt  string  `json:"prompt,omitempty"`
+	Items   []Item  `json:"items"`
+	Scores  []Score `json:"scores"`
+}
+
+// Item one question. Choice answers are the value of an option, boolean
+// answers score 1 for true. ShowIf hides the item unless the condition holds.
+type Item struct {
+	ID       string     `json:"id"`
+	Text     string     `json:"text"`
+	Type     string     `json:"type"`
+	Required bool       `json:"required"`
+	Options  []Option   `json:"options,omitempty"`
+	Min      *float64   `json:"min,omitempty"`
+	Max      *float64   `json:"max,omitempty"`
+	ShowIf   *Condition `json:"showIf,omitempty"`
+}
+
+// Option one answer of a choice item
+type Option struct {
+	Value float64 `json:"value"`
+	Label string  `json:"label"`
+}
+
+// Condition compares an earlier answer, or a score of earlier answers, with a value
+type Condition struct {
+	Item  string  `json:"item,omitempty"`
+	Score string  `json:"score,omitempty"`
+	Op    string  `json:"op"`
+	Value float64 `json:"value"`
+}
+
+// Score computed from the answers to some items. Count counts the answers of
+// at least CountMin. Bands label ranges of the score, both ends included.
+type Score struct {
+	ID       string   `json:"id"`
+	Method   string   `json:"method"`
+	Items    []string `json:"items"`
+	CountMin float64  `json:"countMin,omitempty"`
+	Bands    []Band   `json:"bands,omitempty"`
+}
+
+// Band interpretation of a score range
+type Band struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Label string  `json:"label"`
+}
+
+var (
+	registryMutex sync.RWMutex
+	// instrument id to its versions, oldest first
+	registry = map[string][]Instrument{}
+)
+
+// embedded definitions shipped with the binary, used unless a directory is given
+//
+//go:embed instruments
+var embedded embed.FS
+
+// Init loads the definitions under dir, or the embedded definitions when dir
+// is empty, one folder per instrument holding v<version>.json files, and
+// makes them the current registry
+func Init(dir string) error {
+	var fsys fs.FS
+	source := dir
+	if dir == "" {
+		fsys, _ = fs.Sub(embedded, "instruments")
+		source = "the binary"
+	} else {
+		fsys = os.DirFS(dir)
+	}
+	loaded, err := Load(fsys)
+	if err != nil {
+		return err
+	}
+	registryMutex.Lock()
+	registry = loaded
+	registryMutex.Unlock()
+	log.Printf("Loaded %d questionnaire instruments from %s\n", len(loaded), source)
+	return nil
+}
+
+// Load parses and checks every definition of fsys
+func Load(fsys fs.FS) (map[string][]Instrument, error) {
+	folders, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string][]Instrument{}
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		files, err := fs.Glob(fsys, path.Join(folder.Name(), "v*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			inst, err := loadFile(fsys, file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err.Error())
+			}
+			version := strings.TrimSuffix(strings.TrimPrefix(path.Base(file), "v"), ".json")
+			if inst.ID != folder.Name() || strconv.Itoa(inst.Version) != version {
+				return nil, fmt.Errorf("%s: id and version must match the path", file)
+			}
+			loaded[inst.ID] = append(loaded[inst.ID], inst)
+		}
+		sort.Slice(loaded[folder.Name()], func(i, j int) bool {
+			return loaded[folder.Name()][i].Version < loaded[folder.Name()][j].Version
+		})
+	}
+	return loaded, nil
+}
+
+func loadFile(fsys fs.FS, file string) (Instrument, error) {
+	var inst Instrument
+	f, err := fsys.Open(file)
+	if err != nil {
+		return inst, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&inst); err != nil {
+		return inst, err
+	}
+	return inst, inst.check()
+}
+
+// check makes sure the definition can be answered and scored
+func (inst Instrument) check() error {
+	if inst.ID == "" || inst.Version < 1 || len(inst.Items) == 0 {
+		return errors.New("id, version and items are required")
+	}
+	items := map[string]Item{}
+	scores := map[string]Score{}
+	for _, s := range inst.Scores {
+		scores[s.ID] = s
+	}
+	for _, item := range inst.Items {
+		if item.ID == "" {
+			return errors.New("every item needs an id")
+		}
+		if _, ok := items[item.ID]; ok {
+			return fmt.Errorf("item %s is defined twice", item.ID)
+		}
+		switch item.Type {
+		case TypeBoolean, TypeNumber, TypeText:
+		case TypeChoice:
+			if len(item.Options) == 0 {
+				return fmt.Errorf("choice item %s has no options", item.ID)
+			}
+		default:
+			return fmt.Errorf("item %s has unknown type %q", item.ID, item.Type)
+		}
+		if c := item.ShowIf; c != nil {
+			if !validOp(c.Op) {
+				return fmt.Errorf("item %s: unknown operator %q", item.ID, c.Op)
+			}
+			// conditions only look back so an answer never hides itself
+			switch {
+			case c.Item != "" && c.Score == "":
+				ref, ok := items[c.Item]
+				if !ok || ref.Type == TypeText {
+					return fmt.Errorf("item %s: condition must refer to an earlier non text item", item.ID)
+				}
+			case c.Score != "" && c.Item == "":
+				s, ok := scores[c.Score]
+				if !ok {
+					return fmt.Errorf("item %s: unknown score %s", item.ID, c.Score)
+				}
+				for _, id := range s.Items {
+					if _, ok := items[id]; !ok {
+						return fmt.Errorf("item %s: score %s must only use earlier items", item.ID, c.Score)
+					}
+				}
+			default:
+				return fmt.Errorf("item %s: condition needs either an item or a score", item.ID)
+			}
+		}
+		items[item.ID] = item
+	}
+	for _, s := range inst.Scores {
+		if s.ID == "" || len(s.Items) == 0 {
+			return errors.New("every score needs an id and items")
+		}
+		switch s.Method {
+		case MethodSum, MethodMean, MethodCount:
+		default:
+			return fmt.Errorf("score %s has unknown method %q", s.ID, s.Method)
+		}
+		for _, id := range s.Items {
+			item, ok := items[id]
+			if !ok || item.Type == TypeText {
+				return fmt.Errorf("score %s uses unknown or text item %s", s.ID, id)
+			}
+		}
+	}
+	return nil
+}
+
+func validOp(op string) bool {
+	switch op {
+	case "eq", "ne", "gt", "gte", "lt", "lte":
+		return true
+	}
+	return false
+}
+
+// Get one version of an instrument, the latest when version is 0
+func Get(id string, version int) (Instrument, error) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	versions := registry[id]
+	if len(versions) == 0 {
+		return Instrument{}, ErrNoInstrument
+	}
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+	for _, inst := range versions {
+		if inst.Version == version {
+			return inst, nil
+		}
+	}
+	return Instrument{}, ErrNoInstrument
+}
+
+// Latest the latest version of every instrument, ordered by id
+func Latest() []Instrument {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	latest := []Instrument{}
+	for _, versions := range registry {
+		latest = append(latest, versions[len(versions)-1])
+	}
+	sort.Slice(latest, func(i, j int) bool { return latest[i].ID < latest[j].ID })
+	return latest
+}
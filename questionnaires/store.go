@@ -0,0 +1,154 @@
+package questionnaires
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/sites"
+)
+
+const (
+	selectStudyInstruments = `SELECT instrument_id FROM study_instruments WHERE study_id = $1`
+	insertResponse         = `INSERT INTO questionnaire_responses (participant_id, study_id, instrument_id, instrument_version, created_at, answers, scores)
+VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (participant_id, instrument_id, created_at) DO NOTHING`
+	// participant 0 selects every participant of the study, followed by the
+	// site condition of the coordinator and responsesOrder
+	selectResponses = `SELECT q.response_id, q.participant_id, q.instrument_id, q.instrument_version, q.created_at, q.answers, q.scores, q.submitted_at
+FROM questionnaire_responses q JOIN participants p ON p.participant_id = q.participant_id
+WHERE q.study_id = $1 AND ($2::bigint = 0 OR q.participant_id = $2) AND ($3 = '' OR q.instrument_id = $3) AND `
+	responsesOrder = ` ORDER BY q.created_at, q.response_id`
+)
+
+// Response one completed questionnaire
+type Response struct {
+	ResponseID        int64                  `json:"responseID"`
+	ParticipantID     int64                  `json:"participantID"`
+	InstrumentID      string                 `json:"instrument"`
+	InstrumentVersion int                    `json:"version"`
+	CreatedAt         int64                  `json:"createdAt"`
+	Answers           map[string]interface{} `json:"answers"`
+	Scores            []Result               `json:"scores"`
+	SubmittedAt       time.Time              `json:"submittedAt"`
+}
+
+// Submission a saved response, passed to the hook of its instrument
+type Submission struct {
+	ParticipantID int64
+	Study         string
+	CreatedAt     int64
+	Answers       map[string]interface{}
+}
+
+var (
+	hooksMutex sync.RWMutex
+	hooks      = map[string]func(Submission) error{}
+)
+
+// OnSubmit sets a hook run after every saved response to the instrument, for
+// instruments that feed other processing. A failed hook fails the submission
+// so the app retries it, the hook must be safe to repeat.
+func OnSubmit(instrumentID string, hook func(Submission) error) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	hooks[instrumentID] = hook
+}
+
+func runHook(instrumentID string, sub Submission) error {
+	hooksMutex.RLock()
+	hook := hooks[instrumentID]
+	hooksMutex.RUnlock()
+	if hook == nil {
+		return nil
+	}
+	return hook(sub)
+}
+
+// StudyInstruments latest versions of the instruments the study offers
+func StudyInstruments(study string) ([]Instrument, error) {
+	rows, err := database.ADB.Db.Query(selectStudyInstruments, study)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offered := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		offered[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	instruments := []Instrument{}
+	for _, inst := range Latest() {
+		if len(offered) == 0 || offered[inst.ID] {
+			instruments = append(instruments, inst)
+		}
+	}
+	return instruments, nil
+}
+
+// StudyOffers reports whether participants of the study may answer the instrument
+func StudyOffers(study string, instrumentID string) (bool, error) {
+	instruments, err := StudyInstruments(study)
+	if err != nil {
+		return false, err
+	}
+	for _, inst := range instruments {
+		if inst.ID == instrumentID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Save stores checked answers with their scores. Saving the same
+// participant, instrument and created_at again keeps the first response.
+func Save(participantID int64, study string, inst Instrument, createdAt int64, answers map[string]interface{}) ([]Result, error) {
+	scores := inst.Score(answers)
+	answersJSON, err := json.Marshal(answers)
+	if err != nil {
+		return nil, err
+	}
+	scoresJSON, err := json.Marshal(scores)
+	if err != nil {
+		return nil, err
+	}
+	_, err = database.ADB.Db.Exec(insertResponse, participantID, study, inst.ID, inst.Version, createdAt, answersJSON, scoresJSON)
+	return scores, err
+}
+
+// Responses of a participant, or of the patients at the coordinator's sites
+// when participantID is 0, optionally to one instrument, oldest first
+func Responses(study string, coordinatorID int64, participantID int64, instrumentID string) ([]Response, error) {
+	query := selectResponses + sites.Condition("p.site_id", 4) + responsesOrder
+	rows, err := database.ADB.Db.Query(query, study, participantID, instrumentID, coordinatorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	responses := []Response{}
+	for rows.Next() {
+		var r Response
+		var answersJSON, scoresJSON []byte
+		err := rows.Scan(&r.ResponseID, &r.ParticipantID, &r.InstrumentID, &r.InstrumentVersion, &r.CreatedAt,
+			&answersJSON, &scoresJSON, &r.SubmittedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(answersJSON, &r.Answers); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(scoresJSON, &r.Scores); err != nil {
+			return nil, err
+		}
+		responses = append(responses, r)
+	}
+	return responses, rows.Err()
+}
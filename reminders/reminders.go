@@ -0,0 +1,284 @@
+package reminders
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/capacity"
+	"github.com/cliffordlab/amoss_services/cryptography"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/messages"
+	"github.com/cliffordlab/amoss_services/notify"
+)
+
+const (
+	vitals   = "vitals"
+	symptoms = "symptoms"
+
+	selectSettings = `SELECT study_id, vitals_window_hours, symptoms_window_hours, quiet_start_hour, quiet_end_hour,
+max_per_day, max_per_gap, repeat_after_hours, sms_enabled, timezone FROM reminder_settings WHERE enabled`
+	// one scheduler pass per study at a time when several servers are running
+	lockStudy = `SELECT pg_try_advisory_xact_lock(hashtext('reminders:' || $1))`
+	// created_at is stored either as unix millis or with the leading "1"
+	// dropped, both are turned into millis before taking the latest
+	selectPatients = `SELECT p.participant_id, p.encrypted_email, p.encryption_iv, p.encrypted_phone, p.phone_iv,
+COALESCE(p.locale, ''), COALESCE(p.timezone, ''),
+(SELECT MAX(CASE WHEN b.created_at < 1000000000000 THEN b.created_at + 1000000000000 ELSE b.created_at END)
+ FROM bp_readings b WHERE b.participant_id = p.participant_id),
+(SELECT MAX(CASE WHEN s.created_at < 1000000000000 THEN s.created_at + 1000000000000 ELSE s.created_at END)
+ FROM mme_symptoms s WHERE s.participant_id = p.participant_id)
+FROM participants p WHERE p.study_id = $1 AND p.capacity_id = 'patient' AND p.lifecycle_state IN ('enrollment', 'active')`
+	countSentToday  = `SELECT count(*) FROM participant_reminders WHERE participant_id = $1 AND sent_at >= $2`
+	selectSentInGap = `SELECT count(*), MAX(sent_at) FROM participant_reminders
+WHERE participant_id = $1 AND data_type = $2 AND sent_at > $3`
+	insertReminder = `INSERT INTO participant_reminders (participant_id, data_type, channels, sent_at) VALUES ($1, $2, $3, $4)`
+)
+
+// Settings reminder protocol of a study
+type Settings struct {
+	Study               string
+	VitalsWindowHours   int
+	SymptomsWindowHours int
+	QuietStartHour      int
+	QuietEndHour        int
+	MaxPerDay           int
+	MaxPerGap           int
+	RepeatAfterHours    int
+	SMSEnabled          bool
+	Timezone            string
+}
+
+type patient struct {
+	id             int64
+	encryptedEmail []byte
+	emailIV        []byte
+	encryptedPhone []byte
+	phoneIV        []byte
+	locale         string
+	timezone       string
+	lastVitals     time.Time
+	lastSymptoms   time.Time
+}
+
+// StartScheduler checks every interval for participants who missed their
+// vitals or symptoms and queues reminders for them
+func StartScheduler(interval time.Duration) {
+	log.Println("Starting reminder scheduler...")
+	go func() {
+		for {
+			remind(time.Now().UTC())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func remind(now time.Time) {
+	rows, err := database.ADB.Db.Query(selectSettings)
+	if err != nil {
+		log.Println("failed to query reminder settings")
+		log.Println(err)
+		return
+	}
+	var studies []Settings
+	for rows.Next() {
+		var s Settings
+		err := rows.Scan(&s.Study, &s.VitalsWindowHours, &s.SymptomsWindowHours, &s.QuietStartHour, &s.QuietEndHour,
+			&s.MaxPerDay, &s.MaxPerGap, &s.RepeatAfterHours, &s.SMSEnabled, &s.Timezone)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		studies = append(studies, s)
+	}
+	rows.Close()
+
+	for _, s := range studies {
+		if err := remindStudy(s, now); err != nil {
+			log.Printf("failed to send reminders for study %s: %s\n", s.Study, err.Error())
+		}
+	}
+}
+
+// remindStudy queues the reminders of one study in a single transaction so
+// the outbox messages and the reminder log are written together
+func remindStudy(s Settings, now time.Time) error {
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow(lockStudy, s.Study).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+
+	patients, err := studyPatients(tx, s.Study)
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for _, p := range patients {
+		for _, dataType := range []string{vitals, symptoms} {
+			ok, err := remindPatient(tx, s, p, dataType, now)
+			if err != nil {
+				return err
+			}
+			if ok {
+				sent++
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if sent > 0 {
+		log.Printf("Queued %d reminders for study %s\n", sent, s.Study)
+	}
+	return nil
+}
+
+func studyPatients(tx *sql.Tx, study string) ([]patient, error) {
+	rows, err := tx.Query(selectPatients, study)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var patients []patient
+	for rows.Next() {
+		var p patient
+		var lastVitals, lastSymptoms sql.NullInt64
+		err := rows.Scan(&p.id, &p.encryptedEmail, &p.emailIV, &p.encryptedPhone, &p.phoneIV,
+			&p.locale, &p.timezone, &lastVitals, &lastSymptoms)
+		if err != nil {
+			return nil, err
+		}
+		if lastVitals.Valid {
+			p.lastVitals = time.Unix(0, lastVitals.Int64*int64(time.Millisecond)).UTC()
+		}
+		if lastSymptoms.Valid {
+			p.lastSymptoms = time.Unix(0, lastSymptoms.Int64*int64(time.Millisecond)).UTC()
+		}
+		patients = append(patients, p)
+	}
+	return patients, rows.Err()
+}
+
+// remindPatient queues a reminder for one data type if the participant is
+// outside the protocol window and none of the limits apply. Render and
+// decrypt failures skip the participant, only database errors are returned
+// since they abort the study's transaction.
+func remindPatient(tx *sql.Tx, s Settings, p patient, dataType string, now time.Time) (bool, error) {
+	last, window, name := p.lastVitals, s.VitalsWindowHours, messages.ReminderVitals
+	if dataType == symptoms {
+		last, window, name = p.lastSymptoms, s.SymptomsWindowHours, messages.ReminderSymptoms
+	}
+	if !last.IsZero() && now.Sub(last) < time.Duration(window)*time.Hour {
+		return false, nil
+	}
+
+	local := now.In(location(p.timezone, s.Timezone))
+	if quiet(local.Hour(), s.QuietStartHour, s.QuietEndHour) {
+		return false, nil
+	}
+
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	var today int
+	if err := tx.QueryRow(countSentToday, p.id, midnight).Scan(&today); err != nil {
+		return false, err
+	}
+	if today >= s.MaxPerDay {
+		return false, nil
+	}
+	// the reminders sent since the last upload belong to the current gap
+	var inGap int
+	var lastSent *time.Time
+	if err := tx.QueryRow(selectSentInGap, p.id, dataType, last).Scan(&inGap, &lastSent); err != nil {
+		return false, err
+	}
+	if inGap >= s.MaxPerGap {
+		return false, nil
+	}
+	if lastSent != nil && now.Sub(*lastSent) < time.Duration(s.RepeatAfterHours)*time.Hour {
+		return false, nil
+	}
+
+	hoursSince := window
+	if !last.IsZero() {
+		hoursSince = int(now.Sub(last).Hours())
+	}
+	// a template that does not render for this participant must not hold
+	// back the reminders of the rest of the study
+	rendered, err := messages.Render(s.Study, p.locale, name, map[string]interface{}{"HoursSince": hoursSince})
+	if err != nil {
+		log.Printf("failed to render %s reminder for participant %d: %s\n", dataType, p.id, err.Error())
+		return false, nil
+	}
+
+	key := []byte(capacity.CryptoKey)
+	var channels []string
+	if len(p.encryptedEmail) > 0 {
+		email, err := cryptography.Decrypt(key, p.encryptedEmail, p.emailIV)
+		if err != nil {
+			log.Printf("failed to decrypt email of participant %d\n", p.id)
+		} else {
+			m := notify.Message{Channel: notify.ChannelEmail, Recipient: string(email),
+				Subject: rendered.Subject, Body: rendered.Text, HTML: rendered.HTML}
+			if _, err := notify.QueueTx(tx, m); err != nil {
+				return false, err
+			}
+			channels = append(channels, m.Channel)
+		}
+	}
+	if s.SMSEnabled && len(p.encryptedPhone) > 0 {
+		phone, err := cryptography.Decrypt(key, p.encryptedPhone, p.phoneIV)
+		if err != nil {
+			log.Printf("failed to decrypt phone of participant %d\n", p.id)
+		} else if number := strings.TrimSpace(string(phone)); number != "" {
+			m := notify.Message{Channel: notify.ChannelSMS, Recipient: number, Body: rendered.Text}
+			if _, err := notify.QueueTx(tx, m); err != nil {
+				return false, err
+			}
+			channels = append(channels, m.Channel)
+		}
+	}
+	if len(channels) == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(insertReminder, p.id, dataType, strings.Join(channels, ","), now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// location time zone of the participant, else the study's, else UTC
+func location(names ...string) *time.Location {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+		log.Printf("unknown time zone %s\n", name)
+	}
+	return time.UTC
+}
+
+// quiet reports whether hour falls in the quiet hours. The range may wrap
+// around midnight, equal start and end means no quiet hours.
+func quiet(hour int, start int, end int) bool {
+	if start == end {
+		return false
+	}
+	if start < end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
@@ -0,0 +1,193 @@
+package sites
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	invalidBodyErr    = `{"error":"invalid request body"}`
+	noSiteErr         = `{"error":"no such site"}`
+	noParticipantErr  = `{"error":"no such participant in the study"}`
+	notCoordinatorErr = `{"error":"participant is not a coordinator"}`
+	hasParticipants   = `{"error":"site has participants, move them to another site first"}`
+	sitesFailedErr    = `{"error":"unable to update sites"}`
+)
+
+// SitesHandler lists and saves the sites of a study.
+// GET /api/studies/{study_id}/sites, POST with {"id":"emory","name":"Emory","alertTopic":""}
+type SitesHandler struct {
+	Name string
+}
+
+// SiteHandler deletes a site no participant belongs to.
+// DELETE /api/studies/{study_id}/sites/{site_id}
+type SiteHandler struct {
+	Name string
+}
+
+// CoordinatorSitesHandler sites a coordinator sees, an empty list lets the
+// coordinator see the whole study.
+// GET, PUT /api/studies/{study_id}/coordinators/{participant_id}/sites with {"sites":["emory"]}
+type CoordinatorSitesHandler struct {
+	Name string
+}
+
+// ParticipantSiteHandler moves a participant to a site.
+// PUT /api/studies/{study_id}/participants/{participant_id}/site with {"site":"emory"}
+type ParticipantSiteHandler struct {
+	Name string
+}
+
+// CoordinatorSitesRequest body of a coordinator sites update
+type CoordinatorSitesRequest struct {
+	Sites []string `json:"sites"`
+}
+
+// ParticipantSiteRequest body of a participant site update
+type ParticipantSiteRequest struct {
+	Site string `json:"site"`
+}
+
+func (h SitesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	study := mux.Vars(r)["study_id"]
+	switch r.Method {
+	case "GET":
+		sites, err := List(study)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sites)
+	case "POST":
+		var s Site
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.ID == "" {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(invalidBodyErr))
+			return
+		}
+		if err := Save(study, s); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Saved site %s of study %s\n", s.ID, study)
+		s, err := Get(study, s.ID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h SiteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := mux.Vars(r)
+	if err := Delete(params["study_id"], params["site_id"]); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Deleted site %s of study %s\n", params["site_id"], params["study_id"])
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h CoordinatorSitesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	study := params["study_id"]
+	coordinatorID, err := strconv.ParseInt(params["participant_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid participant id", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var csr CoordinatorSitesRequest
+		if err := json.NewDecoder(r.Body).Decode(&csr); err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(invalidBodyErr))
+			return
+		}
+		if err := SetCoordinatorSites(study, coordinatorID, csr.Sites); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Scoped coordinator %d to sites %v\n", coordinatorID, csr.Sites)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ids, err := CoordinatorSites(study, coordinatorID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, CoordinatorSitesRequest{Sites: ids})
+}
+
+func (h ParticipantSiteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := mux.Vars(r)
+	participantID, err := strconv.ParseInt(params["participant_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid participant id", http.StatusBadRequest)
+		return
+	}
+	var psr ParticipantSiteRequest
+	if err := json.NewDecoder(r.Body).Decode(&psr); err != nil {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(invalidBodyErr))
+		return
+	}
+	if err := SetParticipantSite(params["study_id"], participantID, psr.Site); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Moved participant %d to site %q\n", participantID, psr.Site)
+	writeJSON(w, http.StatusOK, psr)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	switch err {
+	case ErrNoSite:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(noSiteErr))
+	case ErrNoParticipant:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(noParticipantErr))
+	case ErrNotCoordinator:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(notCoordinatorErr))
+	case ErrHasParticipants:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(hasParticipants))
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(sitesFailedErr))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	resultsJSON, _ := json.Marshal(v)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(status)
+	w.Write(resultsJSON)
+}
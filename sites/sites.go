@@ -0,0 +1,237 @@
+package sites
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cliffordlab/amoss_services/database"
+)
+
+const (
+	selectSites = `SELECT site_id, name, alert_topic FROM sites WHERE study_id = $1 ORDER BY site_id`
+	selectSite  = `SELECT site_id, name, alert_topic FROM sites WHERE study_id = $1 AND site_id = $2`
+	upsertSite  = `INSERT INTO sites (study_id, site_id, name, alert_topic) VALUES ($1, $2, $3, $4)
+ON CONFLICT (study_id, site_id) DO UPDATE SET name = EXCLUDED.name, alert_topic = EXCLUDED.alert_topic`
+	deleteSite = `DELETE FROM sites WHERE study_id = $1 AND site_id = $2
+AND NOT EXISTS (SELECT 1 FROM participants WHERE study_id = $1 AND site_id = $2)`
+	selectCoordinatorSites = `SELECT site_id FROM coordinator_sites WHERE coordinator_id = $1 AND study_id = $2 ORDER BY site_id`
+	deleteCoordinatorSites = `DELETE FROM coordinator_sites WHERE coordinator_id = $1`
+	insertCoordinatorSite  = `INSERT INTO coordinator_sites (coordinator_id, study_id, site_id) VALUES ($1, $2, $3)`
+	selectCapacity         = `SELECT capacity_id FROM participants WHERE participant_id = $1 AND study_id = $2`
+	updateParticipantSite  = `UPDATE participants SET site_id = NULLIF($3, '') WHERE participant_id = $1 AND study_id = $2`
+	selectAlertTopic       = `SELECT s.alert_topic FROM participants p
+JOIN sites s ON s.study_id = p.study_id AND s.site_id = p.site_id WHERE p.participant_id = $1`
+	selectVisible = `SELECT 1 FROM participants p WHERE p.participant_id = $1 AND p.study_id = $2 AND `
+)
+
+var (
+	// ErrNoSite returned for a site that is not a site of the study
+	ErrNoSite = errors.New("no such site")
+	// ErrNoParticipant returned for a participant that is not in the study
+	ErrNoParticipant = errors.New("no such participant")
+	// ErrNotCoordinator returned when scoping a participant that is not a coordinator
+	ErrNotCoordinator = errors.New("participant is not a coordinator")
+	// ErrHasParticipants returned when deleting a site participants belong to
+	ErrHasParticipants = errors.New("site has participants")
+)
+
+// Site one site of a study
+type Site struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	AlertTopic string `json:"alertTopic"`
+}
+
+// Condition SQL condition limiting the participants' site column to the
+// sites of the coordinator passed as argument number coordinatorArg.
+// Coordinators without sites are not limited.
+func Condition(siteColumn string, coordinatorArg int) string {
+	return fmt.Sprintf(`(NOT EXISTS (SELECT 1 FROM coordinator_sites WHERE coordinator_id = $%[2]d)
+OR %[1]s IN (SELECT site_id FROM coordinator_sites WHERE coordinator_id = $%[2]d))`, siteColumn, coordinatorArg)
+}
+
+// List sites of a study
+func List(study string) ([]Site, error) {
+	rows, err := database.ADB.Db.Query(selectSites, study)
+	if err != nil {
+		log.Println("failed to query sites")
+		return nil, err
+	}
+	defer rows.Close()
+
+	sites := []Site{}
+	for rows.Next() {
+		var s Site
+		if err := rows.Scan(&s.ID, &s.Name, &s.AlertTopic); err != nil {
+			return nil, err
+		}
+		sites = append(sites, s)
+	}
+	return sites, rows.Err()
+}
+
+// Get one site of a study
+func Get(study string, id string) (Site, error) {
+	var s Site
+	err := database.ADB.Db.QueryRow(selectSite, study, id).Scan(&s.ID, &s.Name, &s.AlertTopic)
+	if err == sql.ErrNoRows {
+		return s, ErrNoSite
+	}
+	return s, err
+}
+
+// Save creates the site or replaces its name and alert topic
+func Save(study string, s Site) error {
+	if s.ID == "" {
+		return ErrNoSite
+	}
+	if s.Name == "" {
+		s.Name = s.ID
+	}
+	_, err := database.ADB.Db.Exec(upsertSite, study, s.ID, s.Name, s.AlertTopic)
+	return err
+}
+
+// Delete removes a site no participant belongs to
+func Delete(study string, id string) error {
+	if _, err := Get(study, id); err != nil {
+		return err
+	}
+	result, err := database.ADB.Db.Exec(deleteSite, study, id)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return ErrHasParticipants
+	}
+	return nil
+}
+
+// CoordinatorSites sites a coordinator is scoped to, empty when the
+// coordinator sees the whole study
+func CoordinatorSites(study string, coordinatorID int64) ([]string, error) {
+	rows, err := database.ADB.Db.Query(selectCoordinatorSites, coordinatorID, study)
+	if err != nil {
+		log.Println("failed to query coordinator sites")
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SetCoordinatorSites replaces the sites of a coordinator, no sites lets the
+// coordinator see the whole study
+func SetCoordinatorSites(study string, coordinatorID int64, siteIDs []string) error {
+	var capacity string
+	err := database.ADB.Db.QueryRow(selectCapacity, coordinatorID, study).Scan(&capacity)
+	if err == sql.ErrNoRows {
+		return ErrNoParticipant
+	}
+	if err != nil {
+		return err
+	}
+	if capacity != "coordinator" {
+		return ErrNotCoordinator
+	}
+	for _, id := range siteIDs {
+		if _, err := Get(study, id); err != nil {
+			return err
+		}
+	}
+
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(deleteCoordinatorSites, coordinatorID); err != nil {
+		return err
+	}
+	for _, id := range siteIDs {
+		if _, err := tx.Exec(insertCoordinatorSite, coordinatorID, study, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetParticipantSite moves a participant to a site of its study, an empty
+// site removes the participant from its site
+func SetParticipantSite(study string, participantID int64, siteID string) error {
+	if siteID != "" {
+		if _, err := Get(study, siteID); err != nil {
+			return err
+		}
+	}
+	result, err := database.ADB.Db.Exec(updateParticipantSite, participantID, study, siteID)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return ErrNoParticipant
+	}
+	return nil
+}
+
+// Visible reports whether the participant is in the study and at one of the
+// coordinator's sites
+func Visible(study string, coordinatorID int64, participantID int64) (bool, error) {
+	var one int
+	err := database.ADB.Db.QueryRow(selectVisible+Condition("p.site_id", 3), participantID, study, coordinatorID).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// AlertTopic topic the alerts of the participant's site go to, empty for the
+// default alert topic
+func AlertTopic(participantID int64) string {
+	var topic string
+	err := database.ADB.Db.QueryRow(selectAlertTopic, participantID).Scan(&topic)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("failed to read alert topic of participant %d: %s\n", participantID, err.Error())
+	}
+	return topic
+}
+
+// EnrollmentSite site a patient enrolled by the coordinator joins. Coordinators
+// scoped to sites only enroll at their sites, with a single site it is the
+// default. ok is false when the requested site is not available.
+func EnrollmentSite(study string, coordinatorID int64, requested string) (site string, ok bool) {
+	scoped, err := CoordinatorSites(study, coordinatorID)
+	if err != nil {
+		log.Println(err)
+		return "", false
+	}
+	if requested == "" {
+		if len(scoped) == 1 {
+			return scoped[0], true
+		}
+		return "", len(scoped) == 0
+	}
+	if _, err := Get(study, requested); err != nil {
+		return "", false
+	}
+	if len(scoped) == 0 {
+		return requested, true
+	}
+	for _, id := range scoped {
+		if id == requested {
+			return requested, true
+		}
+	}
+	return "", false
+}
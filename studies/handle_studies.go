@@ -0,0 +1,131 @@
+package studies
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	invalidBodyErr  = `{"error":"body must be a study as json"}`
+	studyFailedErr  = `{"error":"unable to save study"}`
+	queryFailedErr  = `{"error":"unable to query studies"}`
+	noStudyErr      = `{"error":"no such study"}`
+	studyExistsErr  = `{"error":"study already exists"}`
+	hasParticipants = `{"error":"study has participants, set its status to closed instead"}`
+)
+
+// StudiesHandler lists and creates studies.
+// GET /api/studies, POST /api/studies with a study
+type StudiesHandler struct {
+	Name string
+}
+
+// StudyHandler reads, updates and deletes one study. A PUT changes the fields
+// it sends and the alert rules it lists.
+// GET, PUT, DELETE /api/studies/{study_id}
+type StudyHandler struct {
+	Name string
+}
+
+func (h StudiesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		studies, err := List()
+		if err != nil {
+			log.Println(err)
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(queryFailedErr))
+			return
+		}
+		writeJSON(w, http.StatusOK, studies)
+	case "POST":
+		var s Study
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(invalidBodyErr))
+			return
+		}
+		s, err := Create(s)
+		writeStudy(w, http.StatusCreated, s, err)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h StudyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["study_id"]
+	switch r.Method {
+	case "GET":
+		s, err := Get(id)
+		writeStudy(w, http.StatusOK, s, err)
+	case "PUT":
+		s, err := Get(id)
+		if err != nil {
+			writeStudy(w, http.StatusOK, s, err)
+			return
+		}
+		// the body is read over the current settings, only listed rules change
+		s.AlertRules = nil
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(invalidBodyErr))
+			return
+		}
+		s.ID = id
+		s, err = Update(s)
+		writeStudy(w, http.StatusOK, s, err)
+	case "DELETE":
+		err := Delete(id)
+		if err != nil {
+			writeStudy(w, http.StatusOK, Study{}, err)
+			return
+		}
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeStudy(w http.ResponseWriter, status int, s Study, err error) {
+	if err == nil {
+		writeJSON(w, status, s)
+		return
+	}
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	switch err.(type) {
+	case ValidationError:
+		body, _ := json.Marshal(map[string]string{"error": err.Error()})
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(body)
+		return
+	}
+	switch err {
+	case ErrNoStudy:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(noStudyErr))
+	case ErrStudyExists:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(studyExistsErr))
+	case ErrHasParticipants:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(hasParticipants))
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(studyFailedErr))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	resultsJSON, _ := json.Marshal(v)
+	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	w.WriteHeader(status)
+	w.Write(resultsJSON)
+}
@@ -0,0 +1,318 @@
+package studies
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cliffordlab/amoss_services/alerts"
+	"github.com/cliffordlab/amoss_services/database"
+	"github.com/cliffordlab/amoss_services/ingest"
+)
+
+const (
+	StatusActive = "active"
+	StatusPaused = "paused"
+	StatusClosed = "closed"
+
+	defaultTokenLifetimeDays = 365
+	dateLayout               = "2006-01-02"
+
+	selectStudies = `SELECT study_id, name, status, to_char(start_date, 'YYYY-MM-DD'), to_char(end_date, 'YYYY-MM-DD'),
+token_lifetime_days, s3_prefix, apk_key FROM studies`
+	selectStudy      = selectStudies + ` WHERE study_id = $1`
+	selectAllStudies = selectStudies + ` ORDER BY study_id`
+	selectFileTypes  = `SELECT file_type FROM study_file_types WHERE study_id = $1 ORDER BY file_type`
+	deleteFileTypes  = `DELETE FROM study_file_types WHERE study_id = $1`
+	insertFileType   = `INSERT INTO study_file_types (study_id, file_type) VALUES ($1, $2)`
+	insertStudy      = `INSERT INTO studies (study_id) VALUES ($1) ON CONFLICT (study_id) DO NOTHING`
+	updateStudy      = `UPDATE studies SET name = $2, status = $3, start_date = $4::date, end_date = $5::date,
+token_lifetime_days = $6, s3_prefix = $7, apk_key = $8 WHERE study_id = $1`
+	deleteStudy = `DELETE FROM studies WHERE study_id = $1
+AND NOT EXISTS (SELECT 1 FROM participants WHERE study_id = $1)`
+	deleteStudyRules = `DELETE FROM alert_rules WHERE study_id = $1 AND participant_id IS NULL`
+)
+
+var (
+	// ErrNoStudy returned for an unknown study id
+	ErrNoStudy = errors.New("no such study")
+	// ErrStudyExists returned when creating a study id that is taken
+	ErrStudyExists = errors.New("study already exists")
+	// ErrHasParticipants returned when deleting a study that enrolled participants, close it instead
+	ErrHasParticipants = errors.New("study has participants, set its status to closed instead")
+)
+
+// Study settings of one study. FileTypes empty accepts every known file
+// type. AlertRules are the effective study rules, on writes only the listed
+// kinds are changed.
+type Study struct {
+	ID                string        `json:"id"`
+	Name              string        `json:"name"`
+	Status            string        `json:"status"`
+	StartDate         *string       `json:"startDate"`
+	EndDate           *string       `json:"endDate"`
+	FileTypes         []string      `json:"fileTypes"`
+	TokenLifetimeDays int           `json:"tokenLifetimeDays"`
+	S3Prefix          string        `json:"s3Prefix"`
+	APKKey            string        `json:"apkKey"`
+	AlertRules        []alerts.Rule `json:"alertRules"`
+}
+
+// ValidationError a study that cannot be saved as sent
+type ValidationError struct {
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Message
+}
+
+func (s Study) validate() error {
+	if s.ID == "" {
+		return ValidationError{"id is required"}
+	}
+	switch s.Status {
+	case StatusActive, StatusPaused, StatusClosed:
+	default:
+		return ValidationError{"status must be active, paused or closed"}
+	}
+	var start, end time.Time
+	var err error
+	if s.StartDate != nil {
+		if start, err = time.Parse(dateLayout, *s.StartDate); err != nil {
+			return ValidationError{"startDate must be YYYY-MM-DD"}
+		}
+	}
+	if s.EndDate != nil {
+		if end, err = time.Parse(dateLayout, *s.EndDate); err != nil {
+			return ValidationError{"endDate must be YYYY-MM-DD"}
+		}
+	}
+	if s.StartDate != nil && s.EndDate != nil && end.Before(start) {
+		return ValidationError{"endDate is before startDate"}
+	}
+	if s.TokenLifetimeDays <= 0 {
+		return ValidationError{"tokenLifetimeDays must be positive"}
+	}
+	for _, t := range s.FileTypes {
+		if ingest.ContentType(t) == "" {
+			return ValidationError{"unknown file type " + t}
+		}
+	}
+	return nil
+}
+
+// scanner is a *sql.Row or *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanStudy(row scanner) (Study, error) {
+	var s Study
+	var start, end sql.NullString
+	err := row.Scan(&s.ID, &s.Name, &s.Status, &start, &end, &s.TokenLifetimeDays, &s.S3Prefix, &s.APKKey)
+	if err != nil {
+		return s, err
+	}
+	if start.Valid {
+		s.StartDate = &start.String
+	}
+	if end.Valid {
+		s.EndDate = &end.String
+	}
+	return s, nil
+}
+
+// Get one study with its file types and alert rules
+func Get(id string) (Study, error) {
+	s, err := scanStudy(database.ADB.Db.QueryRow(selectStudy, id))
+	if err == sql.ErrNoRows {
+		return s, ErrNoStudy
+	}
+	if err != nil {
+		return s, err
+	}
+	if s.FileTypes, err = fileTypes(id); err != nil {
+		return s, err
+	}
+	s.AlertRules, err = alerts.RulesFor(id, 0)
+	return s, err
+}
+
+// List every study without file types and alert rules
+func List() ([]Study, error) {
+	rows, err := database.ADB.Db.Query(selectAllStudies)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	studies := []Study{}
+	for rows.Next() {
+		s, err := scanStudy(rows)
+		if err != nil {
+			return nil, err
+		}
+		studies = append(studies, s)
+	}
+	return studies, rows.Err()
+}
+
+func fileTypes(id string) ([]string, error) {
+	rows, err := database.ADB.Db.Query(selectFileTypes, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := []string{}
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, rows.Err()
+}
+
+// Create adds a study. Unset status and token lifetime get the defaults.
+func Create(s Study) (Study, error) {
+	if s.Status == "" {
+		s.Status = StatusActive
+	}
+	if s.TokenLifetimeDays == 0 {
+		s.TokenLifetimeDays = defaultTokenLifetimeDays
+	}
+	if s.Name == "" {
+		s.Name = s.ID
+	}
+	return save(s, true)
+}
+
+// Update replaces the settings of an existing study
+func Update(s Study) (Study, error) {
+	return save(s, false)
+}
+
+func save(s Study, create bool) (Study, error) {
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return s, err
+	}
+	defer tx.Rollback()
+
+	if create {
+		result, err := tx.Exec(insertStudy, s.ID)
+		if err != nil {
+			return s, err
+		}
+		if inserted, _ := result.RowsAffected(); inserted == 0 {
+			return s, ErrStudyExists
+		}
+	}
+	result, err := tx.Exec(updateStudy, s.ID, s.Name, s.Status, s.StartDate, s.EndDate,
+		s.TokenLifetimeDays, s.S3Prefix, s.APKKey)
+	if err != nil {
+		return s, err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return s, ErrNoStudy
+	}
+	if _, err := tx.Exec(deleteFileTypes, s.ID); err != nil {
+		return s, err
+	}
+	for _, t := range s.FileTypes {
+		if _, err := tx.Exec(insertFileType, s.ID, t); err != nil {
+			return s, err
+		}
+	}
+	if err := alerts.SaveStudyRules(tx, s.ID, s.AlertRules); err != nil {
+		return s, ValidationError{err.Error()}
+	}
+	if err := tx.Commit(); err != nil {
+		return s, err
+	}
+	log.Printf("Saved settings of study %s\n", s.ID)
+	return Get(s.ID)
+}
+
+// Delete removes a study that never enrolled anyone
+func Delete(id string) error {
+	if _, err := Get(id); err != nil {
+		return err
+	}
+	tx, err := database.ADB.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(deleteStudy, id)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return ErrHasParticipants
+	}
+	if _, err := tx.Exec(deleteFileTypes, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(deleteStudyRules, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Enrolling reports whether the study exists and accepts new participants
+func Enrolling(id string) (bool, error) {
+	s, err := scanStudy(database.ADB.Db.QueryRow(selectStudy, id))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return s.Status == StatusActive, nil
+}
+
+// TokenLifetime how long the tokens of the study's users are valid. Unknown
+// studies and lookup failures get the default of a year.
+func TokenLifetime(id string) time.Duration {
+	days := defaultTokenLifetimeDays
+	s, err := scanStudy(database.ADB.Db.QueryRow(selectStudy, id))
+	if err == nil {
+		days = s.TokenLifetimeDays
+	} else if err != sql.ErrNoRows {
+		log.Printf("failed to read token lifetime of study %s: %s\n", id, err.Error())
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// KeyPrefix folder of the study's uploads in s3, the study id unless the study sets one
+func KeyPrefix(id string) string {
+	s, err := scanStudy(database.ADB.Db.QueryRow(selectStudy, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("failed to read s3 prefix of study %s: %s\n", id, err.Error())
+		}
+		return id
+	}
+	if s.S3Prefix == "" {
+		return id
+	}
+	return s.S3Prefix
+}
+
+// APKKey key of the app the study's participants download, empty when none
+func APKKey(id string) (string, error) {
+	s, err := scanStudy(database.ADB.Db.QueryRow(selectStudy, id))
+	if err == sql.ErrNoRows {
+		return "", ErrNoStudy
+	}
+	return s.APKKey, err
+}
@@ -1,78 +1,45 @@
 package moyo_mom_emory
 
 import (
-	"fmt"
+	"database/sql"
+	"errors"
 	"log"
-	"os"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/cliffordlab/amoss_services/notify"
 )
 
-func SendVitalEmail(msg *string) {
-	log.Print("Attempting to send vital threshold email to clinician..")
-
-	if *msg == "" {
-		fmt.Println("You must supply a message and topic ARN")
-		fmt.Println("Usage: go run SnsPublish.go -m MESSAGE -t TOPIC-ARN")
-		os.Exit(1)
-	}
-
-	svc := sns.New(session.New(&aws.Config{Region: aws.String("us-east-1")}))
-
-	result, err := svc.Publish(&sns.PublishInput{
-		Subject:  aws.String("(URGENT)Moyo Mom Emory Study: THRESHOLD REACHED"),
-		Message:  msg,
-		TopicArn: aws.String(vault.arnTopic),
-	})
-
-	//sendSMS(msg, result, err, svc)
-
-	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
-	}
+const alertSubject = "(URGENT)Moyo Mom Emory Study: THRESHOLD REACHED"
 
-	fmt.Println(*result.MessageId)
+// SendVitalEmail queues a vitals alert for the clinicians' alert topic, an
+// empty topic is the default alert topic
+func SendVitalEmail(topic string, msg *string) error {
+	log.Print("Attempting to send vital threshold email to clinician..")
+	return queueAlert(topic, msg)
 }
 
-func SendSymptomsEmail(msg *string) {
+// SendSymptomsEmail queues a symptoms alert for the clinicians' alert topic, an
+// empty topic is the default alert topic
+func SendSymptomsEmail(topic string, msg *string) error {
 	log.Print("Attempting to send symptom threshold email to clinician..")
+	return queueAlert(topic, msg)
+}
 
+func queueAlert(topic string, msg *string) error {
 	if *msg == "" {
-		fmt.Println("You must supply a message and topic ARN")
-		fmt.Println("Usage: go run SnsPublish.go -m MESSAGE -t TOPIC-ARN")
-		os.Exit(1)
+		return errors.New("you must supply a message")
 	}
+	_, err := notify.Queue(notify.Message{Channel: notify.ChannelTopic, Recipient: topic, Subject: alertSubject, Body: *msg})
+	return err
+}
 
-	svc := sns.New(session.New(&aws.Config{Region: aws.String("us-east-1")}))
-
-	result, err := svc.Publish(&sns.PublishInput{
-		Subject:  aws.String("(URGENT)Moyo Mom Emory Study: THRESHOLD REACHED"),
-		Message:  msg,
-		TopicArn: aws.String("vault.arnTopic"),
-	})
-
-	//sendSMS(msg, result, err, svc)
+// SendEscalationSMS queues a text of an escalated alert to a secondary
+// contact as part of the caller's transaction
+func SendEscalationSMS(tx *sql.Tx, phone string, msg *string) error {
+	log.Print("Attempting to send escalation SMS to secondary contact..")
 
-	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
+	if *msg == "" || phone == "" {
+		return errors.New("you must supply a message and phone number")
 	}
-
-	fmt.Println(*result.MessageId)
+	_, err := notify.QueueTx(tx, notify.Message{Channel: notify.ChannelSMS, Recipient: phone, Body: *msg})
+	return err
 }
-
-//
-//func sendSMS(msg *string, result *sns.PublishOutput, err error, svc *sns.SNS) {
-//	log.Print("Attempting to send vital threshold SMS to clinician..")
-//	result, err = svc.Publish(&sns.PublishInput{
-//		PhoneNumber: aws.String("+16786876602"),
-//		Message:  msg,
-//	})
-//	if err != nil {
-//		fmt.Println(err.Error())
-//		os.Exit(1)
-//	}
-//}
@@ -3,6 +3,7 @@ package vault
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -15,12 +16,28 @@ var (
 	mutex sync.Mutex
 )
 
+// defaultEmailLambdaURL lambda participant emails were sent through before
+// the url was read from vault
+const defaultEmailLambdaURL = "https://w5k4kp7yt1.execute-api.us-east-1.amazonaws.com/default/sendMoyoBetaEmail"
+
 type amossCreds struct {
 	DBAddr   string
 	DBUser   string
 	DBUserPW string
 }
 
+// NotificationConfig where alerts and participant emails are delivered.
+// Keys missing from vault are left empty, except EmailLambdaURL which falls
+// back to the lambda used before.
+type NotificationConfig struct {
+	AlertTopicArn  string
+	EmailLambdaURL string
+	SMTPAddr       string
+	SMTPUser       string
+	SMTPPassword   string
+	SMTPFrom       string
+}
+
 type vaultClient struct {
 	client          *api.Client
 	dbLeaseID       string
@@ -149,6 +166,33 @@ func (v *vaultClient) GetDbCreds(path string) (amossCreds, error) {
 	return creds, nil
 }
 
+// GetNotificationConfig reads the notification settings from vault
+func (v *vaultClient) GetNotificationConfig(path string) (NotificationConfig, error) {
+	secret, err := v.client.Logical().Read(path)
+	var config NotificationConfig
+	if err != nil {
+		return config, err
+	}
+	if secret == nil {
+		return config, fmt.Errorf("no notification settings at %s", path)
+	}
+
+	optional := func(key string) string {
+		value, _ := secret.Data[key].(string)
+		return value
+	}
+	config.AlertTopicArn = optional("ALERT_TOPIC_ARN")
+	config.EmailLambdaURL = optional("EMAIL_LAMBDA_URL")
+	if config.EmailLambdaURL == "" {
+		config.EmailLambdaURL = defaultEmailLambdaURL
+	}
+	config.SMTPAddr = optional("SMTP_ADDR")
+	config.SMTPUser = optional("SMTP_USER")
+	config.SMTPPassword = optional("SMTP_PASSWORD")
+	config.SMTPFrom = optional("SMTP_FROM")
+	return config, nil
+}
+
 func (v *vaultClient) AutomateVaultTokenRenewal() error {
 	timeToLive, err := v.getTokenTimeToLive()
 	log.Println("This is the token TTL(Time To Live) left:", timeToLive)